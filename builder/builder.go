@@ -1,7 +1,12 @@
 package builder
 
 import (
+	"context"
+	"encoding/json"
 	core "fproxy/core"
+	"fproxy/stats"
+	store "fproxy/store"
+	"github.com/golang/glog"
 )
 
 //处理结果
@@ -14,3 +19,31 @@ const (
 type Builder interface {
 	build() (int, core.Proxy)
 }
+
+/*
+*候选代理去重后序列化，返回待放入检测队列的json及被过滤的数量，爬取、扫描及导入共用
+*去重出错时不过滤
+ */
+func PrepareCandidates(ctx context.Context, dedup *store.Deduper, proxies []core.Proxy) ([]string, int) {
+	proxies, suppressed, err := dedup.Filter(ctx, proxies)
+	if err != nil {
+		glog.Errorln("dedup candidate proxies error: ", err)
+	}
+	candidates := make([]string, 0, len(proxies))
+	for _, proxy := range proxies {
+		bs, err := json.Marshal(proxy)
+		if err != nil {
+			glog.Errorln("marshal candidate proxy ", proxy.Addr(), " error: ", err)
+			continue
+		}
+		candidates = append(candidates, string(bs))
+	}
+	return candidates, suppressed
+}
+
+//在批量写入中放入检测队列，并按来源记录发现及被过滤的数量
+func PushCandidates(pipe store.Pipeliner, recorder *stats.Recorder, source string, candidates []string, suppressed int) {
+	pipe.Rpush(core.PROXY_CHECK_QUEUE, candidates...)
+	recorder.IncrPipelined(pipe, stats.METRIC_DISCOVERED, source, int64(len(candidates)))
+	recorder.IncrPipelined(pipe, stats.METRIC_SUPPRESSED, source, int64(suppressed))
+}
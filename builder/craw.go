@@ -1,11 +1,13 @@
 package builder
 
 import (
+	"context"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	core "fproxy/core"
+	"fproxy/stats"
 	store "fproxy/store"
 	"github.com/golang/glog"
 	"io/ioutil"
@@ -27,32 +29,38 @@ type CrawTask struct {
 }
 
 type Crawler interface {
-	Craw()
+	Craw(ctx context.Context)
 }
 
 type SimpleCrawler struct {
 	UserAgent string
 	Tasks     []CrawTask
 	Random    *rand.Rand
-	Redis     *store.RedisManager
+	Store     store.ProxyStore
+	Dedup     *store.Deduper
+	Stats     *stats.Recorder
 	Distance  int
 }
 
-func NewSimpleCrawler(userAgent string, tasks []CrawTask, redis *store.RedisManager, distance int) *SimpleCrawler {
+func NewSimpleCrawler(userAgent string, tasks []CrawTask, proxyStore store.ProxyStore, distance int, dedupTTL time.Duration, recorder *stats.Recorder) *SimpleCrawler {
 	source := rand.NewSource(rand.Int63())
 	random := rand.New(source)
-	return &SimpleCrawler{UserAgent: userAgent, Tasks: tasks, Random: random, Redis: redis, Distance: distance}
+	dedup := store.NewDeduper(proxyStore, dedupTTL)
+	return &SimpleCrawler{UserAgent: userAgent, Tasks: tasks, Random: random, Store: proxyStore, Dedup: dedup, Stats: recorder, Distance: distance}
 }
 
-func (c *SimpleCrawler) Craw() {
+func (c *SimpleCrawler) Craw(ctx context.Context) {
 	tasks := c.Tasks
 	for _, task := range tasks {
-		c.crawTask(task)
+		if ctx.Err() != nil {
+			return
+		}
+		c.crawTask(ctx, task)
 	}
 }
 
-func (c *SimpleCrawler) crawTask(task CrawTask) {
-	if task.Level >= task.MaxLevel {
+func (c *SimpleCrawler) crawTask(ctx context.Context, task CrawTask) {
+	if task.Level >= task.MaxLevel || ctx.Err() != nil {
 		return
 	}
 	waitTime := time.Duration(c.Random.Intn(task.WaitTime)) * time.Second
@@ -67,7 +75,7 @@ func (c *SimpleCrawler) crawTask(task CrawTask) {
 		glog.Errorln("craw task process template {"+task.Url+"} error: ", err)
 		return
 	}
-	c.processCrawResults(task, crawResults)
+	c.processCrawResults(ctx, task, crawResults)
 }
 
 func (c *SimpleCrawler) downloadHtml(task CrawTask) (string, error) {
@@ -97,27 +105,27 @@ func (c *SimpleCrawler) downloadHtml(task CrawTask) (string, error) {
 	return string(html), nil
 }
 
-func (s *SimpleCrawler) processCrawResults(srcTask CrawTask, crawResults []CrawResult) {
+func (s *SimpleCrawler) processCrawResults(ctx context.Context, srcTask CrawTask, crawResults []CrawResult) {
 	crawResultMap := mapCrawResults(crawResults)
+	var proxies []core.Proxy
+	var ipArr []string
 	ipAndPortsResult, ok := crawResultMap["ip_port"]
 	if ok {
-		ipArr := s.processIPWithPorts(ipAndPortsResult)
-		if ipArr != nil {
-			s.createAndPushIPSections(ipArr)
-		}
+		proxies, ipArr = s.processIPWithPorts(srcTask, ipAndPortsResult)
 	} else {
 		ipResult, ok1 := crawResultMap["ip"]
 		portResult, ok2 := crawResultMap["port"]
 		if ok1 && ok2 {
-			ipArr := s.processIPAndPorts(ipResult, portResult)
-			if ipArr != nil {
-				s.createAndPushIPSections(ipArr)
-			}
+			proxies, ipArr = s.processIPAndPorts(srcTask, ipResult, portResult)
 		}
 	}
+	err := s.flushCrawPage(ctx, proxies, ipArr)
+	if err != nil {
+		glog.Errorln("flush craw page {"+srcTask.Url+"} error: ", err)
+	}
 	pageResult, ok := crawResultMap["page"]
 	if ok {
-		s.processPages(srcTask, pageResult)
+		s.processPages(ctx, srcTask, pageResult)
 	}
 }
 
@@ -132,15 +140,16 @@ func mapCrawResults(crawResults []CrawResult) map[string]CrawResult {
 	return resultMap
 }
 
-func (s *SimpleCrawler) processIPWithPorts(crawResult CrawResult) []string {
+func (s *SimpleCrawler) processIPWithPorts(srcTask CrawTask, crawResult CrawResult) ([]core.Proxy, []string) {
 	if crawResult.Value == "" {
-		return nil
+		return nil, nil
 	}
 	ipPortsArr := strings.Split(crawResult.Value, ",")
 	ipslen := len(ipPortsArr)
 	if ipslen == 0 {
-		return nil
+		return nil, nil
 	}
+	proxies := make([]core.Proxy, 0, ipslen)
 	ipArr := make([]string, ipslen)
 	for i, ipPortStr := range ipPortsArr {
 		ipPortArr := strings.Split(ipPortStr, ":")
@@ -150,19 +159,20 @@ func (s *SimpleCrawler) processIPWithPorts(crawResult CrawResult) []string {
 			glog.Errorln("process ip with port error[", ipPortStr, "]: ", err)
 			continue
 		}
-		proxy := core.Proxy{Ip: ip, Port: port, Source: core.PROXY_SOURCE_CRAW}
-		s.pushProxyForCheck(proxy)
+		proxy := core.NewProxy(ip, port, core.PROXY_SOURCE_CRAW, srcTask.Url)
+		proxies = append(proxies, proxy)
 		ipArr[i] = ip
 	}
-	return ipArr
+	return proxies, ipArr
 }
 
-func (s *SimpleCrawler) processIPAndPorts(ipResult CrawResult, portResult CrawResult) []string {
+func (s *SimpleCrawler) processIPAndPorts(srcTask CrawTask, ipResult CrawResult, portResult CrawResult) ([]core.Proxy, []string) {
 	if ipResult.Value == "" {
-		return nil
+		return nil, nil
 	}
 	ipsArr := strings.Split(ipResult.Value, ",")
 	portsArr := strings.Split(portResult.Value, ",")
+	proxies := make([]core.Proxy, 0, len(ipsArr))
 	for i, ip := range ipsArr {
 		port, err := strconv.Atoi(portsArr[i])
 		glog.Infoln("process ip and port: ", ip, ", ", port)
@@ -170,13 +180,13 @@ func (s *SimpleCrawler) processIPAndPorts(ipResult CrawResult, portResult CrawRe
 			glog.Errorln("process ip and port error[", ip, ":", portsArr[i], "]: ", err)
 			continue
 		}
-		proxy := core.Proxy{Ip: ip, Port: port, Source: core.PROXY_SOURCE_CRAW}
-		s.pushProxyForCheck(proxy)
+		proxy := core.NewProxy(ip, port, core.PROXY_SOURCE_CRAW, srcTask.Url)
+		proxies = append(proxies, proxy)
 	}
-	return ipsArr
+	return proxies, ipsArr
 }
 
-func (s *SimpleCrawler) processPages(srcTask CrawTask, pageResult CrawResult) {
+func (s *SimpleCrawler) processPages(ctx context.Context, srcTask CrawTask, pageResult CrawResult) {
 	if pageResult.Value == "" {
 		return
 	}
@@ -187,29 +197,31 @@ func (s *SimpleCrawler) processPages(srcTask CrawTask, pageResult CrawResult) {
 
 		}
 		newTask := CrawTask{Url: newUrl, UserAgent: srcTask.UserAgent, Template: srcTask.Template, WaitTime: srcTask.WaitTime, Level: srcTask.Level + 1}
-		s.crawTask(newTask)
+		s.crawTask(ctx, newTask)
 	}
 }
 
-func (s *SimpleCrawler) pushProxyForCheck(proxy core.Proxy) {
-	jsonBytes, err := json.Marshal(proxy)
-	if err != nil {
-		glog.Errorln("push craw proxy ", proxy, " for check parse json error: ", err)
-		return
+//一个页面的候选代理与ip段在一次管道中写入
+func (s *SimpleCrawler) flushCrawPage(ctx context.Context, proxies []core.Proxy, ipArr []string) error {
+	candidates, suppressed := PrepareCandidates(ctx, s.Dedup, proxies)
+	if suppressed > 0 {
+		glog.Infoln("craw page suppressed ", suppressed, " duplicate proxies")
 	}
-	s.Redis.Rpush(core.PROXY_CHECK_QUEUE, string(jsonBytes))
-}
-
-func (s *SimpleCrawler) createAndPushIPSections(ipArr []string) {
-	ipSections := createIPSections(ipArr, s.Distance)
-	for _, ipSection := range ipSections {
-		bs, err := json.Marshal(ipSection)
-		if err != nil {
-			glog.Errorln("marshal craw ip section[", ipSection, "] error: ", err)
-			continue
+	sections := make([]string, 0)
+	if len(ipArr) > 0 {
+		for _, ipSection := range createIPSections(ipArr, s.Distance) {
+			bs, err := json.Marshal(ipSection)
+			if err != nil {
+				glog.Errorln("marshal craw ip section[", ipSection, "] error: ", err)
+				continue
+			}
+			sections = append(sections, string(bs))
 		}
-		s.Redis.Rpush(KEY_SCAN_TASK, string(bs))
 	}
+	return s.Store.Pipelined(ctx, func(pipe store.Pipeliner) {
+		PushCandidates(pipe, s.Stats, core.PROXY_SOURCE_CRAW, candidates, suppressed)
+		pipe.Rpush(KEY_SCAN_TASK, sections...)
+	})
 }
 
 func createIPSections(ipArr []string, distance int) []IPSection {
@@ -2,6 +2,7 @@ package builder
 
 import (
 	"container/list"
+	"context"
 	"encoding/json"
 	store "fproxy/store"
 	"github.com/golang/glog"
@@ -16,12 +17,12 @@ type IPSection struct {
 }
 
 type IPSectionManager struct {
-	Redis    *store.RedisManager
+	Store    store.ProxyStore
 	Distance int
 }
 
-func (i *IPSectionManager) MergeStoreSections() {
-	secSize, err := i.Redis.Len(KEY_SCAN_TASK)
+func (i *IPSectionManager) MergeStoreSections(ctx context.Context) {
+	secSize, err := i.Store.Len(ctx, KEY_SCAN_TASK)
 	if err != nil {
 		glog.Errorln("redis command len error", err)
 		return
@@ -29,42 +30,72 @@ func (i *IPSectionManager) MergeStoreSections() {
 	if secSize <= 100 {
 		return
 	}
-	newkey := KEY_SCAN_TASK + ":check"
-	i.Redis.Rename(KEY_SCAN_TASK, newkey)
-	values, err := i.Redis.Lrange(newkey, 0, secSize)
+	//hash tag保证集群模式下与扫描队列位于同一槽位
+	newkey := "{" + KEY_SCAN_TASK + "}:check"
+	err = i.Store.Rename(ctx, KEY_SCAN_TASK, newkey)
+	if err != nil {
+		glog.Errorln("rename ip section queue error: ", err)
+		return
+	}
+	values, err := i.Store.Lrange(ctx, newkey, 0, secSize)
 	if err != nil {
 		glog.Errorln("lrange ip section error: ", err)
-		i.Redis.RpopLpush(newkey, KEY_SCAN_TASK)
+		i.restoreSections(ctx, newkey)
+		return
 	}
 	ipSections, err := i.doMerge(values)
 	if err != nil {
 		glog.Errorln("merge ip section error: ", err)
-		i.Redis.RpopLpush(newkey, KEY_SCAN_TASK)
+		i.restoreSections(ctx, newkey)
+		return
+	}
+	err = i.pushIPSections(ctx, ipSections)
+	if err != nil {
+		glog.Errorln("push merged ip sections error: ", err)
+		i.restoreSections(ctx, newkey)
+		return
+	}
+	err = i.Store.Del(ctx, newkey)
+	if err != nil {
+		glog.Errorln("delete merged ip sections error: ", err)
 	}
-	i.pushIPSections(ipSections)
-	i.Redis.Del(newkey)
 }
 
-func (i *IPSectionManager) pushIPSections(ipSections []*IPSection) {
+//合并失败时将原ip段放回扫描队列
+func (i *IPSectionManager) restoreSections(ctx context.Context, key string) {
+	for {
+		_, err := i.Store.RpopLpush(ctx, key, KEY_SCAN_TASK)
+		if err != nil {
+			if err != store.ErrNil {
+				glog.Errorln("restore ip sections error: ", err)
+			}
+			return
+		}
+	}
+}
+
+func (i *IPSectionManager) pushIPSections(ctx context.Context, ipSections []*IPSection) error {
 	if ipSections == nil {
-		return
+		return nil
 	}
+	values := make([]string, 0, len(ipSections))
 	for _, ipSection := range ipSections {
 		bVal, err := json.Marshal(ipSection)
 		if err != nil {
 			glog.Errorln("ip section manage marshal ip section error[", ipSection.Start, ", ", ipSection.End, ", ", ipSection.ProxyNum, "]: ", err)
-			return
+			return err
 		}
-		i.Redis.Rpush(KEY_SCAN_TASK, string(bVal))
+		values = append(values, string(bVal))
 	}
+	return i.Store.Rpush(ctx, KEY_SCAN_TASK, values...)
 }
 
-func (i *IPSectionManager) doMerge(sections [][]byte) ([]*IPSection, error) {
+func (i *IPSectionManager) doMerge(sections []string) ([]*IPSection, error) {
 	size := len(sections)
 	ipSections := make([]*IPSection, size)
 	for i, v := range sections {
 		ipSection := &IPSection{}
-		err := json.Unmarshal(v, ipSection)
+		err := json.Unmarshal([]byte(v), ipSection)
 		if err != nil {
 			return nil, err
 		}
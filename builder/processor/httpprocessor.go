@@ -1,11 +1,9 @@
 package processor
 
 import (
-	"encoding/json"
 	"fmt"
 	"fproxy/core"
 	"fproxy/httputil"
-	"fproxy/store"
 	"github.com/golang/glog"
 	"math/rand"
 )
@@ -15,7 +13,6 @@ const KEY_PROXY_CACHE = "proxy:valid:"
 type HttpProcessor struct {
 	UserAgent     string
 	CheckRequests []CheckRequest
-	RedisManager  *store.RedisManager
 	RequestRand   *rand.Rand
 }
 
@@ -23,10 +20,11 @@ func (h *HttpProcessor) SetCheckRequests(checkRequests []CheckRequest) {
 	h.CheckRequests = checkRequests
 }
 
-func (h *HttpProcessor) Process(proxy core.Proxy) int {
+func (h *HttpProcessor) Process(proxy *core.Proxy) int {
 	request := h.selectRequest()
 	result := h.processOne(request, proxy.Ip, proxy.Port)
 	if result == SUCCESS {
+		proxy.Protocol = core.PROXY_PROTOCOL_HTTP
 		return result
 	}
 	return FAIL
@@ -53,14 +51,9 @@ func (h *HttpProcessor) processOne(request CheckRequest, ip string, port int) in
 	return FAIL
 }
 
+//扫描结果由Scanner按ip段批量写入检测队列
 func (h *HttpProcessor) OnSuccess(proxy core.Proxy) {
 	glog.Infoln("scan find proxy: ", proxy)
-	bs, err := json.Marshal(proxy)
-	if err != nil {
-		glog.Errorln("http processor marshal proxy error: ", err)
-		return
-	}
-	h.RedisManager.Rpush(core.PROXY_CHECK_QUEUE, string(bs))
 }
 
 func (h *HttpProcessor) OnFail(proxy core.Proxy) {
@@ -10,7 +10,8 @@ const (
 )
 
 type Processor interface {
-	Process(proxy core.Proxy) int
+	//检测成功时处理器可设置代理的协议
+	Process(proxy *core.Proxy) int
 	OnSuccess(proxy core.Proxy)
 	OnFail(proxy core.Proxy)
 }
@@ -2,7 +2,6 @@ package processor
 
 import (
 	"fproxy/core"
-	"fproxy/store"
 	"math/rand"
 )
 
@@ -10,23 +9,43 @@ type ChainProcessor struct {
 	Processors []Processor
 }
 
-func (c *ChainProcessor) Process(proxy core.Proxy) int {
+//依次执行全部处理器，第一个成功的处理器设置的协议作为代理的协议
+func (c *ChainProcessor) Process(proxy *core.Proxy) int {
 	finalResult := 0
 	for _, processor := range c.Processors {
-		result := processor.Process(proxy)
+		candidate := *proxy
+		result := processor.Process(&candidate)
 		if result == SUCCESS {
-			processor.OnSuccess(proxy)
+			processor.OnSuccess(candidate)
+			if finalResult == 0 {
+				*proxy = candidate
+			}
 		} else {
-			processor.OnFail(proxy)
+			processor.OnFail(candidate)
 		}
 		finalResult += result
 	}
 	return finalResult
 }
 
-func NewChainProcessor(redisManager *store.RedisManager, requests []CheckRequest) *ChainProcessor {
+//按检测请求的类型创建处理器，type为空或http时使用http代理检测，socks时使用socks代理检测
+func NewChainProcessor(requests []CheckRequest) *ChainProcessor {
 	random := rand.New(rand.NewSource(rand.Int63()))
-	httpProcessor := &HttpProcessor{UserAgent: "", CheckRequests: requests, RedisManager: redisManager, RequestRand: random}
-	var processors = []Processor{httpProcessor}
+	httpRequests := make([]CheckRequest, 0)
+	socksRequests := make([]CheckRequest, 0)
+	for _, request := range requests {
+		if request.Type == REQUEST_TYPE_SOCKS {
+			socksRequests = append(socksRequests, request)
+		} else {
+			httpRequests = append(httpRequests, request)
+		}
+	}
+	processors := make([]Processor, 0)
+	if len(httpRequests) > 0 {
+		processors = append(processors, &HttpProcessor{UserAgent: "", CheckRequests: httpRequests, RequestRand: random})
+	}
+	if len(socksRequests) > 0 {
+		processors = append(processors, &SocksProcessor{CheckRequests: socksRequests, RequestRand: random})
+	}
 	return &ChainProcessor{Processors: processors}
 }
@@ -0,0 +1,40 @@
+package processor
+
+import (
+	"fproxy/core"
+	"fproxy/httputil/sockstest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChainProcessorSocks(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("check word"))
+	}))
+	defer target.Close()
+	socks, err := sockstest.NewServer("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	requests := []CheckRequest{
+		{Type: REQUEST_TYPE_HTTP, Url: target.URL, Word: "check word"},
+		{Type: REQUEST_TYPE_SOCKS, Url: target.URL, Word: "check word"},
+	}
+	chain := NewChainProcessor(requests)
+	if len(chain.Processors) != 2 {
+		t.Fatalf("processors = %d", len(chain.Processors))
+	}
+	ip, port, _ := core.ParseProxyAddr(socks.Addr())
+	proxy := core.NewProxy(ip, port, core.PROXY_SOURCE_SCAN, "")
+	if n := chain.Process(&proxy); n != 1 || proxy.Protocol != core.PROXY_PROTOCOL_SOCKS5 {
+		t.Errorf("process socks proxy = %d, protocol %s", n, proxy.Protocol)
+	}
+	//只有http检测请求时不检测socks
+	chain = NewChainProcessor(requests[:1])
+	proxy = core.NewProxy(ip, port, core.PROXY_SOURCE_SCAN, "")
+	if n := chain.Process(&proxy); n != 0 {
+		t.Errorf("http only chain accepted socks proxy")
+	}
+}
@@ -6,6 +6,12 @@ import (
 	"io/ioutil"
 )
 
+//检测请求类型
+const (
+	REQUEST_TYPE_HTTP  = "http"
+	REQUEST_TYPE_SOCKS = "socks"
+)
+
 type CheckRequest struct {
 	Type      string
 	Url       string
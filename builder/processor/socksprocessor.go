@@ -0,0 +1,44 @@
+package processor
+
+import (
+	"fproxy/core"
+	"fproxy/httputil"
+	"github.com/golang/glog"
+	"math/rand"
+)
+
+//依次尝试的socks协议，优先使用由代理解析域名的协议
+var SOCKS_PROTOCOLS = []string{core.PROXY_PROTOCOL_SOCKS5, core.PROXY_PROTOCOL_SOCKS4A, core.PROXY_PROTOCOL_SOCKS4}
+
+/*
+*socks代理检测，通过socks代理请求检测地址
+ */
+type SocksProcessor struct {
+	CheckRequests []CheckRequest
+	RequestRand   *rand.Rand
+}
+
+func (s *SocksProcessor) Process(proxy *core.Proxy) int {
+	request := s.CheckRequests[s.RequestRand.Intn(len(s.CheckRequests))]
+	headers := make(map[string]string)
+	if request.UserAgent != "" {
+		headers["User-Agent"] = request.UserAgent
+	}
+	for _, protocol := range SOCKS_PROTOCOLS {
+		candidate := *proxy
+		candidate.Protocol = protocol
+		if httputil.GetForCheck(request.Url, candidate.URL(), request.Word, headers, request.MaxLength) {
+			proxy.Protocol = protocol
+			return SUCCESS
+		}
+	}
+	return FAIL
+}
+
+func (s *SocksProcessor) OnSuccess(proxy core.Proxy) {
+	glog.Infoln("scan find socks proxy: ", proxy)
+}
+
+func (s *SocksProcessor) OnFail(proxy core.Proxy) {
+	glog.Infoln("check socks proxy fail: invalid proxy[", proxy.Ip, ",", proxy.Port, ",", proxy.Source, "]")
+}
@@ -1,9 +1,11 @@
 package builder
 
 import (
+	"context"
 	"encoding/json"
 	"fproxy/builder/processor"
 	"fproxy/core"
+	"fproxy/stats"
 	"fproxy/store"
 	"github.com/golang/glog"
 	"strconv"
@@ -15,23 +17,30 @@ const KEY_SCAN_TASK = "proxy:scan:task"
 
 type TaskResult struct {
 	IsProxy bool
+	Proxy   core.Proxy
 }
 
 type ProxyTask struct {
-	IP   string
-	Port int
+	IP      string
+	Port    int
+	Section string
 }
 
 type Worker struct {
 	Processor *processor.ChainProcessor
 }
 
-func (w *Worker) DoWork(taskChan chan ProxyTask, resultChan chan TaskResult) {
+func (w *Worker) DoWork(ctx context.Context, taskChan chan ProxyTask, resultChan chan TaskResult) {
 	glog.Infoln("worker start do work...")
 	for {
-		task := <-taskChan
-		proxy := core.Proxy{Ip: task.IP, Port: task.Port, Source: core.PROXY_SOURCE_SCAN}
-		proxyNum := w.Processor.Process(proxy)
+		var task ProxyTask
+		select {
+		case task = <-taskChan:
+		case <-ctx.Done():
+			return
+		}
+		proxy := core.NewProxy(task.IP, task.Port, core.PROXY_SOURCE_SCAN, task.Section)
+		proxyNum := w.Processor.Process(&proxy)
 		isProxy := false
 		if proxyNum > 0 {
 			isProxy = true
@@ -39,21 +48,24 @@ func (w *Worker) DoWork(taskChan chan ProxyTask, resultChan chan TaskResult) {
 		if isProxy {
 			glog.Infoln("scan proxy: ", task.IP, ", ", task.Port)
 		}
-		taskResult := TaskResult{IsProxy: isProxy}
+		taskResult := TaskResult{IsProxy: isProxy, Proxy: proxy}
 		resultChan <- taskResult
 	}
 }
 
 type Scanner struct {
-	Ports        []int
-	RedisManager *store.RedisManager
-	Workers      []*Worker
-	TaskChan     chan ProxyTask
-	ResultChan   chan TaskResult
+	Ports      []int
+	Store      store.ProxyStore
+	Queue      *store.ReliableQueue
+	Dedup      *store.Deduper
+	Stats      *stats.Recorder
+	Workers    []*Worker
+	TaskChan   chan ProxyTask
+	ResultChan chan TaskResult
 }
 
-func NewScanner(nWorkers int, ports []int, redisManager *store.RedisManager, requests []processor.CheckRequest) *Scanner {
-	processor := processor.NewChainProcessor(redisManager, requests)
+func NewScanner(nWorkers int, ports []int, proxyStore store.ProxyStore, requests []processor.CheckRequest, visibility, dedupTTL time.Duration, recorder *stats.Recorder) *Scanner {
+	processor := processor.NewChainProcessor(requests)
 	if nWorkers <= 0 {
 		nWorkers = 3
 	}
@@ -64,41 +76,94 @@ func NewScanner(nWorkers int, ports []int, redisManager *store.RedisManager, req
 	}
 	taskChan := make(chan ProxyTask, 65535)
 	resultChan := make(chan TaskResult, 65535)
-	return &Scanner{Ports: ports, RedisManager: redisManager, TaskChan: taskChan, ResultChan: resultChan, Workers: workers}
+	queue := store.NewReliableQueue(proxyStore, KEY_SCAN_TASK, store.DefaultConsumer("scan"), visibility)
+	dedup := store.NewDeduper(proxyStore, dedupTTL)
+	return &Scanner{Ports: ports, Store: proxyStore, Queue: queue, Dedup: dedup, Stats: recorder, TaskChan: taskChan, ResultChan: resultChan, Workers: workers}
 }
 
-func (s *Scanner) Start() {
+func (s *Scanner) Start(ctx context.Context) {
 	glog.Infoln("start proxy scan workers...")
 	for _, worker := range s.Workers {
-		go worker.DoWork(s.TaskChan, s.ResultChan)
+		go worker.DoWork(ctx, s.TaskChan, s.ResultChan)
 	}
+	go s.reapSections(ctx)
 	glog.Infoln("scan workers running, start scanner...")
 	for {
 		glog.Infoln("pull ipsection for scan...")
-		ipSection := s.pullIPSection()
+		rawSection, ipSection := s.pullIPSection(ctx)
 		if ipSection == nil {
-			time.Sleep(5 * time.Second)
-			continue
+			select {
+			case <-time.After(5 * time.Second):
+				continue
+			case <-ctx.Done():
+				return
+			}
 		}
 		proxyTasks := createProxyTasks(ipSection, s.Ports)
 		taskNum := len(proxyTasks)
 		glog.Infoln("ip section[", ipSection.Start, ",", ipSection.End, "] task size: ", taskNum)
-		for _, task := range proxyTasks {
-			s.TaskChan <- task
-		}
-		proxyNum := 0
-		for i := 0; i < taskNum; i++ {
-			result := <-s.ResultChan
-			if result.IsProxy {
-				proxyNum++
+		go func() {
+			for _, task := range proxyTasks {
+				select {
+				case s.TaskChan <- task:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		proxies := make([]core.Proxy, 0)
+		//扫描一个ip段耗时较长，定期续约避免被回收
+		extendTicker := time.NewTicker(s.Queue.Visibility / 3)
+		for i := 0; i < taskNum; {
+			select {
+			case result := <-s.ResultChan:
+				i++
+				if result.IsProxy {
+					proxies = append(proxies, result.Proxy)
+				}
+			case <-extendTicker.C:
+				err := s.Queue.Extend(ctx)
+				if err != nil {
+					glog.Errorln("extend scan task lease error: ", err)
+				}
+			case <-ctx.Done():
+				extendTicker.Stop()
+				return
 			}
 		}
+		extendTicker.Stop()
+		proxyNum := len(proxies)
 		glog.Infoln("ip section[", ipSection.Start, ",", ipSection.End, "] proxyNum size: ", proxyNum)
-		if ipSection.ProxyNum == -1 || ipSection.ProxyNum > 0 || proxyNum > 0 {
-			ipSection.ProxyNum = proxyNum
-			s.pushIPSection(ipSection)
+		pushSection := ipSection.ProxyNum == -1 || ipSection.ProxyNum > 0 || proxyNum > 0
+		ipSection.ProxyNum = proxyNum
+		err := s.flushSection(ctx, rawSection, ipSection, proxies, pushSection)
+		if err != nil {
+			glog.Errorln("flush ip section[", ipSection.Start, ",", ipSection.End, "] error: ", err)
+		}
+	}
+}
+
+//扫描结果、ip段及任务确认在一次管道中写入
+func (s *Scanner) flushSection(ctx context.Context, rawSection string, ipSection *IPSection, proxies []core.Proxy, pushSection bool) error {
+	candidates, suppressed := PrepareCandidates(ctx, s.Dedup, proxies)
+	if suppressed > 0 {
+		glog.Infoln("ip section[", ipSection.Start, ",", ipSection.End, "] suppressed ", suppressed, " duplicate proxies")
+	}
+	var section string
+	if pushSection {
+		bVal, err := json.Marshal(ipSection)
+		if err != nil {
+			return err
 		}
+		section = string(bVal)
 	}
+	return s.Store.Pipelined(ctx, func(pipe store.Pipeliner) {
+		PushCandidates(pipe, s.Stats, core.PROXY_SOURCE_SCAN, candidates, suppressed)
+		if section != "" {
+			pipe.Rpush(KEY_SCAN_TASK, section)
+		}
+		s.Queue.AckPipelined(pipe, rawSection)
+	})
 }
 
 func createProxyTasks(ipSection *IPSection, ports []int) []ProxyTask {
@@ -110,12 +175,13 @@ func createProxyTasks(ipSection *IPSection, ports []int) []ProxyTask {
 	endCPart, _ := strconv.Atoi(endIPParts[2])
 	size := (endCPart - startCPart + 1) * 256 * len(ports)
 	proxyTasks := make([]ProxyTask, size)
+	section := startIP + "_" + endIP
 	index := 0
 	for cPart := startCPart; cPart <= endCPart; cPart++ {
 		for dPart := 0; dPart < 256; dPart++ {
 			ip := startIPParts[0] + "." + startIPParts[1] + "." + strconv.Itoa(cPart) + "." + strconv.Itoa(dPart)
 			for _, port := range ports {
-				proxyTask := ProxyTask{IP: ip, Port: port}
+				proxyTask := ProxyTask{IP: ip, Port: port, Section: section}
 				proxyTasks[index] = proxyTask
 				index++
 			}
@@ -124,27 +190,39 @@ func createProxyTasks(ipSection *IPSection, ports []int) []ProxyTask {
 	return proxyTasks
 }
 
-func (s *Scanner) pullIPSection() *IPSection {
-	jsonText, err := s.RedisManager.Lpop(KEY_SCAN_TASK)
-	if jsonText == "" || err != nil {
-		return nil
+func (s *Scanner) pullIPSection(ctx context.Context) (string, *IPSection) {
+	jsonText, err := s.Queue.Pull(ctx)
+	if err != nil {
+		if err != store.ErrNil && ctx.Err() == nil {
+			glog.Errorln("pull ip section error: ", err)
+		}
+		return "", nil
 	}
 	ipSection := &IPSection{}
 	err = json.Unmarshal([]byte(jsonText), ipSection)
 	if err != nil {
-		return nil
+		glog.Errorln("unmarshal ip section ", jsonText, " error: ", err)
+		//无法解析的ip段直接确认，避免反复回收
+		s.Queue.Ack(ctx, jsonText)
+		return "", nil
 	}
-	return ipSection
+	return jsonText, ipSection
 }
 
-func (s *Scanner) pushIPSection(ipSection *IPSection) {
-	if ipSection == nil {
-		return
-	}
-	bVal, err := json.Marshal(ipSection)
-	if err != nil {
-		glog.Errorln("marshal ip section error[", ipSection.Start, ", ", ipSection.End, ", ", ipSection.ProxyNum, "]: ", err)
-		return
+//定期回收租约过期的ip段，直到ctx取消
+func (s *Scanner) reapSections(ctx context.Context) {
+	for {
+		n, err := s.Queue.Reap(ctx)
+		if err != nil && ctx.Err() == nil {
+			glog.Errorln("reap scan task error: ", err)
+		}
+		if n > 0 {
+			glog.Infoln("requeue ", n, " expired ip sections")
+		}
+		select {
+		case <-time.After(s.Queue.Visibility / 2):
+		case <-ctx.Done():
+			return
+		}
 	}
-	s.RedisManager.Rpush(KEY_SCAN_TASK, string(bVal))
 }
@@ -1,6 +1,7 @@
 package builder
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fproxy/store"
@@ -16,7 +17,7 @@ const (
 )
 
 type VPS struct {
-	Redis *store.RedisManager
+	Store store.ProxyStore
 }
 
 type VPSProxy struct {
@@ -26,47 +27,50 @@ type VPSProxy struct {
 	LeftSecond int64
 }
 
-func (v *VPS) AddVPS(vpsName string, ip string, port int) {
-	isOldVPS, err := v.Redis.Sismember(VPS_PROXY_SET, vpsName)
+func (v *VPS) AddVPS(ctx context.Context, vpsName string, ip string, port int) error {
+	isOldVPS, err := v.Store.Sismember(ctx, VPS_PROXY_SET, vpsName)
 	if err != nil || !isOldVPS {
-		v.Redis.Sadd(VPS_PROXY_SET, vpsName)
+		_, err = v.Store.Sadd(ctx, VPS_PROXY_SET, vpsName)
+		if err != nil {
+			glog.Errorln("add vps to redis err[", vpsName, "]", err)
+			return err
+		}
 	}
 	key := VPS_PROXY_DATA + vpsName
-	text, err := v.Redis.Get(key)
-	if err != nil {
+	text, err := v.Store.Get(ctx, key)
+	if err != nil && err != store.ErrNil {
 		glog.Errorln("before add vps get from redis err[", key, "]", err)
-		return
+		return err
 	}
 	timestamp := time.Now().UnixNano()
 	if text != "" {
 		var oldProxy VPSProxy
 		err = json.Unmarshal([]byte(text), &oldProxy)
 		if err != nil {
-			v.addNewVPS(vpsName, ip, port, timestamp)
+			return v.addNewVPS(ctx, vpsName, ip, port, timestamp)
 		} else {
 			if oldProxy.IP != ip && oldProxy.Port != port {
-				v.addNewVPS(vpsName, ip, port, timestamp)
+				return v.addNewVPS(ctx, vpsName, ip, port, timestamp)
 			} else {
-				v.updateVPS(vpsName, ip, port, timestamp, oldProxy)
+				return v.updateVPS(ctx, vpsName, ip, port, timestamp, oldProxy)
 			}
 		}
-	} else {
-		v.addNewVPS(vpsName, ip, port, timestamp)
 	}
+	return v.addNewVPS(ctx, vpsName, ip, port, timestamp)
 }
 
-func (v *VPS) addNewVPS(vpsName string, ip string, port int, startTime int64) {
+func (v *VPS) addNewVPS(ctx context.Context, vpsName string, ip string, port int, startTime int64) error {
 	key := VPS_PROXY_DATA + vpsName
 	newProxy := VPSProxy{IP: ip, Port: port, StartTime: startTime, LeftSecond: VPS_ALIVE_TIME}
 	btext, err := json.Marshal(newProxy)
 	if err != nil {
 		glog.Errorln("add new vps proxy parse to json err: ", err)
-		return
+		return err
 	}
-	v.Redis.Set(key, string(btext))
+	return v.Store.Set(ctx, key, string(btext))
 }
 
-func (v *VPS) updateVPS(vpsName string, ip string, port int, curtime int64, oldProxy VPSProxy) {
+func (v *VPS) updateVPS(ctx context.Context, vpsName string, ip string, port int, curtime int64, oldProxy VPSProxy) error {
 	key := VPS_PROXY_DATA + vpsName
 	startSecond := oldProxy.StartTime / 1000000000
 	nowSecond := curtime / 1000000000
@@ -75,37 +79,57 @@ func (v *VPS) updateVPS(vpsName string, ip string, port int, curtime int64, oldP
 	btext, err := json.Marshal(oldProxy)
 	if err != nil {
 		glog.Errorln("update vps proxy parse to json err: ", err)
-		return
+		return err
+	}
+	return v.Store.Set(ctx, key, string(btext))
+}
+
+//读取全部vps及其代理，数据缺失或无法解析的vps跳过
+func (v *VPS) ListVPS(ctx context.Context) (map[string]VPSProxy, error) {
+	names, err := v.Store.Smembers(ctx, VPS_PROXY_SET)
+	if err != nil {
+		return nil, err
+	}
+	proxies := make(map[string]VPSProxy, len(names))
+	for _, name := range names {
+		text, err := v.Store.Get(ctx, VPS_PROXY_DATA+name)
+		if err == store.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var proxy VPSProxy
+		err = json.Unmarshal([]byte(text), &proxy)
+		if err != nil {
+			glog.Errorln("deserialize vps ", name, " error: ", err)
+			continue
+		}
+		proxies[name] = proxy
 	}
-	v.Redis.Set(key, string(btext))
+	return proxies, nil
 }
 
-func (v *VPS) GetValidVPS() ([]string, error) {
-	bTexts, err := v.Redis.Smembers(VPS_PROXY_SET)
+//vps集合中保存的是vps名称，代理数据按名称读取
+func (v *VPS) GetValidVPS(ctx context.Context) ([]string, error) {
+	proxies, err := v.ListVPS(ctx)
 	if err != nil {
 		glog.Errorln("get valid vps from redis error: ", err)
 		return nil, err
 	}
-	bLen := 0
-	if bTexts == nil {
+	if len(proxies) == 0 {
 		return nil, errors.New("no valid vps")
 	}
-	bLen = len(bTexts)
-	vpses := make([]string, bLen)
+	vpses := make([]string, 0, len(proxies))
 	nowSecond := time.Now().UnixNano() / 1000000000
-	for i, bText := range bTexts {
-		var proxy VPSProxy
-		err = json.Unmarshal(bText, &proxy)
-		if err != nil {
-			return nil, errors.New("can not deserialize vps")
-		}
+	for _, proxy := range proxies {
 		startSecond := proxy.StartTime / 1000000000
 		useSecond := nowSecond - startSecond
 		if useSecond > VPS_ALIVE_TIME {
 			continue
 		}
 		vps := proxy.IP + ":" + strconv.Itoa(proxy.Port)
-		vpses[i] = vps
+		vpses = append(vpses, vps)
 	}
 	return vpses, nil
 }
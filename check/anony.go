@@ -1,12 +1,17 @@
 package check
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"fproxy/core"
+	"fproxy/geo"
 	"fproxy/httputil"
+	"fproxy/stats"
 	"fproxy/store"
 	"github.com/golang/glog"
+	"strconv"
 	"time"
 )
 
@@ -14,83 +19,354 @@ import (
 *高匿检测器
  */
 type AnonyChecker struct {
-	CheckUrl   string
-	Redis      *store.RedisManager
-	Workers    []AnonyCheckWorker
-	CheckQueue chan core.Proxy
+	Judges  *JudgePool
+	Store   store.ProxyStore
+	Workers []AnonyCheckWorker
+	Reaper  *store.ReliableQueue
 }
 
 /*
-*高匿检测工作器，并发操作
+*高匿检测工作器，并发操作，每个工作器使用自己的处理中列表
  */
 type AnonyCheckWorker struct {
-	CheckUrl    string
-	Redis       *store.RedisManager
-	CheckQueue  chan core.Proxy
+	Judges      *JudgePool
+	Store       store.ProxyStore
+	Queue       *store.ReliableQueue
 	MaxBodySize int
+	Stats       *stats.Recorder
+	//https判定服务地址，为空时不检测https隧道
+	HttpsCheckUrl string
+	TLSConfig     *tls.Config
+	//尚未探测协议的代理先探测支持的协议
+	Detector *ProtocolDetector
+	//判定服务提供定长数据的地址，为空时不测量带宽
+	BandwidthCheckUrl string
+	//为空时不检测篡改
+	Tamper *TamperChecker
+	//为空时不查询地理位置
+	Geo *geo.Locator
+	//为空时不做目标站点验证
+	Profiles *ProfileChecker
 }
 
-func NewAnonyChecker(checkUrl string, redis *store.RedisManager, nWorkers, checkSize, maxBodySize int) AnonyChecker {
-	if checkSize < 1 {
-		checkSize = 100
-	}
-	checkQueue := make(chan core.Proxy, checkSize)
+func NewAnonyChecker(judges *JudgePool, proxyStore store.ProxyStore, nWorkers, maxBodySize int, visibility time.Duration, recorder *stats.Recorder, httpsCheckUrl string, tlsConfig *tls.Config, bandwidthCheckUrl, tamperCheckUrl string, locator *geo.Locator, profiles *ProfileChecker) AnonyChecker {
 	if nWorkers < 1 {
 		nWorkers = 10
 	}
 	workers := make([]AnonyCheckWorker, nWorkers)
+	var tamper *TamperChecker
+	if tamperCheckUrl != "" {
+		tamper = NewTamperChecker(tamperCheckUrl, tlsConfig)
+	}
+	detector := &ProtocolDetector{HttpsJudgeUrl: httpsCheckUrl, TLSConfig: tlsConfig, MaxBodySize: maxBodySize}
 	for i := 0; i < nWorkers; i++ {
-		worker := AnonyCheckWorker{CheckUrl: checkUrl, Redis: redis, CheckQueue: checkQueue, MaxBodySize: maxBodySize}
+		queue := store.NewReliableQueue(proxyStore, core.PROXY_CHECK_QUEUE, store.DefaultConsumer("anony:"+strconv.Itoa(i)), visibility)
+		worker := AnonyCheckWorker{Judges: judges, Store: proxyStore, Queue: queue, MaxBodySize: maxBodySize, Stats: recorder, HttpsCheckUrl: httpsCheckUrl, TLSConfig: tlsConfig, Detector: detector, BandwidthCheckUrl: bandwidthCheckUrl, Tamper: tamper, Geo: locator, Profiles: profiles}
 		workers[i] = worker
 	}
-	return AnonyChecker{CheckUrl: checkUrl, Redis: redis, CheckQueue: checkQueue, Workers: workers}
+	reaper := store.NewReliableQueue(proxyStore, core.PROXY_CHECK_QUEUE, store.DefaultConsumer("anony"), visibility)
+	return AnonyChecker{Judges: judges, Store: proxyStore, Workers: workers, Reaper: reaper}
 }
 
-func (c AnonyChecker) CheckAll() {
+func (c AnonyChecker) CheckAll(ctx context.Context) {
 	for _, worker := range c.Workers {
-		go worker.DoWork()
+		go worker.DoWork(ctx)
+	}
+	reapQueue(ctx, c.Reaper)
+}
+
+func (w AnonyCheckWorker) pullForCheck(ctx context.Context) (string, core.Proxy, error) {
+	jsonText, err := w.Queue.Pull(ctx)
+	if err != nil {
+		return "", core.Proxy{}, err
 	}
+	checkProxy := core.Proxy{}
+	err = json.Unmarshal([]byte(jsonText), &checkProxy)
+	return jsonText, checkProxy, err
+}
+
+func (w AnonyCheckWorker) DoWork(ctx context.Context) {
 	for {
-		proxy, err := c.pullForCheck()
+		jsonText, checkProxy, err := w.pullForCheck(ctx)
 		if err != nil {
-			glog.Errorln("pull for anonymous check error: ", err)
-			time.Sleep(5 * time.Second)
+			if err != store.ErrNil && ctx.Err() == nil {
+				glog.Errorln("pull for anonymous check error: ", err)
+			}
+			if jsonText != "" {
+				//无法解析的元素直接确认，避免反复回收
+				w.ack(ctx, jsonText)
+				continue
+			}
+			if !sleepContext(ctx, 5*time.Second) {
+				return
+			}
 			continue
 		}
-		c.CheckQueue <- proxy
+		glog.Errorln("anony checker: ", checkProxy)
+		stopExtend := w.extendLease(ctx)
+		proxy := w.loadRecord(ctx, checkProxy)
+		verdict, err := w.judge(&proxy)
+		if err == ErrNoJudge {
+			//判定服务不可用时不计为代理失败，放回队列稍后重新检测
+			glog.Errorln("skip proxy ", proxy.Addr(), ": ", err)
+			stopExtend()
+			w.release(ctx, jsonText)
+			if !sleepContext(ctx, 5*time.Second) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			glog.Infoln("query judge by proxy ", proxy.Addr(), " error: ", err)
+		}
+		if err == nil {
+			recordTiming(&proxy, verdict.Timing)
+			w.measureBandwidth(&proxy)
+			w.inspect(&proxy, verdict)
+			w.checkTampering(ctx, &proxy)
+			w.locate(&proxy)
+			w.checkProfiles(&proxy)
+			w.checkSuccess(ctx, proxy)
+		} else {
+			proxy.RecordFail()
+			proxy.UpdateScore()
+			w.saveRecord(ctx, proxy)
+		}
+		stopExtend()
+		w.ack(ctx, jsonText)
 	}
 }
 
-func (c AnonyChecker) pullForCheck() (core.Proxy, error) {
-	jsonText, err := c.Redis.Lpop(core.PROXY_CHECK_QUEUE)
+/*
+*通过代理请求判定服务
+*尚未探测协议时先探测，之后的检测直接使用选定的协议
+ */
+func (w AnonyCheckWorker) judge(proxy *core.Proxy) (judgement, error) {
+	if len(proxy.Protocols) == 0 && w.Detector != nil {
+		verdict, err := w.detect(proxy)
+		//探测只请求了一个判定服务，需要多个判定服务一致时再按Quorum请求
+		if err != nil || w.Judges.Quorum <= 1 || isConnectOnly(*proxy) {
+			return verdict, err
+		}
+		return w.Judges.Query(proxy.URL(), w.MaxBodySize)
+	}
+	if isConnectOnly(*proxy) && w.HttpsCheckUrl != "" {
+		result, timing, err := QueryJudgeTimed(w.HttpsCheckUrl, proxy.URL(), w.TLSConfig, w.MaxBodySize)
+		w.recordHttps(proxy, err)
+		return judgement{Result: result, Timing: timing, Egress: w.Judges.egress()}, err
+	}
+	verdict, err := w.Judges.Query(proxy.URL(), w.MaxBodySize)
 	if err != nil {
-		return core.Proxy{}, err
+		return verdict, err
 	}
-	checkProxy := core.Proxy{}
-	err = json.Unmarshal([]byte(jsonText), &checkProxy)
-	return checkProxy, err
+	w.checkHttps(proxy)
+	return verdict, nil
 }
 
-func (w AnonyCheckWorker) DoWork() {
-	for {
-		checkProxy := <-w.CheckQueue
-		glog.Errorln("anony checker: ", checkProxy)
-		proxyStr := checkProxy.Ip + ":" + fmt.Sprintf("%d", checkProxy.Port)
-		isAnnoy := httputil.GetForCheck(w.CheckUrl, proxyStr, "anony", nil, w.MaxBodySize)
-		if isAnnoy {
-			w.checkSuccess(checkProxy)
+/*
+*探测代理支持的协议，记录支持的协议并选用优先级最高的协议
+*未探测到协议或只探测到CONNECT隧道时确认判定服务是否可用，不可用时换下一个判定服务
+ */
+func (w AnonyCheckWorker) detect(proxy *core.Proxy) (judgement, error) {
+	for _, judge := range w.Judges.pick() {
+		detector := *w.Detector
+		detector.JudgeUrl = judge.Url
+		protocols, results := detector.Detect(*proxy)
+		if (len(protocols) == 0 || protocols[0] == core.PROXY_PROTOCOL_CONNECT) && !judge.verify(w.MaxBodySize) {
+			continue
+		}
+		if len(protocols) == 0 {
+			return judgement{}, errors.New("no supported protocol detected")
 		}
+		proxy.Protocols = protocols
+		proxy.Https = proxy.SupportsProtocol(core.PROXY_PROTOCOL_CONNECT)
+		proxy.Protocol = core.PROXY_PROTOCOL_HTTP
+		if protocols[0] != core.PROXY_PROTOCOL_CONNECT {
+			proxy.Protocol = protocols[0]
+			judge.succeed()
+		}
+		if probe, ok := results[core.PROXY_PROTOCOL_CONNECT]; ok {
+			proxy.TlsIntercepted = httputil.IsTLSInterception(probe.Err)
+		}
+		probe := results[proxy.Protocol]
+		if probe.Err != nil {
+			//只支持CONNECT隧道，使用https判定结果
+			probe = results[core.PROXY_PROTOCOL_CONNECT]
+		}
+		return judgement{Result: probe.Result, Timing: probe.Timing, Egress: judge.egress()}, nil
+	}
+	return judgement{}, ErrNoJudge
+}
+
+//只支持CONNECT隧道，只能通过https判定服务检测
+func isConnectOnly(proxy core.Proxy) bool {
+	return len(proxy.Protocols) == 1 && proxy.Protocols[0] == core.PROXY_PROTOCOL_CONNECT
+}
+
+//未配置带宽检测地址或测量失败时保留上次的带宽
+func (w AnonyCheckWorker) measureBandwidth(proxy *core.Proxy) {
+	if w.BandwidthCheckUrl == "" {
+		return
 	}
+	bandwidth, err := MeasureBandwidth(w.BandwidthCheckUrl, proxy.URL(), w.TLSConfig)
+	if err != nil {
+		glog.Infoln("measure bandwidth by proxy ", proxy.Addr(), " error: ", err)
+		return
+	}
+	proxy.Bandwidth = bandwidth
 }
 
-func (w AnonyCheckWorker) checkSuccess(proxy core.Proxy) {
-	glog.Infoln("find anony proxy: ", proxy)
-	proxyStr := proxy.Ip + ":" + fmt.Sprintf("%d", proxy.Port)
-	w.Redis.Sadd(core.PROXY_POOL_VALID, proxyStr)
-	w.Redis.Sadd(core.PROXY_POOL_HISTORY, proxyStr)
-	if proxy.Source == core.PROXY_SOURCE_CRAW {
-		w.Redis.Incr(core.GetProxyTimeKey(core.PROXY_COUNT_CRAW))
-	} else if proxy.Source == core.PROXY_SOURCE_SCAN {
-		w.Redis.Incr(core.GetProxyTimeKey(core.PROXY_COUNT_SCAN))
+func (w AnonyCheckWorker) checkHttps(proxy *core.Proxy) {
+	if w.HttpsCheckUrl == "" {
+		proxy.Https = false
+		return
+	}
+	_, err := QueryHttpsJudge(w.HttpsCheckUrl, proxy.URL(), w.TLSConfig, w.MaxBodySize)
+	w.recordHttps(proxy, err)
+}
+
+//记录https检测结果，证书被替换时标记为拦截TLS，其他错误保留上次的拦截结果
+func (w AnonyCheckWorker) recordHttps(proxy *core.Proxy, err error) {
+	proxy.Https = err == nil
+	if err == nil {
+		proxy.TlsIntercepted = false
+		return
+	}
+	glog.Infoln("https check by proxy ", proxy.Addr(), " error: ", err)
+	if httputil.IsTLSInterception(err) {
+		proxy.TlsIntercepted = true
+	}
+}
+
+//检测失败时保留上次的结果
+func (w AnonyCheckWorker) checkTampering(ctx context.Context, proxy *core.Proxy) {
+	if w.Tamper == nil {
+		return
+	}
+	tampered, err := w.Tamper.Check(proxy.URL())
+	if err != nil {
+		glog.Infoln("tamper check by proxy ", proxy.Addr(), " error: ", err)
+		return
+	}
+	if tampered && !proxy.Tampered {
+		err = w.Stats.Incr(ctx, stats.METRIC_TAMPERED, proxy.Source, 1)
+		if err != nil {
+			glog.Errorln("record tampered proxy error: ", err)
+		}
+	}
+	proxy.Tampered = tampered
+}
+
+//按代理地址查询国家、城市及自治系统，查询失败时保留上次的结果
+func (w AnonyCheckWorker) locate(proxy *core.Proxy) {
+	if w.Geo == nil {
+		return
+	}
+	location, err := w.Geo.Lookup(proxy.Ip)
+	if err != nil {
+		glog.Infoln("locate proxy ", proxy.Addr(), " error: ", err)
+		return
+	}
+	proxy.Country, proxy.City, proxy.Asn, proxy.AsnOrg = location.Country, location.City, location.Asn, location.AsnOrg
+}
+
+//记录代理通过的目标站点验证，未通过的配置不再标记
+func (w AnonyCheckWorker) checkProfiles(proxy *core.Proxy) {
+	if w.Profiles == nil {
+		return
+	}
+	proxy.Profiles = w.Profiles.Check(proxy.URL())
+}
+
+//记录泄露的请求头并划分匿名级别
+func (w AnonyCheckWorker) inspect(proxy *core.Proxy, verdict judgement) {
+	proxy.LeakedHeaders, proxy.IpLeaked = inspectJudge(verdict.Result, verdict.Egress)
+	proxy.Anonymity = classifyAnonymity(proxy.LeakedHeaders, proxy.IpLeaked, verdict.Egress)
+}
+
+//检测一个代理要依次请求多个地址，耗时可能超过租约，定期续约避免被回收，返回的函数停止续约
+func (w AnonyCheckWorker) extendLease(ctx context.Context) func() {
+	done := make(chan struct{})
+	go func() {
+		extendTicker := time.NewTicker(w.Queue.Visibility / 3)
+		defer extendTicker.Stop()
+		for {
+			select {
+			case <-extendTicker.C:
+				err := w.Queue.Extend(ctx)
+				if err != nil {
+					glog.Errorln("extend check task lease error: ", err)
+				}
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+func (w AnonyCheckWorker) ack(ctx context.Context, jsonText string) {
+	err := w.Queue.Ack(ctx, jsonText)
+	if err != nil {
+		glog.Errorln("ack check queue error: ", err)
+	}
+}
+
+func (w AnonyCheckWorker) release(ctx context.Context, jsonText string) {
+	err := w.Queue.Release(ctx, jsonText)
+	if err != nil {
+		glog.Errorln("release check queue error: ", err)
+	}
+}
+
+//读取已保存的代理记录，不存在时使用待检测的候选代理
+func (w AnonyCheckWorker) loadRecord(ctx context.Context, candidate core.Proxy) core.Proxy {
+	proxy, err := store.LoadProxy(ctx, w.Store, candidate.Addr())
+	if err != nil {
+		if candidate.FirstSeen == 0 {
+			candidate.FirstSeen = time.Now().Unix()
+		}
+		if candidate.Protocol == "" {
+			candidate.Protocol = core.PROXY_PROTOCOL_HTTP
+		}
+		return candidate
+	}
+	return proxy
+}
+
+func (w AnonyCheckWorker) saveRecord(ctx context.Context, proxy core.Proxy) {
+	err := store.SaveProxy(ctx, w.Store, proxy)
+	if err != nil {
+		glog.Errorln("save proxy record ", proxy.Addr(), " error: ", err)
+	}
+}
+
+func (w AnonyCheckWorker) checkSuccess(ctx context.Context, proxy core.Proxy) {
+	glog.Infoln("find proxy of anonymity ", proxy.Anonymity, ": ", proxy)
+	proxy.UpdateScore()
+	proxyStr := proxy.Addr()
+	levelPool := proxy.Pool()
+	err := w.Store.Pipelined(ctx, func(pipe store.Pipeliner) {
+		pipe.Hmset(core.GetProxyDataKey(proxyStr), proxy.ToHash())
+		//匿名级别变化时移出原来的池
+		for _, pool := range core.ANONYMITY_POOLS {
+			if pool == levelPool {
+				pipe.Zadd(pool, proxy.Score, proxyStr)
+			} else {
+				pipe.Zrem(pool, proxyStr)
+			}
+		}
+		pipe.Sadd(core.PROXY_POOL_HISTORY, proxyStr)
+		pipe.Srem(core.PROXY_POOL_ARCHIVE, proxyStr)
+		if levelPool == core.PROXY_POOL_VALID {
+			w.Stats.IncrPipelined(pipe, stats.METRIC_VALIDATED, proxy.Source, 1)
+		}
+	})
+	if err != nil {
+		glog.Errorln("store anony proxy ", proxyStr, " error: ", err)
 	}
 }
@@ -0,0 +1,461 @@
+package check
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fproxy/core"
+	"fproxy/httputil"
+	"fproxy/httputil/sockstest"
+	"fproxy/server"
+	"fproxy/store"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//测试用的http转发代理，转发时添加指定的请求头，connect为false时拒绝CONNECT
+func newForwardProxy(t *testing.T, headers map[string]string, connect bool) *httptest.Server {
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			tunnel(w, r, connect)
+			return
+		}
+		req, err := http.NewRequest(r.Method, r.URL.String(), nil)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req.Header = r.Header.Clone()
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer res.Body.Close()
+		for name, values := range res.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+	}))
+	//socks握手不是完整的请求头，尽快断开，协议探测不必等待客户端超时
+	proxy.Config.ReadHeaderTimeout = time.Second
+	proxy.Start()
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func tunnel(w http.ResponseWriter, r *http.Request, connect bool) {
+	if !connect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	tunnelTo(w, r.Host)
+}
+
+//建立到target的隧道，target与请求的地址不同时即为劫持隧道
+func tunnelTo(w http.ResponseWriter, target string) {
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+	w.WriteHeader(http.StatusOK)
+	client, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	go io.Copy(conn, buf)
+	io.Copy(client, conn)
+}
+
+func proxyFromServer(t *testing.T, s *httptest.Server) core.Proxy {
+	ip, port, err := core.ParseProxyAddr(strings.TrimPrefix(s.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return core.NewProxy(ip, port, core.PROXY_SOURCE_SCAN, "")
+}
+
+func TestJudge(t *testing.T) {
+	judge := httptest.NewServer(&server.JudgeHandler{})
+	defer judge.Close()
+	proxy := newForwardProxy(t, map[string]string{"Via": "1.1 squid"}, false)
+	result, err := QueryJudge(judge.URL, strings.TrimPrefix(proxy.URL, "http://"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Ip != "127.0.0.1" || result.Headers.Get("Via") != "1.1 squid" || result.Headers.Get("User-Agent") == "" {
+		t.Errorf("judge result = %+v", result)
+	}
+	behind := httptest.NewServer(&server.JudgeHandler{RealIpHeader: "X-Real-IP"})
+	defer behind.Close()
+	req, _ := http.NewRequest("GET", behind.URL, nil)
+	req.Header.Set("X-Real-IP", "1.2.3.4")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	json.NewDecoder(res.Body).Decode(&result)
+	if result.Ip != "1.2.3.4" || result.Headers.Get("X-Real-IP") != "" {
+		t.Errorf("real ip judge result = %+v", result)
+	}
+}
+
+//刷新出口地址时不持有锁，判定服务无响应时其他工作器仍可读取
+func TestEgressResolverUnlockedFetch(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	judge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+		w.Write([]byte(`{"Ip":"1.2.3.4"}`))
+	}))
+	defer judge.Close()
+	resolver := NewEgressResolver(judge.URL)
+	done := make(chan string)
+	go func() {
+		ip, _ := resolver.Ip()
+		done <- ip
+	}()
+	<-received
+	if !resolver.lock.TryLock() {
+		t.Errorf("lock held during judge request")
+	} else {
+		resolver.lock.Unlock()
+	}
+	close(release)
+	if ip := <-done; ip != "1.2.3.4" {
+		t.Errorf("egress ip %q", ip)
+	}
+}
+
+func judgeTLSConfig(judge *httptest.Server) *tls.Config {
+	certPool := x509.NewCertPool()
+	certPool.AddCert(judge.Certificate())
+	return &tls.Config{RootCAs: certPool}
+}
+
+func TestHttpsJudge(t *testing.T) {
+	judge := httptest.NewTLSServer(&server.JudgeHandler{})
+	defer judge.Close()
+	tlsConfig := judgeTLSConfig(judge)
+	tunnelProxy := newForwardProxy(t, nil, true)
+	result, err := QueryHttpsJudge(judge.URL, strings.TrimPrefix(tunnelProxy.URL, "http://"), tlsConfig, 0)
+	if err != nil || result.Ip != "127.0.0.1" {
+		t.Errorf("https judge by tunnel proxy = %+v, %v", result, err)
+	}
+	httpOnlyProxy := newForwardProxy(t, nil, false)
+	if _, err = QueryHttpsJudge(judge.URL, strings.TrimPrefix(httpOnlyProxy.URL, "http://"), tlsConfig, 0); err == nil {
+		t.Errorf("proxy refusing CONNECT passed https check")
+	}
+	//证书不受信任时失败
+	if _, err = QueryHttpsJudge(judge.URL, strings.TrimPrefix(tunnelProxy.URL, "http://"), nil, 0); err == nil {
+		t.Errorf("untrusted judge certificate accepted")
+	}
+}
+
+//自签名证书，与httptest服务的证书不同，用于模拟替换证书的代理
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "mitm"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSInterception(t *testing.T) {
+	judge := httptest.NewTLSServer(&server.JudgeHandler{})
+	defer judge.Close()
+	mitm := httptest.NewUnstartedServer(&server.JudgeHandler{})
+	mitm.TLS = &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}
+	mitm.StartTLS()
+	defer mitm.Close()
+	honest := newForwardProxy(t, nil, true)
+	//CONNECT请求全部转到mitm，客户端收到的是mitm的证书
+	interceptor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tunnelTo(w, mitm.Listener.Addr().String())
+	}))
+	defer interceptor.Close()
+	pinned := httputil.PinTLSConfig(nil, []string{strings.ToUpper(httputil.CertificateFingerprint(judge.Certificate()))})
+	if _, err := QueryHttpsJudge(judge.URL, strings.TrimPrefix(honest.URL, "http://"), pinned, 0); err != nil {
+		t.Fatal("pinned judge by honest proxy: ", err)
+	}
+	for name, tlsConfig := range map[string]*tls.Config{"pinned": pinned, "ca": judgeTLSConfig(judge)} {
+		_, err := QueryHttpsJudge(judge.URL, strings.TrimPrefix(interceptor.URL, "http://"), tlsConfig, 0)
+		if !httputil.IsTLSInterception(err) {
+			t.Errorf("%s judge by intercepting proxy error = %v", name, err)
+		}
+	}
+	worker := AnonyCheckWorker{HttpsCheckUrl: judge.URL, TLSConfig: pinned}
+	proxy := proxyFromServer(t, interceptor)
+	proxy.Https = true
+	worker.checkHttps(&proxy)
+	if !proxy.TlsIntercepted || proxy.ServesHttps() {
+		t.Errorf("intercepting proxy = %+v", proxy)
+	}
+	proxy = proxyFromServer(t, honest)
+	proxy.TlsIntercepted = true
+	worker.checkHttps(&proxy)
+	if proxy.TlsIntercepted || !proxy.ServesHttps() {
+		t.Errorf("honest proxy = %+v", proxy)
+	}
+}
+
+func TestDetectProtocols(t *testing.T) {
+	judge := httptest.NewServer(&server.JudgeHandler{})
+	defer judge.Close()
+	httpsJudge := httptest.NewTLSServer(&server.JudgeHandler{})
+	defer httpsJudge.Close()
+	socks, err := sockstest.NewServer("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	detector := &ProtocolDetector{JudgeUrl: judge.URL, HttpsJudgeUrl: httpsJudge.URL, TLSConfig: judgeTLSConfig(httpsJudge)}
+	socksIp, socksPort, _ := core.ParseProxyAddr(socks.Addr())
+	cases := []struct {
+		proxy     core.Proxy
+		protocols []string
+	}{
+		{proxyFromServer(t, newForwardProxy(t, nil, true)), []string{core.PROXY_PROTOCOL_HTTP, core.PROXY_PROTOCOL_CONNECT}},
+		{proxyFromServer(t, newForwardProxy(t, nil, false)), []string{core.PROXY_PROTOCOL_HTTP}},
+		{core.NewProxy(socksIp, socksPort, core.PROXY_SOURCE_IMPORT, ""), []string{core.PROXY_PROTOCOL_SOCKS5, core.PROXY_PROTOCOL_SOCKS4A, core.PROXY_PROTOCOL_SOCKS4}},
+	}
+	for _, c := range cases {
+		protocols, results := detector.Detect(c.proxy)
+		if !reflect.DeepEqual(protocols, c.protocols) || results[protocols[0]].Err != nil {
+			t.Errorf("detect %s = %v, %v", c.proxy.Addr(), protocols, results)
+		}
+	}
+}
+
+func TestInspectJudge(t *testing.T) {
+	egress := "1.2.3.4"
+	cases := []struct {
+		result    core.JudgeResult
+		egressIp  string
+		leaked    []string
+		ipLeaked  bool
+		anonymity int
+	}{
+		{core.JudgeResult{Ip: "5.5.5.5", Headers: http.Header{"User-Agent": {"Go"}}}, egress, []string{}, false, core.HighAnonymous},
+		{core.JudgeResult{Ip: "5.5.5.5", Headers: http.Header{"Via": {"1.1 squid"}, "Proxy-Connection": {"keep-alive"}}}, egress, []string{"Proxy-Connection", "Via"}, false, core.Anonymous},
+		{core.JudgeResult{Ip: "5.5.5.5", Headers: http.Header{"X-Forwarded-For": {"11.2.3.45"}}}, egress, []string{"X-Forwarded-For"}, false, core.Anonymous},
+		{core.JudgeResult{Ip: "5.5.5.5", Headers: http.Header{"X-Forwarded-For": {"10.0.0.1, 1.2.3.4"}}}, egress, []string{"X-Forwarded-For"}, true, core.Transparent},
+		{core.JudgeResult{Ip: "5.5.5.5", Headers: http.Header{"Forwarded": {"for=1.2.3.4:5678"}}}, egress, []string{"Forwarded"}, true, core.Transparent},
+		{core.JudgeResult{Ip: "5.5.5.5", Headers: http.Header{"X-Custom-From": {"1.2.3.4"}}}, egress, []string{"X-Custom-From"}, true, core.Transparent},
+		{core.JudgeResult{Ip: egress, Headers: http.Header{}}, egress, []string{}, true, core.Transparent},
+		{core.JudgeResult{Ip: "5.5.5.5", Headers: http.Header{"Host": {"1.2.3.4:8090"}}}, egress, []string{}, false, core.HighAnonymous},
+		{core.JudgeResult{Ip: "5.5.5.5", Headers: http.Header{"Via": {"1.1 squid"}}}, "", []string{"Via"}, false, core.Transparent},
+		{core.JudgeResult{Ip: "5.5.5.5", Headers: http.Header{}}, "", []string{}, false, core.HighAnonymous},
+	}
+	for i, c := range cases {
+		leaked, ipLeaked := inspectJudge(c.result, c.egressIp)
+		if !reflect.DeepEqual(leaked, c.leaked) || ipLeaked != c.ipLeaked {
+			t.Errorf("case %d: leaked = %v, %v, want %v, %v", i, leaked, ipLeaked, c.leaked, c.ipLeaked)
+		}
+		if anonymity := classifyAnonymity(leaked, ipLeaked, c.egressIp); anonymity != c.anonymity {
+			t.Errorf("case %d: anonymity = %d, want %d", i, anonymity, c.anonymity)
+		}
+	}
+}
+
+//本地判定服务与代理走完整的检测流程，代理通过请求头模拟自己的出口地址
+func TestAnonyCheckPipeline(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/", &server.JudgeHandler{RealIpHeader: "X-Test-Egress"})
+	mux.HandleFunc("/payload", server.ServePayload)
+	mux.HandleFunc("/page", server.ServeTamperPage)
+	judge := httptest.NewServer(mux)
+	defer judge.Close()
+	httpsJudge := httptest.NewTLSServer(&server.JudgeHandler{})
+	defer httpsJudge.Close()
+	high := proxyFromServer(t, newForwardProxy(t, map[string]string{"X-Test-Egress": "10.0.0.2"}, true))
+	anony := proxyFromServer(t, newForwardProxy(t, map[string]string{"X-Test-Egress": "10.0.0.3", "Via": "1.1 squid"}, false))
+	trans := proxyFromServer(t, newForwardProxy(t, map[string]string{"X-Test-Egress": "10.0.0.4", "X-Forwarded-For": "127.0.0.1"}, true))
+	s := store.NewMemoryStore()
+	for _, proxy := range []core.Proxy{high, anony, trans} {
+		bs, _ := json.Marshal(proxy)
+		s.Rpush(context.Background(), core.PROXY_CHECK_QUEUE, string(bs))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	checker := NewAnonyChecker(singleJudge(judge.URL), s, 2, 0, time.Minute, nil, httpsJudge.URL, judgeTLSConfig(httpsJudge), judge.URL+"/payload?size=65536", judge.URL+"/page", nil, nil)
+	go checker.CheckAll(ctx)
+	expected := map[string]core.Proxy{core.PROXY_POOL_VALID: high, core.PROXY_POOL_ANONYMOUS: anony, core.PROXY_POOL_TRANSPARENT: trans}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		done := true
+		for _, pool := range core.ANONYMITY_POOLS {
+			if n, _ := s.Zcard(ctx, pool); n != 1 {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	levels := map[string]int{core.PROXY_POOL_VALID: core.HighAnonymous, core.PROXY_POOL_ANONYMOUS: core.Anonymous, core.PROXY_POOL_TRANSPARENT: core.Transparent}
+	for pool, proxy := range expected {
+		if _, err := s.Zscore(ctx, pool, proxy.Addr()); err != nil {
+			t.Errorf("%s not in %s: %v", proxy.Addr(), pool, err)
+		}
+		record, err := store.LoadProxy(ctx, s, proxy.Addr())
+		if err != nil || record.Anonymity != levels[pool] || record.SuccessCount != 1 || record.Https != (proxy.Addr() != anony.Addr()) {
+			t.Errorf("proxy record = %+v, %v", record, err)
+		}
+		if record.Bandwidth <= 0 || record.FirstByteTime > record.Latency {
+			t.Errorf("proxy timing = %+v", record)
+		}
+	}
+	record, _ := store.LoadProxy(ctx, s, trans.Addr())
+	if !record.IpLeaked || !reflect.DeepEqual(record.LeakedHeaders, []string{"X-Forwarded-For"}) {
+		t.Errorf("transparent proxy leaks = %v, %v", record.LeakedHeaders, record.IpLeaked)
+	}
+}
+
+//socks代理走完整的检测流程，socks服务端从127.0.0.2发出请求，模拟与本机不同的出口地址
+func TestAnonyCheckSocks(t *testing.T) {
+	judge := httptest.NewServer(&server.JudgeHandler{})
+	defer judge.Close()
+	socks, err := sockstest.NewServer("user", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	socks.LocalIp = "127.0.0.2"
+	ip, port, _ := core.ParseProxyAddr(socks.Addr())
+	proxy := core.NewProxy(ip, port, core.PROXY_SOURCE_IMPORT, "")
+	proxy.Protocol, proxy.Username, proxy.Password = core.PROXY_PROTOCOL_SOCKS5, "user", "secret"
+	s := store.NewMemoryStore()
+	bs, _ := json.Marshal(proxy)
+	s.Rpush(context.Background(), core.PROXY_CHECK_QUEUE, string(bs))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	checker := NewAnonyChecker(singleJudge(judge.URL), s, 1, 0, time.Minute, nil, "", nil, "", "", nil, nil)
+	go checker.CheckAll(ctx)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if n, _ := s.Zcard(ctx, core.PROXY_POOL_VALID); n == 1 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	record, err := store.LoadProxy(ctx, s, proxy.Addr())
+	if err != nil || record.Anonymity != core.HighAnonymous || record.Protocol != core.PROXY_PROTOCOL_SOCKS5 || record.Username != "user" ||
+		!reflect.DeepEqual(record.Protocols, []string{core.PROXY_PROTOCOL_SOCKS5, core.PROXY_PROTOCOL_SOCKS4A, core.PROXY_PROTOCOL_SOCKS4}) {
+		t.Errorf("socks proxy record = %+v, %v", record, err)
+	}
+	if len(socks.Requests()) == 0 {
+		t.Errorf("judge not requested through socks proxy")
+	}
+}
+
+//没有可用的判定服务时不记录失败，检测项放回队列
+func TestAnonyCheckWithoutJudge(t *testing.T) {
+	down := httptest.NewServer(&server.JudgeHandler{})
+	down.Close()
+	proxy := proxyFromServer(t, newForwardProxy(t, nil, false))
+	s := store.NewMemoryStore()
+	bs, _ := json.Marshal(proxy)
+	s.Rpush(context.Background(), core.PROXY_CHECK_QUEUE, string(bs))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	judges := singleJudge(down.URL)
+	checker := NewAnonyChecker(judges, s, 1, 0, time.Minute, nil, "", nil, "", "", nil, nil)
+	queue := store.NewReliableQueue(s, core.PROXY_CHECK_QUEUE, store.DefaultConsumer("anony:0"), time.Minute)
+	go checker.CheckAll(ctx)
+	//等到直接请求过判定服务，放回后工作器等待5秒才重新取出
+	deadline := time.Now().Add(5 * time.Second)
+	probed := false
+	for !probed && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		judges.judges[0].lock.Lock()
+		probed = !judges.judges[0].probedAt.IsZero()
+		judges.judges[0].lock.Unlock()
+	}
+	time.Sleep(100 * time.Millisecond)
+	if values, _ := s.Lrange(ctx, core.PROXY_CHECK_QUEUE, 0, -1); !probed || len(values) != 1 || values[0] != string(bs) {
+		t.Errorf("check queue = %q, probed %v", values, probed)
+	}
+	if n, _ := s.Len(ctx, queue.ProcessingKey()); n != 0 {
+		t.Errorf("processing list len %d", n)
+	}
+	if record, err := store.LoadProxy(ctx, s, proxy.Addr()); err == nil && record.FailCount != 0 {
+		t.Errorf("proxy failure recorded: %+v", record)
+	}
+}
+
+//检测耗时超过租约时续约，不被回收重复检测
+func TestAnonyCheckExtendLease(t *testing.T) {
+	var lock sync.Mutex
+	judged := 0
+	handler := &server.JudgeHandler{}
+	judge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//只有经代理的请求带有X-Test-Slow
+		if r.Header.Get("X-Test-Slow") != "" {
+			lock.Lock()
+			judged++
+			lock.Unlock()
+			time.Sleep(3500 * time.Millisecond)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer judge.Close()
+	proxy := proxyFromServer(t, newForwardProxy(t, map[string]string{"X-Test-Slow": "1"}, false))
+	s := store.NewMemoryStore()
+	bs, _ := json.Marshal(proxy)
+	s.Rpush(context.Background(), core.PROXY_CHECK_QUEUE, string(bs))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//租约按秒记录，2秒是不会在两次续约之间过期的最短时长
+	checker := NewAnonyChecker(singleJudge(judge.URL), s, 1, 0, 2*time.Second, nil, "", nil, "", "", nil, nil)
+	go checker.CheckAll(ctx)
+	deadline := time.Now().Add(10 * time.Second)
+	saved := false
+	for !saved && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		for _, pool := range core.ANONYMITY_POOLS {
+			if n, _ := s.Zcard(ctx, pool); n == 1 {
+				saved = true
+			}
+		}
+	}
+	//被回收时工作器会立即重新取出并再次请求判定服务
+	time.Sleep(200 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	if !saved || judged != 1 {
+		t.Errorf("saved %v, judged %d times", saved, judged)
+	}
+	if n, _ := s.Len(ctx, core.PROXY_CHECK_QUEUE); n != 0 {
+		t.Errorf("check queue len %d", n)
+	}
+}
@@ -1,5 +1,40 @@
 package check
 
+import (
+	"context"
+	"fproxy/store"
+	"github.com/golang/glog"
+	"time"
+)
+
 type Checker interface {
-	CheckAll()
+	CheckAll(ctx context.Context)
+}
+
+//等待d时长，ctx取消时提前返回false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//定期回收租约过期的处理中列表，直到ctx取消
+func reapQueue(ctx context.Context, queue *store.ReliableQueue) {
+	for {
+		n, err := queue.Reap(ctx)
+		if err != nil && ctx.Err() == nil {
+			glog.Errorln("reap queue ", queue.Queue, " error: ", err)
+		}
+		if n > 0 {
+			glog.Infoln("requeue ", n, " expired items to ", queue.Queue)
+		}
+		if !sleepContext(ctx, queue.Visibility/2) {
+			return
+		}
+	}
 }
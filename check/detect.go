@@ -0,0 +1,72 @@
+package check
+
+import (
+	"crypto/tls"
+	"fproxy/core"
+	"fproxy/httputil"
+	"sync"
+)
+
+//探测的协议，按优先级排列，检测时使用第一个支持的协议
+var DETECT_PROTOCOLS = []string{core.PROXY_PROTOCOL_HTTP, core.PROXY_PROTOCOL_SOCKS5, core.PROXY_PROTOCOL_SOCKS4A, core.PROXY_PROTOCOL_SOCKS4}
+
+/*
+*协议探测，分别以各协议通过代理请求判定服务，能返回判定结果即支持该协议
+*配置了https判定服务时，以http代理的CONNECT隧道请求https判定服务
+ */
+type ProtocolDetector struct {
+	JudgeUrl      string
+	HttpsJudgeUrl string
+	TLSConfig     *tls.Config
+	MaxBodySize   int
+}
+
+/*
+*一个协议的探测结果及耗时
+ */
+type JudgeProbe struct {
+	Result core.JudgeResult
+	Timing httputil.Timing
+	Err    error
+}
+
+//并发探测，返回按优先级排列的协议及各协议的探测结果，探测失败的协议只带有Err
+func (d *ProtocolDetector) Detect(proxy core.Proxy) ([]string, map[string]JudgeProbe) {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]JudgeProbe)
+	probe := func(key string, query func() (core.JudgeResult, httputil.Timing, error)) {
+		defer wg.Done()
+		result, timing, err := query()
+		lock.Lock()
+		results[key] = JudgeProbe{Result: result, Timing: timing, Err: err}
+		lock.Unlock()
+	}
+	for _, protocol := range DETECT_PROTOCOLS {
+		candidate := proxy
+		candidate.Protocol = protocol
+		wg.Add(1)
+		go probe(protocol, func() (core.JudgeResult, httputil.Timing, error) {
+			return QueryJudgeTimed(d.JudgeUrl, candidate.URL(), nil, d.MaxBodySize)
+		})
+	}
+	if d.HttpsJudgeUrl != "" {
+		candidate := proxy
+		candidate.Protocol = core.PROXY_PROTOCOL_HTTP
+		wg.Add(1)
+		go probe(core.PROXY_PROTOCOL_CONNECT, func() (core.JudgeResult, httputil.Timing, error) {
+			return QueryJudgeTimed(d.HttpsJudgeUrl, candidate.URL(), d.TLSConfig, d.MaxBodySize)
+		})
+	}
+	wg.Wait()
+	protocols := make([]string, 0, len(results))
+	for _, protocol := range DETECT_PROTOCOLS {
+		if results[protocol].Err == nil {
+			protocols = append(protocols, protocol)
+		}
+	}
+	if probe, ok := results[core.PROXY_PROTOCOL_CONNECT]; ok && probe.Err == nil {
+		protocols = append(protocols, core.PROXY_PROTOCOL_CONNECT)
+	}
+	return protocols, results
+}
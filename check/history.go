@@ -1,87 +1,307 @@
 package check
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	core "fproxy/core"
 	"fproxy/httputil"
+	"fproxy/stats"
 	store "fproxy/store"
 	"github.com/golang/glog"
+	"math"
 	"net/http"
-	"strconv"
+	"strings"
 	"time"
 )
 
+//历史池复检的默认值，连续失败demoteFails次移出评分池，archiveFails次移出历史池
+const (
+	HISTORY_DEMOTE_FAILS  = 1
+	HISTORY_ARCHIVE_FAILS = 5
+)
+
+//没有到期的代理时的轮询间隔，及把新加入历史池的代理补充到调度中的间隔
+const (
+	HISTORY_POLL_INTERVAL = time.Second
+	HISTORY_SYNC_INTERVAL = 10 * time.Minute
+)
+
+//每个代理最多尝试的检测地址数
+const HISTORY_MAX_CHECK_URLS = 5
+
 type CheckResult struct {
+	Proxy core.Proxy
 	Valid bool
 }
 
 type HistoryWorker struct {
 	UserAgent  string
-	Redis      *store.RedisManager
+	Store      store.ProxyStore
 	ProxyChan  chan core.Proxy
 	ResultChan chan CheckResult
 	CheckUrls  []string
 }
 
-func (h *HistoryWorker) DoWork() {
+func (h *HistoryWorker) DoWork(ctx context.Context) {
 	for {
-		proxy := <-h.ProxyChan
-		checkValue := false
-		for i, checkUrl := range h.CheckUrls {
-			proxyAddr := proxy.Ip + ":" + fmt.Sprintf("%d", proxy.Port)
-			checkValue := httputil.HeadForCheck(checkUrl, proxyAddr, nil, http.StatusOK)
-			if checkValue || i > 3 {
-				break
-			}
+		var proxy core.Proxy
+		select {
+		case proxy = <-h.ProxyChan:
+		case <-ctx.Done():
+			return
+		}
+		start := time.Now()
+		valid := h.check(proxy)
+		if valid {
+			proxy.RecordSuccess(time.Since(start))
+		} else {
+			proxy.RecordFail()
 		}
-		checkResult := CheckResult{Valid: checkValue}
-		h.ResultChan <- checkResult
+		select {
+		case h.ResultChan <- CheckResult{Proxy: proxy, Valid: valid}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
+//依次请求检测地址，任一返回200即有效
+func (h *HistoryWorker) check(proxy core.Proxy) bool {
+	var headers map[string]string
+	if h.UserAgent != "" {
+		headers = map[string]string{"User-Agent": h.UserAgent}
+	}
+	for i, checkUrl := range h.CheckUrls {
+		if i >= HISTORY_MAX_CHECK_URLS {
+			break
+		}
+		if httputil.HeadForCheck(checkUrl, proxy.URL(), headers, http.StatusOK) {
+			return true
+		}
 	}
+	return false
 }
 
+/*
+*历史池复检，按每个代理的下次检测时间调度，检测结果决定下次检测时间
+*复活的代理放回检测队列，通过高匿检测后才重新进入评分池，连续失败的代理先移出评分池，失败过多时移入归档池不再检测
+ */
 type HistoryChecker struct {
-	Redis      *store.RedisManager
+	Store      store.ProxyStore
 	ProxyChan  chan core.Proxy
 	ResultChan chan CheckResult
 	Workers    []*HistoryWorker
+	Stats      *stats.Recorder
+	//连续失败达到该次数时移出评分池
+	DemoteFails int
+	//连续失败达到该次数时移入归档池
+	ArchiveFails int
+	Schedule     Schedule
+	//本进程每秒最多检测的代理数，不大于0时不限制
+	MaxChecksPerSecond float64
+	//每批最多取出的到期代理数
+	BatchSize int
 }
 
-func (h *HistoryChecker) CheckAll() {
+func (h *HistoryChecker) CheckAll(ctx context.Context) {
+	for _, worker := range h.Workers {
+		go worker.DoWork(ctx)
+	}
+	limiter := NewRateLimiter(h.MaxChecksPerSecond)
+	defer limiter.Stop()
+	var lastSync time.Time
 	for {
-		proxys, err := h.Redis.Smembers(core.PROXY_POOL_HISTORY)
-		if err != nil {
-			glog.Errorln("get history proxy from redis error: ", err)
+		if time.Since(lastSync) >= HISTORY_SYNC_INTERVAL {
+			alive, err := h.SyncSchedule(ctx)
+			if err != nil {
+				glog.Errorln("sync history schedule error: ", err)
+			} else {
+				lastSync = time.Now()
+				err = h.Stats.Gauge(ctx, stats.GAUGE_GROUP_HISTORY, map[string]int64{stats.Field(stats.METRIC_SIZE, stats.GAUGE_ALIVE, stats.SOURCE_ALL): int64(alive)})
+				if err != nil {
+					glog.Errorln("save history alive count error: ", err)
+				}
+			}
+		}
+		n, err := h.CheckDue(ctx, limiter)
+		if err != nil && ctx.Err() == nil {
+			glog.Errorln("history check error: ", err)
+		}
+		if n == 0 && !sleepContext(ctx, HISTORY_POLL_INTERVAL) {
 			return
 		}
-		if proxys == nil {
+		if ctx.Err() != nil {
 			return
 		}
-		for _, bsproxy := range proxys {
-			proxy := core.Proxy{}
-			err = json.Unmarshal(bsproxy, &proxy)
-			if err != nil {
-				glog.Errorln("history check proxy unmarshal proxy error: ", err)
-				continue
+	}
+}
+
+/*
+*历史池中尚未调度的代理安排立即检测，调度中已不在历史池的代理移除
+*返回最近一次检测成功的代理数
+ */
+func (h *HistoryChecker) SyncSchedule(ctx context.Context) (int, error) {
+	members, err := h.Store.Smembers(ctx, core.PROXY_POOL_HISTORY)
+	if err != nil {
+		return 0, err
+	}
+	scheduled, err := h.Store.ZrevrangeByScore(ctx, core.PROXY_SCHEDULE, math.Inf(1), math.Inf(-1))
+	if err != nil {
+		return 0, err
+	}
+	history := make(map[string]bool, len(members))
+	for _, member := range members {
+		history[member] = true
+	}
+	stale := make([]string, 0)
+	for _, member := range scheduled {
+		if !history[member.Member] {
+			stale = append(stale, member.Member)
+		}
+		delete(history, member.Member)
+	}
+	now := float64(time.Now().Unix())
+	err = h.Store.Pipelined(ctx, func(pipe store.Pipeliner) {
+		for addr := range history {
+			pipe.Zadd(core.PROXY_SCHEDULE, now, addr)
+		}
+		pipe.Zrem(core.PROXY_SCHEDULE, stale...)
+	})
+	if err != nil {
+		return 0, err
+	}
+	alive := 0
+	for _, proxy := range store.LoadProxies(ctx, h.Store, members) {
+		if proxy.LastChecked > 0 && proxy.ConsecutiveFails == 0 {
+			alive++
+		}
+	}
+	return alive, nil
+}
+
+//检测一批到期的代理，返回检测的数量，检测速率受limiter限制
+func (h *HistoryChecker) CheckDue(ctx context.Context, limiter *RateLimiter) (int, error) {
+	now := time.Now()
+	due, err := h.Store.ZrevrangeByScore(ctx, core.PROXY_SCHEDULE, float64(now.Unix()), math.Inf(-1))
+	if err != nil || len(due) == 0 {
+		return 0, err
+	}
+	//按时间倒序返回，优先检测到期最早的
+	if h.BatchSize > 0 && len(due) > h.BatchSize {
+		due = due[len(due)-h.BatchSize:]
+	}
+	addrs := make([]string, len(due))
+	for i, member := range due {
+		addrs[i] = member.Member
+	}
+	lease := float64(now.Add(SCHEDULE_LEASE).Unix())
+	err = h.Store.Pipelined(ctx, func(pipe store.Pipeliner) {
+		for _, addr := range addrs {
+			pipe.Zadd(core.PROXY_SCHEDULE, lease, addr)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	records := store.LoadProxies(ctx, h.Store, addrs)
+	//分发与收集同时进行，批量大于通道容量时不会阻塞
+	go func() {
+		for _, proxy := range records {
+			if !limiter.Wait(ctx) {
+				return
+			}
+			select {
+			case h.ProxyChan <- proxy:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for i := 0; i < len(records); i++ {
+		var result CheckResult
+		select {
+		case result = <-h.ResultChan:
+		case <-ctx.Done():
+			return i, ctx.Err()
+		}
+		h.apply(ctx, result)
+	}
+	return len(records), nil
+}
+
+/*
+*记录检测结果，按结果及连续失败次数调整代理所在的池
+*检测地址只说明代理可用，不在评分池中的代理复活时放回检测队列，重新检测匿名级别、篡改及TLS拦截
+ */
+func (h *HistoryChecker) apply(ctx context.Context, result CheckResult) {
+	proxy := result.Proxy
+	addr := proxy.Addr()
+	proxy.UpdateScore()
+	levelPool := proxy.Pool()
+	pooled := false
+	if levelPool != "" {
+		_, err := h.Store.Zscore(ctx, levelPool, addr)
+		if err != nil && err != store.ErrNil {
+			glog.Errorln("history check load score ", addr, " error: ", err)
+		}
+		pooled = err == nil
+	}
+	archive := !result.Valid && proxy.ConsecutiveFails >= h.ArchiveFails
+	demote := !result.Valid && proxy.ConsecutiveFails >= h.DemoteFails
+	var candidate string
+	if result.Valid && levelPool != "" && !pooled {
+		bs, err := json.Marshal(proxy)
+		if err != nil {
+			glog.Errorln("history check marshal proxy ", addr, " error: ", err)
+		}
+		candidate = string(bs)
+	}
+	err := h.Store.Pipelined(ctx, func(pipe store.Pipeliner) {
+		pipe.Hmset(core.GetProxyDataKey(addr), proxy.ToHash())
+		switch {
+		case candidate != "":
+			pipe.Rpush(core.PROXY_CHECK_QUEUE, candidate)
+			h.Stats.IncrPipelined(pipe, stats.METRIC_PROMOTED, proxy.Source, 1)
+		case demote:
+			for _, pool := range core.ANONYMITY_POOLS {
+				pipe.Zrem(pool, addr)
 			}
-			h.ProxyChan <- proxy
-		}
-		proxylen := len(proxys)
-		success := 0
-		for i := 0; i < proxylen; i++ {
-			result := <-h.ResultChan
-			if result.Valid {
-				success++
+			if pooled && levelPool == core.PROXY_POOL_VALID {
+				h.Stats.IncrPipelined(pipe, stats.METRIC_EVICTED, proxy.Source, 1)
 			}
+		case pooled:
+			pipe.Zadd(levelPool, proxy.Score, addr)
 		}
-		historyCount := strconv.Itoa(success)
-		h.Redis.Set(core.PROXY_COUNT_HISTORY, historyCount)
-		time.Sleep(30 * time.Second)
+		if archive {
+			pipe.Srem(core.PROXY_POOL_HISTORY, addr)
+			pipe.Sadd(core.PROXY_POOL_ARCHIVE, addr)
+			pipe.Zrem(core.PROXY_SCHEDULE, addr)
+			h.Stats.IncrPipelined(pipe, stats.METRIC_ARCHIVED, proxy.Source, 1)
+		} else {
+			pipe.Zadd(core.PROXY_SCHEDULE, float64(h.Schedule.Next(proxy, time.Now()).Unix()), addr)
+		}
+	})
+	if err != nil {
+		glog.Errorln("history check save proxy ", addr, " error: ", err)
 	}
 }
 
-func NewHistoryChecker(redis *store.RedisManager, nWorkers, checkSize int, userAgent string, checkUrls []string) *HistoryChecker {
+/*
+*demoteFails、archiveFails不大于0时使用默认值，archiveFails不小于demoteFails
+*没有检测地址时全部代理都会被判为失败并移出代理池，返回错误
+ */
+func NewHistoryChecker(proxyStore store.ProxyStore, nWorkers, checkSize int, userAgent string, checkUrls []string, recorder *stats.Recorder, demoteFails, archiveFails int,
+	schedule Schedule, maxChecksPerSecond float64) (*HistoryChecker, error) {
+	urls := make([]string, 0, len(checkUrls))
+	for _, checkUrl := range checkUrls {
+		if checkUrl = strings.TrimSpace(checkUrl); checkUrl != "" {
+			urls = append(urls, checkUrl)
+		}
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("history check urls are empty")
+	}
 	if checkSize <= 0 {
 		checkSize = 100
 	}
@@ -90,11 +310,20 @@ func NewHistoryChecker(redis *store.RedisManager, nWorkers, checkSize int, userA
 	if nWorkers <= 0 {
 		nWorkers = 10
 	}
+	if demoteFails <= 0 {
+		demoteFails = HISTORY_DEMOTE_FAILS
+	}
+	if archiveFails <= 0 {
+		archiveFails = HISTORY_ARCHIVE_FAILS
+	}
+	if archiveFails < demoteFails {
+		archiveFails = demoteFails
+	}
 	workers := make([]*HistoryWorker, nWorkers)
 	for i := 0; i < nWorkers; i++ {
-		worker := &HistoryWorker{Redis: redis, UserAgent: userAgent, CheckUrls: checkUrls, ProxyChan: proxyChan, ResultChan: resultChan}
-		go worker.DoWork()
+		worker := &HistoryWorker{Store: proxyStore, UserAgent: userAgent, CheckUrls: urls, ProxyChan: proxyChan, ResultChan: resultChan}
 		workers[i] = worker
 	}
-	return &HistoryChecker{Redis: redis, ProxyChan: proxyChan, ResultChan: resultChan, Workers: workers}
+	return &HistoryChecker{Store: proxyStore, ProxyChan: proxyChan, ResultChan: resultChan, Workers: workers, Stats: recorder,
+		DemoteFails: demoteFails, ArchiveFails: archiveFails, Schedule: schedule, MaxChecksPerSecond: maxChecksPerSecond, BatchSize: checkSize}, nil
 }
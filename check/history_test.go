@@ -0,0 +1,117 @@
+package check
+
+import (
+	"context"
+	"fproxy/core"
+	"fproxy/store"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryCheckPromoteAndArchive(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := store.NewMemoryStore()
+	revived := proxyFromServer(t, newForwardProxy(t, nil, false))
+	revived.Anonymity = core.HighAnonymous
+	revived.ConsecutiveFails = 3
+	dying := core.NewProxy("127.0.0.1", 1, core.PROXY_SOURCE_SCAN, "")
+	dying.Anonymity = core.HighAnonymous
+	dead := core.NewProxy("127.0.0.1", 2, core.PROXY_SOURCE_SCAN, "")
+	dead.Anonymity = core.Anonymous
+	dead.ConsecutiveFails = 2
+	for _, proxy := range []core.Proxy{revived, dying, dead} {
+		store.SaveProxy(ctx, s, proxy)
+		s.Sadd(ctx, core.PROXY_POOL_HISTORY, proxy.Addr())
+	}
+	s.Zadd(ctx, core.PROXY_POOL_VALID, 50, dying.Addr())
+	s.Zadd(ctx, core.PROXY_POOL_ANONYMOUS, 50, dead.Addr())
+	//通道容量小于历史池大小
+	//每批2个，通道容量1
+	if _, err := NewHistoryChecker(s, 1, 1, "", []string{" "}, nil, 1, 3, NewSchedule(time.Minute, time.Hour), 100); err == nil {
+		t.Fatal("history checker created without check urls")
+	}
+	checker, err := NewHistoryChecker(s, 1, 1, "", []string{target.URL}, nil, 1, 3, NewSchedule(time.Minute, time.Hour), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker.BatchSize = 2
+	for _, worker := range checker.Workers {
+		go worker.DoWork(ctx)
+	}
+	if _, err := checker.SyncSchedule(ctx); err != nil {
+		t.Fatal(err)
+	}
+	limiter := NewRateLimiter(checker.MaxChecksPerSecond)
+	defer limiter.Stop()
+	checked := 0
+	for i := 0; i < 3; i++ {
+		n, err := checker.CheckDue(ctx, limiter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checked += n
+	}
+	if checked != 3 {
+		t.Fatalf("checked %d proxies, rescheduled proxies should not be checked again", checked)
+	}
+	//复活的代理不直接进入评分池，放回检测队列重新检测匿名级别
+	if _, err := s.Zscore(ctx, core.PROXY_POOL_VALID, revived.Addr()); err != store.ErrNil {
+		t.Errorf("revived proxy promoted without anony check: %v", err)
+	}
+	if values, _ := s.Lrange(ctx, core.PROXY_CHECK_QUEUE, 0, -1); len(values) != 1 || !strings.Contains(values[0], `"Port":`+strconv.Itoa(revived.Port)) {
+		t.Errorf("check queue %q", values)
+	}
+	if record, _ := store.LoadProxy(ctx, s, revived.Addr()); record.ConsecutiveFails != 0 || record.SuccessCount != 1 {
+		t.Errorf("revived record = %+v", record)
+	}
+	if _, err := s.Zscore(ctx, core.PROXY_POOL_VALID, dying.Addr()); err != store.ErrNil {
+		t.Errorf("failed proxy not demoted: %v", err)
+	}
+	if ok, _ := s.Sismember(ctx, core.PROXY_POOL_HISTORY, dying.Addr()); !ok {
+		t.Errorf("demoted proxy should stay in history")
+	}
+	if _, err := s.Zscore(ctx, core.PROXY_POOL_ANONYMOUS, dead.Addr()); err != store.ErrNil {
+		t.Errorf("dead proxy not demoted: %v", err)
+	}
+	if ok, _ := s.Sismember(ctx, core.PROXY_POOL_HISTORY, dead.Addr()); ok {
+		t.Errorf("dead proxy should leave history")
+	}
+	if ok, _ := s.Sismember(ctx, core.PROXY_POOL_ARCHIVE, dead.Addr()); !ok {
+		t.Errorf("dead proxy not archived")
+	}
+	if _, err := s.Zscore(ctx, core.PROXY_SCHEDULE, dead.Addr()); err != store.ErrNil {
+		t.Errorf("archived proxy still scheduled: %v", err)
+	}
+	next, err := s.Zscore(ctx, core.PROXY_SCHEDULE, revived.Addr())
+	if err != nil || int64(next) <= time.Now().Unix() {
+		t.Errorf("revived proxy next check = %v, %v", next, err)
+	}
+}
+
+func TestScheduleDelay(t *testing.T) {
+	schedule := NewSchedule(time.Minute, time.Hour)
+	fresh := core.Proxy{SuccessCount: 1}
+	stable := core.Proxy{SuccessCount: 50}
+	flaky := core.Proxy{SuccessCount: 50, FailCount: 50}
+	if !(schedule.Delay(fresh) < schedule.Delay(flaky) && schedule.Delay(flaky) < schedule.Delay(stable)) || schedule.Delay(stable) != time.Hour {
+		t.Errorf("delays fresh %v, flaky %v, stable %v", schedule.Delay(fresh), schedule.Delay(flaky), schedule.Delay(stable))
+	}
+	failing := core.Proxy{SuccessCount: 50, ConsecutiveFails: 1}
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		if delay := schedule.Delay(failing); delay != expected {
+			t.Errorf("backoff after %d fails = %v, want %v", failing.ConsecutiveFails, delay, expected)
+		}
+		failing.ConsecutiveFails++
+	}
+	failing.ConsecutiveFails = 30
+	if delay := schedule.Delay(failing); delay != time.Hour {
+		t.Errorf("backoff not capped: %v", delay)
+	}
+}
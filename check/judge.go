@@ -0,0 +1,164 @@
+package check
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fproxy/core"
+	"fproxy/httputil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//代理转发时添加、会暴露使用了代理的请求头，使用规范化的名称
+var PROXY_HEADERS = []string{"Via", "X-Forwarded-For", "X-Forwarded", "Forwarded", "Forwarded-For", "X-Real-Ip", "Client-Ip", "X-Client-Ip",
+	"X-Cluster-Client-Ip", "X-Originating-Ip", "True-Client-Ip", "X-Proxy-Id", "Proxy-Connection", "X-Bluecoat-Via"}
+
+//本机出口地址的缓存时长
+const EGRESS_IP_TTL = 10 * time.Minute
+
+//测量带宽时响应体的长度上限
+const BANDWIDTH_MAX_BODY_SIZE = 16 * 1024 * 1024
+
+//通过代理请求判定服务，proxy为空时直接请求
+func QueryJudge(judgeUrl, proxy string, maxBodySize int) (core.JudgeResult, error) {
+	result, _, err := QueryJudgeTimed(judgeUrl, proxy, nil, maxBodySize)
+	return result, err
+}
+
+//通过代理的CONNECT隧道请求https判定服务，能完成TLS握手并返回判定结果即支持https
+func QueryHttpsJudge(judgeUrl, proxy string, tlsConfig *tls.Config, maxBodySize int) (core.JudgeResult, error) {
+	result, _, err := QueryJudgeTimed(judgeUrl, proxy, tlsConfig, maxBodySize)
+	return result, err
+}
+
+//请求判定服务并返回各阶段耗时，judgeUrl为https时经CONNECT隧道请求
+func QueryJudgeTimed(judgeUrl, proxy string, tlsConfig *tls.Config, maxBodySize int) (core.JudgeResult, httputil.Timing, error) {
+	result := core.JudgeResult{}
+	bs, timing, err := httputil.DoHttpGetTimed(judgeUrl, proxy, tlsConfig, nil, maxBodySize)
+	if err != nil {
+		return result, timing, err
+	}
+	err = json.Unmarshal(bs, &result)
+	return result, timing, err
+}
+
+//通过代理下载判定服务提供的定长数据，返回下载速度，单位字节/秒
+func MeasureBandwidth(payloadUrl, proxy string, tlsConfig *tls.Config) (int64, error) {
+	_, timing, err := httputil.DoHttpGetTimed(payloadUrl, proxy, tlsConfig, nil, BANDWIDTH_MAX_BODY_SIZE)
+	if err != nil {
+		return 0, err
+	}
+	return timing.Throughput(), nil
+}
+
+//记录一次成功检测的各阶段耗时
+func recordTiming(proxy *core.Proxy, timing httputil.Timing) {
+	proxy.RecordSuccess(timing.Total)
+	proxy.DnsTime = int64(timing.DNS / time.Millisecond)
+	proxy.ConnectTime = int64(timing.Connect / time.Millisecond)
+	proxy.TlsTime = int64(timing.TLSHandshake / time.Millisecond)
+	proxy.FirstByteTime = int64(timing.FirstByte / time.Millisecond)
+}
+
+/*
+*本机出口地址，直接请求判定服务得到，定期刷新
+ */
+type EgressResolver struct {
+	lock     sync.Mutex
+	JudgeUrl string
+	ip       string
+	expireAt time.Time
+}
+
+func NewEgressResolver(judgeUrl string) *EgressResolver {
+	return &EgressResolver{JudgeUrl: judgeUrl}
+}
+
+//刷新失败时沿用上次的地址，请求判定服务时不持有锁，判定服务无响应不会阻塞其他工作器
+func (e *EgressResolver) Ip() (string, error) {
+	e.lock.Lock()
+	ip, expireAt := e.ip, e.expireAt
+	e.lock.Unlock()
+	if ip != "" && time.Now().Before(expireAt) {
+		return ip, nil
+	}
+	result, err := QueryJudge(e.JudgeUrl, "", 0)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if err != nil {
+		return e.ip, err
+	}
+	e.ip = result.Ip
+	e.expireAt = time.Now().Add(EGRESS_IP_TTL)
+	return e.ip, nil
+}
+
+/*
+*检查判定结果，返回泄露的请求头及是否暴露了本机出口地址
+*泄露的请求头包括代理请求头及值中带有出口地址的请求头，按名称排序
+ */
+func inspectJudge(result core.JudgeResult, egressIp string) ([]string, bool) {
+	leaked := make([]string, 0)
+	ipLeaked := egressIp != "" && result.Ip == egressIp
+	for name, values := range result.Headers {
+		//Host为判定服务的地址，判定服务与检测器部署在同一节点时与出口地址相同
+		if name == "Host" {
+			continue
+		}
+		isLeaked := false
+		for _, header := range PROXY_HEADERS {
+			if name == header {
+				isLeaked = true
+				break
+			}
+		}
+		if egressIp != "" {
+			for _, value := range values {
+				if containsIp(value, egressIp) {
+					isLeaked = true
+					ipLeaked = true
+					break
+				}
+			}
+		}
+		if isLeaked {
+			leaked = append(leaked, name)
+		}
+	}
+	sort.Strings(leaked)
+	return leaked, ipLeaked
+}
+
+/*
+*按检查结果划分匿名级别
+*暴露了本机出口地址时为透明，隐藏了地址但泄露了请求头时为匿名，否则为高匿
+*出口地址未知时无法确认地址是否暴露，泄露了请求头的按透明处理
+ */
+func classifyAnonymity(leakedHeaders []string, ipLeaked bool, egressIp string) int {
+	if ipLeaked || egressIp == "" && len(leakedHeaders) > 0 {
+		return core.Transparent
+	}
+	if len(leakedHeaders) > 0 {
+		return core.Anonymous
+	}
+	return core.HighAnonymous
+}
+
+//按地址字符切分后比较，避免1.2.3.4匹配到11.2.3.45
+func containsIp(value, ip string) bool {
+	tokens := strings.FieldsFunc(value, func(r rune) bool {
+		return !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F' || r == '.' || r == ':' || r == '[' || r == ']')
+	})
+	for _, token := range tokens {
+		if host, _, err := net.SplitHostPort(token); err == nil {
+			token = host
+		}
+		if strings.Trim(token, "[]") == ip {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package check
+
+import (
+	"errors"
+	"fproxy/core"
+	"fproxy/httputil"
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+//判定服务健康检查的默认值
+const (
+	//直接请求连续失败该次数后暂停使用
+	JUDGE_MAX_FAILS = 3
+	//暂停使用的时长，之后重新参与轮转
+	JUDGE_RETRY_INTERVAL = time.Minute
+	//直接请求的结果缓存时长，避免每个失败的代理都请求一次判定服务
+	JUDGE_PROBE_INTERVAL = 30 * time.Second
+	//直接请求的超时时长，无响应的判定服务记为不可用
+	JUDGE_PROBE_TIMEOUT = 5 * time.Second
+)
+
+//可用的判定服务不足，无法判断代理是否可用，不应计为代理失败
+var ErrNoJudge = errors.New("not enough judges available")
+
+/*
+*判定服务地址及轮转权重，权重不大于0时为1
+ */
+type Judge struct {
+	Url    string
+	Weight int
+}
+
+type judgeState struct {
+	Judge
+	Egress       *EgressResolver
+	ProbeTimeout time.Duration
+	//平滑加权轮转的当前权重，由JudgePool的锁保护
+	current   int
+	lock      sync.Mutex
+	fails     int
+	downUntil time.Time
+	probedAt  time.Time
+}
+
+func (j *judgeState) available(now time.Time) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return now.After(j.downUntil)
+}
+
+//经代理请求成功，判定服务可用
+func (j *judgeState) succeed() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.fails = 0
+	j.downUntil = time.Time{}
+}
+
+/*
+*经代理请求失败时直接请求判定服务，区分是代理还是判定服务的问题，返回判定服务是否可用
+*连续失败JUDGE_MAX_FAILS次后暂停使用JUDGE_RETRY_INTERVAL，请求期间其他调用沿用上次的结果
+ */
+func (j *judgeState) verify(maxBodySize int) bool {
+	j.lock.Lock()
+	if time.Since(j.probedAt) < JUDGE_PROBE_INTERVAL {
+		defer j.lock.Unlock()
+		return j.fails == 0
+	}
+	j.probedAt = time.Now()
+	j.lock.Unlock()
+	err := j.probe(maxBodySize)
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err == nil {
+		if j.fails >= JUDGE_MAX_FAILS {
+			glog.Infoln("judge ", j.Url, " recovered")
+		}
+		j.fails = 0
+		j.downUntil = time.Time{}
+		return true
+	}
+	j.fails++
+	glog.Errorln("judge ", j.Url, " unavailable: ", err)
+	if j.fails >= JUDGE_MAX_FAILS {
+		j.downUntil = time.Now().Add(JUDGE_RETRY_INTERVAL)
+	}
+	return false
+}
+
+//直接请求判定服务，超过ProbeTimeout未返回时记为失败，请求本身受http客户端的超时限制
+func (j *judgeState) probe(maxBodySize int) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := QueryJudge(j.Url, "", maxBodySize)
+		done <- err
+	}()
+	timer := time.NewTimer(j.ProbeTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return errors.New("judge probe timeout after " + j.ProbeTimeout.String())
+	}
+}
+
+//判定服务看到的本机出口地址
+func (j *judgeState) egress() string {
+	egressIp, err := j.Egress.Ip()
+	if err != nil {
+		glog.Errorln("resolve egress ip by judge ", j.Url, " error: ", err)
+	}
+	return egressIp
+}
+
+/*
+*一次判定的结果、耗时及判定服务看到的本机出口地址
+ */
+type judgement struct {
+	Result core.JudgeResult
+	Timing httputil.Timing
+	Egress string
+}
+
+/*
+*多个判定服务，按权重平滑轮转，暂停使用直接请求失败过多的判定服务
+*Quorum大于1时依次请求多个判定服务，Quorum个判定服务划分的匿名级别一致才采用，单个判定服务出错不会影响结果
+ */
+type JudgePool struct {
+	lock   sync.Mutex
+	judges []*judgeState
+	Quorum int
+}
+
+//quorum不大于0时为1，不超过判定服务的数量
+func NewJudgePool(judges []Judge, quorum int) *JudgePool {
+	states := make([]*judgeState, 0, len(judges))
+	for _, judge := range judges {
+		if judge.Url == "" {
+			continue
+		}
+		if judge.Weight <= 0 {
+			judge.Weight = 1
+		}
+		states = append(states, &judgeState{Judge: judge, Egress: NewEgressResolver(judge.Url), ProbeTimeout: JUDGE_PROBE_TIMEOUT})
+	}
+	if quorum <= 0 {
+		quorum = 1
+	}
+	if quorum > len(states) {
+		quorum = len(states)
+	}
+	return &JudgePool{judges: states, Quorum: quorum}
+}
+
+/*
+*按平滑加权轮转选出第一个判定服务，其余可用的判定服务按配置顺序排在后面
+*全部暂停使用时仍返回全部判定服务，由请求结果决定
+ */
+func (p *JudgePool) pick() []*judgeState {
+	now := time.Now()
+	candidates := make([]*judgeState, 0, len(p.judges))
+	for _, judge := range p.judges {
+		if judge.available(now) {
+			candidates = append(candidates, judge)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, p.judges...)
+	}
+	if len(candidates) == 0 {
+		return candidates
+	}
+	p.lock.Lock()
+	total := 0
+	best := 0
+	for i, judge := range candidates {
+		judge.current += judge.Weight
+		total += judge.Weight
+		if judge.current > candidates[best].current {
+			best = i
+		}
+	}
+	candidates[best].current -= total
+	p.lock.Unlock()
+	ordered := make([]*judgeState, 0, len(candidates))
+	ordered = append(ordered, candidates[best:]...)
+	return append(ordered, candidates[:best]...)
+}
+
+//第一个能得到出口地址的判定服务看到的出口地址
+func (p *JudgePool) egress() string {
+	for _, judge := range p.pick() {
+		if egressIp := judge.egress(); egressIp != "" {
+			return egressIp
+		}
+	}
+	return ""
+}
+
+/*
+*经代理请求判定服务，直到Quorum个判定服务划分的匿名级别一致
+*判定服务本身不可用时改用下一个，判定服务可用而代理请求失败时返回代理的错误
+*可用的判定服务不足Quorum个时返回ErrNoJudge，判定结果不一致时返回错误
+ */
+func (p *JudgePool) Query(proxy string, maxBodySize int) (judgement, error) {
+	votes := make(map[int][]judgement)
+	answered := 0
+	for _, judge := range p.pick() {
+		result, timing, err := QueryJudgeTimed(judge.Url, proxy, nil, maxBodySize)
+		if err != nil {
+			if judge.verify(maxBodySize) {
+				return judgement{}, err
+			}
+			continue
+		}
+		judge.succeed()
+		answered++
+		verdict := judgement{Result: result, Timing: timing, Egress: judge.egress()}
+		leaked, ipLeaked := inspectJudge(result, verdict.Egress)
+		anonymity := classifyAnonymity(leaked, ipLeaked, verdict.Egress)
+		votes[anonymity] = append(votes[anonymity], verdict)
+		if len(votes[anonymity]) >= p.Quorum {
+			return votes[anonymity][0], nil
+		}
+	}
+	if answered < p.Quorum {
+		return judgement{}, ErrNoJudge
+	}
+	return judgement{}, errors.New("judges disagree on anonymity of proxy " + proxy)
+}
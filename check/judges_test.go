@@ -0,0 +1,125 @@
+package check
+
+import (
+	"fproxy/core"
+	"fproxy/server"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func singleJudge(judgeUrl string) *JudgePool {
+	return NewJudgePool([]Judge{{Url: judgeUrl}}, 1)
+}
+
+func TestJudgePoolRotation(t *testing.T) {
+	pool := NewJudgePool([]Judge{{Url: "http://a/judge", Weight: 2}, {Url: "http://b/judge"}, {Url: ""}}, 5)
+	if len(pool.judges) != 2 || pool.Quorum != 2 {
+		t.Fatalf("judges = %d, quorum = %d", len(pool.judges), pool.Quorum)
+	}
+	order := ""
+	for i := 0; i < 6; i++ {
+		judges := pool.pick()
+		if len(judges) != 2 || judges[0] == judges[1] {
+			t.Fatalf("picked %v", judges)
+		}
+		order += judges[0].Url[7:8]
+	}
+	if order != "abaaba" {
+		t.Errorf("rotation order %s", order)
+	}
+}
+
+//一个判定服务给所有请求加上Via，单独使用时会把高匿代理误判为匿名
+func TestJudgePoolQuorum(t *testing.T) {
+	honest := &server.JudgeHandler{RealIpHeader: "X-Test-Egress"}
+	poisoned := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Via", "1.1 poisoned")
+		honest.ServeHTTP(w, r)
+	}))
+	defer poisoned.Close()
+	judges := []Judge{{Url: poisoned.URL, Weight: 10}}
+	for i := 0; i < 2; i++ {
+		judge := httptest.NewServer(honest)
+		defer judge.Close()
+		judges = append(judges, Judge{Url: judge.URL})
+	}
+	proxy := newForwardProxy(t, map[string]string{"X-Test-Egress": "10.0.0.2"}, false)
+	cases := []struct {
+		quorum    int
+		anonymity int
+		err       bool
+	}{
+		{1, core.Anonymous, false},
+		{2, core.HighAnonymous, false},
+		{3, 0, true},
+	}
+	for _, c := range cases {
+		pool := NewJudgePool(judges, c.quorum)
+		verdict, err := pool.Query(proxy.URL, 0)
+		if c.err {
+			if err == nil || err == ErrNoJudge {
+				t.Errorf("quorum %d: error = %v", c.quorum, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("quorum %d: %v", c.quorum, err)
+		}
+		leaked, ipLeaked := inspectJudge(verdict.Result, verdict.Egress)
+		if anonymity := classifyAnonymity(leaked, ipLeaked, verdict.Egress); anonymity != c.anonymity || verdict.Egress != "127.0.0.1" {
+			t.Errorf("quorum %d: anonymity = %d, egress %s", c.quorum, anonymity, verdict.Egress)
+		}
+	}
+}
+
+func TestJudgePoolHealth(t *testing.T) {
+	judge := httptest.NewServer(&server.JudgeHandler{})
+	defer judge.Close()
+	down := httptest.NewServer(&server.JudgeHandler{})
+	down.Close()
+	pool := NewJudgePool([]Judge{{Url: down.URL, Weight: 10}, {Url: judge.URL}}, 1)
+	proxy := newForwardProxy(t, nil, false)
+	for i := 0; i < JUDGE_MAX_FAILS; i++ {
+		//跳过直接请求的缓存，每次都确认判定服务
+		pool.judges[0].probedAt = time.Time{}
+		if _, err := pool.Query(proxy.URL, 0); err != nil {
+			t.Fatalf("query %d with a down judge: %v", i, err)
+		}
+	}
+	if judges := pool.pick(); len(judges) != 1 || judges[0].Url != judge.URL {
+		t.Errorf("down judge still picked: %v", judges)
+	}
+	if _, err := pool.Query("127.0.0.1:1", 0); err == nil || err == ErrNoJudge {
+		t.Errorf("dead proxy error = %v", err)
+	}
+	if _, err := singleJudge(down.URL).Query(proxy.URL, 0); err != ErrNoJudge {
+		t.Errorf("query without available judge error = %v", err)
+	}
+	//判定服务不可用时不计为代理失败
+	worker := AnonyCheckWorker{Judges: singleJudge(down.URL), Detector: &ProtocolDetector{}}
+	candidate := proxyFromServer(t, proxy)
+	if _, err := worker.judge(&candidate); err != ErrNoJudge || len(candidate.Protocols) != 0 {
+		t.Errorf("detect without available judge = %v, %v", candidate.Protocols, err)
+	}
+}
+
+//无响应的判定服务在超时后记为不可用
+func TestJudgeProbeTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+	pool := singleJudge(hung.URL)
+	pool.judges[0].ProbeTimeout = 100 * time.Millisecond
+	start := time.Now()
+	if pool.judges[0].verify(0) {
+		t.Errorf("hung judge verified")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("probe took %v", elapsed)
+	}
+}
@@ -0,0 +1,216 @@
+package check
+
+import (
+	"encoding/xml"
+	"errors"
+	"fproxy/httputil"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+//目标站点验证请求的默认值
+const (
+	PROFILE_STATUS     = http.StatusOK
+	PROFILE_MAX_LENGTH = 1048576
+)
+
+/*
+*目标站点验证配置，代理通过全部请求才算通过该配置
+*判定服务只能说明代理可用，目标站点可能封禁代理地址或返回验证码，按实际抓取的站点分别验证
+ */
+type Profile struct {
+	Name     string
+	Requests []ProfileRequest
+}
+
+/*
+*一个验证请求，响应状态须为Status，响应体须匹配Body，响应头须满足全部Headers规则
+ */
+type ProfileRequest struct {
+	Url       string
+	Status    int
+	Body      *regexp.Regexp
+	UserAgent string
+	MaxLength int
+	Headers   []HeaderRule
+}
+
+/*
+*响应头规则，Absent为true时要求没有该响应头，否则要求有该响应头且值匹配Match，Match为空时只要求存在
+ */
+type HeaderRule struct {
+	Name   string
+	Match  *regexp.Regexp
+	Absent bool
+}
+
+type ProfilesXml struct {
+	XMLName  xml.Name     `xml:"profiles"`
+	Profiles []ProfileXml `xml:"profile"`
+}
+
+type ProfileXml struct {
+	Name     string              `xml:"name,attr"`
+	Requests []ProfileRequestXml `xml:"request"`
+}
+
+type ProfileRequestXml struct {
+	Url       string          `xml:"url,attr"`
+	Status    int             `xml:"status,attr"`
+	Body      string          `xml:"body,attr"`
+	UA        string          `xml:"ua,attr"`
+	MaxLength int             `xml:"max-length,attr"`
+	Headers   []HeaderRuleXml `xml:"header"`
+}
+
+type HeaderRuleXml struct {
+	Name   string `xml:"name,attr"`
+	Match  string `xml:"match,attr"`
+	Absent bool   `xml:"absent,attr"`
+}
+
+func ParseProfilesXml(path string) ([]Profile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	profilesXml := ProfilesXml{}
+	err = xml.Unmarshal(content, &profilesXml)
+	if err != nil {
+		return nil, err
+	}
+	return xmlToProfiles(profilesXml)
+}
+
+//配置名保存时以逗号连接，不能为空、重复或含逗号
+func xmlToProfiles(profilesXml ProfilesXml) ([]Profile, error) {
+	profiles := make([]Profile, 0, len(profilesXml.Profiles))
+	names := make(map[string]bool)
+	for _, profileXml := range profilesXml.Profiles {
+		name := strings.TrimSpace(profileXml.Name)
+		if name == "" || strings.Contains(name, ",") || names[name] {
+			return nil, errors.New("invalid or duplicate profile name: " + profileXml.Name)
+		}
+		names[name] = true
+		if len(profileXml.Requests) == 0 {
+			return nil, errors.New("profile " + name + " has no request")
+		}
+		profile := Profile{Name: name, Requests: make([]ProfileRequest, len(profileXml.Requests))}
+		for i, requestXml := range profileXml.Requests {
+			request, err := xmlToProfileRequest(requestXml)
+			if err != nil {
+				return nil, errors.New("profile " + name + ": " + err.Error())
+			}
+			profile.Requests[i] = request
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+func xmlToProfileRequest(requestXml ProfileRequestXml) (ProfileRequest, error) {
+	request := ProfileRequest{Url: requestXml.Url, Status: requestXml.Status, UserAgent: requestXml.UA, MaxLength: requestXml.MaxLength}
+	if request.Url == "" {
+		return request, errors.New("empty request url")
+	}
+	if request.Status == 0 {
+		request.Status = PROFILE_STATUS
+	}
+	if request.MaxLength <= 0 {
+		request.MaxLength = PROFILE_MAX_LENGTH
+	}
+	var err error
+	if requestXml.Body != "" {
+		request.Body, err = regexp.Compile(requestXml.Body)
+		if err != nil {
+			return request, err
+		}
+	}
+	for _, headerXml := range requestXml.Headers {
+		if headerXml.Name == "" {
+			return request, errors.New("empty header name in request " + request.Url)
+		}
+		rule := HeaderRule{Name: headerXml.Name, Absent: headerXml.Absent}
+		if headerXml.Match != "" {
+			rule.Match, err = regexp.Compile(headerXml.Match)
+			if err != nil {
+				return request, err
+			}
+		}
+		request.Headers = append(request.Headers, rule)
+	}
+	return request, nil
+}
+
+//检查一个响应，不满足时返回原因
+func (r ProfileRequest) verify(res *http.Response, body []byte) error {
+	if res.StatusCode != r.Status {
+		return errors.New("status " + res.Status)
+	}
+	if r.Body != nil && !r.Body.Match(body) {
+		return errors.New("body not match " + r.Body.String())
+	}
+	for _, rule := range r.Headers {
+		values, ok := res.Header[http.CanonicalHeaderKey(rule.Name)]
+		if rule.Absent {
+			if ok {
+				return errors.New("unexpected header " + rule.Name)
+			}
+			continue
+		}
+		if !ok {
+			return errors.New("missing header " + rule.Name)
+		}
+		if rule.Match != nil && !rule.Match.MatchString(strings.Join(values, ", ")) {
+			return errors.New("header " + rule.Name + " not match " + rule.Match.String())
+		}
+	}
+	return nil
+}
+
+/*
+*按目标站点验证配置检测代理
+ */
+type ProfileChecker struct {
+	Profiles []Profile
+}
+
+//没有配置时返回nil，不做检测
+func NewProfileChecker(profiles []Profile) *ProfileChecker {
+	if len(profiles) == 0 {
+		return nil
+	}
+	return &ProfileChecker{Profiles: profiles}
+}
+
+//返回代理通过的配置名，按配置的顺序
+func (p *ProfileChecker) Check(proxy string) []string {
+	passed := make([]string, 0, len(p.Profiles))
+	for _, profile := range p.Profiles {
+		if p.checkProfile(profile, proxy) {
+			passed = append(passed, profile.Name)
+		}
+	}
+	return passed
+}
+
+func (p *ProfileChecker) checkProfile(profile Profile, proxy string) bool {
+	for _, request := range profile.Requests {
+		var headers map[string]string
+		if request.UserAgent != "" {
+			headers = map[string]string{"User-Agent": request.UserAgent}
+		}
+		res, body, err := httputil.DoHttpGetResponse(request.Url, proxy, nil, headers, request.MaxLength)
+		if err == nil {
+			err = request.verify(res, body)
+		}
+		if err != nil {
+			glog.Infoln("profile ", profile.Name, " request ", request.Url, " by proxy ", proxy, " fail: ", err)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package check
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testProfiles = `<?xml version="1.0" encoding="UTF-8"?>
+<profiles>
+	<profile name="shop">
+		<request url="{shop}/" body="welcome \d+">
+			<header name="content-type" match="^text/html" />
+			<header name="X-Captcha" absent="true" />
+		</request>
+	</profile>
+	<profile name="forum">
+		<request url="{forum}/" status="200" body="welcome">
+			<header name="X-Captcha" absent="true" />
+		</request>
+		<request url="{forum}/login" status="401" />
+	</profile>
+</profiles>`
+
+func writeProfiles(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "profiles.xml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProfileChecker(t *testing.T) {
+	shop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("welcome 1"))
+	}))
+	defer shop.Close()
+	//论坛对带Via的请求返回验证码
+	forum := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Via") != "" {
+			w.Header().Set("X-Captcha", "1")
+		}
+		if r.URL.Path == "/login" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("welcome"))
+	}))
+	defer forum.Close()
+	content := strings.NewReplacer("{shop}", shop.URL, "{forum}", forum.URL).Replace(testProfiles)
+	profiles, err := ParseProfilesXml(writeProfiles(t, content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 || profiles[0].Requests[0].Status != PROFILE_STATUS || len(profiles[1].Requests) != 2 {
+		t.Fatalf("profiles = %+v", profiles)
+	}
+	checker := NewProfileChecker(profiles)
+	cases := []struct {
+		headers map[string]string
+		passed  []string
+	}{
+		{nil, []string{"shop", "forum"}},
+		{map[string]string{"Via": "1.1 squid"}, []string{"shop"}},
+	}
+	for _, c := range cases {
+		proxy := newForwardProxy(t, c.headers, false)
+		if passed := checker.Check(proxy.URL); !reflect.DeepEqual(passed, c.passed) {
+			t.Errorf("proxy with %v passed %v, want %v", c.headers, passed, c.passed)
+		}
+	}
+	proxy := proxyFromServer(t, newForwardProxy(t, nil, false))
+	proxy.Profiles = []string{"stale"}
+	AnonyCheckWorker{Profiles: checker}.checkProfiles(&proxy)
+	if !proxy.PassesProfile("forum") || proxy.PassesProfile("stale") {
+		t.Errorf("proxy profiles = %v", proxy.Profiles)
+	}
+	if NewProfileChecker(nil) != nil {
+		t.Errorf("checker without profiles")
+	}
+	invalid := []string{
+		`<profiles><profile name="a,b"><request url="http://a/" /></profile></profiles>`,
+		`<profiles><profile name="a"><request url="http://a/" /></profile><profile name="a"><request url="http://a/" /></profile></profiles>`,
+		`<profiles><profile name="a"></profile></profiles>`,
+		`<profiles><profile name="a"><request url="http://a/" body="(" /></profile></profiles>`,
+		`<profiles><profile name="a"><request url="http://a/"><header match="x" /></request></profile></profiles>`,
+	}
+	for _, content := range invalid {
+		if _, err := ParseProfilesXml(writeProfiles(t, content)); err == nil {
+			t.Errorf("invalid profiles accepted: %s", content)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package check
+
+import (
+	"context"
+	"fproxy/core"
+	"math"
+	"time"
+)
+
+//检测调度的默认值
+const (
+	SCHEDULE_MIN_INTERVAL = time.Minute
+	SCHEDULE_MAX_INTERVAL = time.Hour
+	//成功次数达到该值且从未失败的代理视为完全稳定，使用最长间隔
+	SCHEDULE_STABLE_CHECKS = 10
+	//取出检测时先推迟该时长，检测完成前不会被再次取出
+	SCHEDULE_LEASE = 10 * time.Minute
+)
+
+/*
+*按代理的检测结果计算下次检测时间
+*成功的代理按稳定程度在最短与最长间隔之间取值，新代理检测更频繁，稳定的代理检测更少
+*失败的代理从最短间隔开始按连续失败次数指数退避，不超过最长间隔
+ */
+type Schedule struct {
+	MinInterval  time.Duration
+	MaxInterval  time.Duration
+	StableChecks int
+}
+
+func NewSchedule(minInterval, maxInterval time.Duration) Schedule {
+	if minInterval <= 0 {
+		minInterval = SCHEDULE_MIN_INTERVAL
+	}
+	if maxInterval <= 0 {
+		maxInterval = SCHEDULE_MAX_INTERVAL
+	}
+	if maxInterval < minInterval {
+		maxInterval = minInterval
+	}
+	return Schedule{MinInterval: minInterval, MaxInterval: maxInterval, StableChecks: SCHEDULE_STABLE_CHECKS}
+}
+
+//距下次检测的间隔
+func (s Schedule) Delay(proxy core.Proxy) time.Duration {
+	if proxy.ConsecutiveFails > 0 {
+		backoff := float64(s.MinInterval) * math.Pow(2, float64(proxy.ConsecutiveFails-1))
+		if backoff >= float64(s.MaxInterval) {
+			return s.MaxInterval
+		}
+		return time.Duration(backoff)
+	}
+	total := proxy.SuccessCount + proxy.FailCount
+	if total == 0 || s.StableChecks <= 0 {
+		return s.MinInterval
+	}
+	successRate := float64(proxy.SuccessCount) / float64(total)
+	maturity := math.Min(float64(proxy.SuccessCount)/float64(s.StableChecks), 1)
+	stability := successRate * maturity
+	return s.MinInterval + time.Duration(stability*float64(s.MaxInterval-s.MinInterval))
+}
+
+func (s Schedule) Next(proxy core.Proxy, now time.Time) time.Time {
+	return now.Add(s.Delay(proxy))
+}
+
+/*
+*本进程的检测速率限制，rate为每秒最多检测的代理数，不大于0时不限制
+*多个进程各自限速，不共享配额
+ */
+type RateLimiter struct {
+	ticker *time.Ticker
+}
+
+func NewRateLimiter(rate float64) *RateLimiter {
+	if rate <= 0 {
+		return &RateLimiter{}
+	}
+	return &RateLimiter{ticker: time.NewTicker(time.Duration(float64(time.Second) / rate))}
+}
+
+//等待可以进行下一次检测，ctx取消时返回false
+func (r *RateLimiter) Wait(ctx context.Context) bool {
+	if r.ticker == nil {
+		return ctx.Err() == nil
+	}
+	select {
+	case <-r.ticker.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (r *RateLimiter) Stop() {
+	if r.ticker != nil {
+		r.ticker.Stop()
+	}
+}
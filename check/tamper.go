@@ -0,0 +1,78 @@
+package check
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fproxy/httputil"
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+//原始内容的缓存时长
+const TAMPER_REFERENCE_TTL = 10 * time.Minute
+
+/*
+*篡改检测，直接请求判定服务的固定页面得到原始内容的摘要及长度，再经代理请求同一页面比较
+*原始内容定期刷新，判定服务更新页面后无需重启
+ */
+type TamperChecker struct {
+	lock      sync.Mutex
+	PageUrl   string
+	TLSConfig *tls.Config
+	sum       [sha256.Size]byte
+	size      int
+	expireAt  time.Time
+}
+
+func NewTamperChecker(pageUrl string, tlsConfig *tls.Config) *TamperChecker {
+	return &TamperChecker{PageUrl: pageUrl, TLSConfig: tlsConfig}
+}
+
+//刷新失败时沿用上次的原始内容，请求页面时不持有锁，页面无响应不会阻塞其他工作器
+func (t *TamperChecker) reference() ([sha256.Size]byte, int, error) {
+	t.lock.Lock()
+	if t.size > 0 && time.Now().Before(t.expireAt) {
+		defer t.lock.Unlock()
+		return t.sum, t.size, nil
+	}
+	t.lock.Unlock()
+	bs, _, err := httputil.DoHttpGetTimed(t.PageUrl, "", t.TLSConfig, nil, BANDWIDTH_MAX_BODY_SIZE)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err != nil {
+		return t.sum, t.size, err
+	}
+	if len(bs) == 0 {
+		return t.sum, t.size, errors.New("empty tamper check page: " + t.PageUrl)
+	}
+	t.sum = sha256.Sum256(bs)
+	t.size = len(bs)
+	t.expireAt = time.Now().Add(TAMPER_REFERENCE_TTL)
+	return t.sum, t.size, nil
+}
+
+//经代理请求固定页面，内容的摘要或长度与原始内容不同即为篡改，请求失败时返回错误
+func (t *TamperChecker) Check(proxy string) (bool, error) {
+	sum, size, err := t.reference()
+	if size == 0 {
+		if err == nil {
+			err = errors.New("no reference of tamper check page")
+		}
+		return false, err
+	}
+	bs, _, err := httputil.DoHttpGetTimed(t.PageUrl, proxy, t.TLSConfig, nil, BANDWIDTH_MAX_BODY_SIZE)
+	if err != nil {
+		return false, err
+	}
+	if len(bs) != size {
+		glog.Infoln("page size through proxy ", proxy, " is ", len(bs), ", want ", size)
+		return true, nil
+	}
+	if sha256.Sum256(bs) != sum {
+		glog.Infoln("page content changed through proxy ", proxy)
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,119 @@
+package check
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fproxy/core"
+	"fproxy/server"
+	"fproxy/store"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//测试用的篡改代理，在html页面中注入脚本
+func newInjectingProxy(t *testing.T) *httptest.Server {
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequest(r.Method, r.URL.String(), nil)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		body = bytes.Replace(body, []byte("</body>"), []byte(`<script src="http://ads.example.com/a.js"></script></body>`), 1)
+		w.WriteHeader(res.StatusCode)
+		w.Write(body)
+	}))
+	proxy.Config.ReadHeaderTimeout = time.Second
+	proxy.Start()
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestTamperCheck(t *testing.T) {
+	page := httptest.NewServer(http.HandlerFunc(server.ServeTamperPage))
+	defer page.Close()
+	tamper := NewTamperChecker(page.URL, nil)
+	honest := proxyFromServer(t, newForwardProxy(t, nil, false))
+	if tampered, err := tamper.Check(honest.URL()); err != nil || tampered {
+		t.Errorf("honest proxy tampered = %v, %v", tampered, err)
+	}
+	injecting := proxyFromServer(t, newInjectingProxy(t))
+	if tampered, err := tamper.Check(injecting.URL()); err != nil || !tampered {
+		t.Errorf("injecting proxy tampered = %v, %v", tampered, err)
+	}
+	if _, err := tamper.Check("127.0.0.1:1"); err == nil {
+		t.Errorf("unreachable proxy should be an error")
+	}
+}
+
+//篡改内容的代理通过匿名检测后也不进入评分池
+func TestAnonyCheckExcludesTampering(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/", &server.JudgeHandler{})
+	mux.HandleFunc("/page", server.ServeTamperPage)
+	judge := httptest.NewServer(mux)
+	defer judge.Close()
+	proxy := proxyFromServer(t, newInjectingProxy(t))
+	s := store.NewMemoryStore()
+	bs, _ := json.Marshal(proxy)
+	s.Rpush(context.Background(), core.PROXY_CHECK_QUEUE, string(bs))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	checker := NewAnonyChecker(singleJudge(judge.URL), s, 1, 0, time.Minute, nil, "", nil, "", judge.URL+"/page", nil, nil)
+	go checker.CheckAll(ctx)
+	var record core.Proxy
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		record, _ = store.LoadProxy(ctx, s, proxy.Addr())
+		if record.SuccessCount > 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !record.Tampered {
+		t.Errorf("tampering proxy record = %+v", record)
+	}
+	for _, pool := range core.ANONYMITY_POOLS {
+		if _, err := s.Zscore(ctx, pool, proxy.Addr()); err != store.ErrNil {
+			t.Errorf("tampering proxy in %s: %v", pool, err)
+		}
+	}
+}
+
+//刷新原始内容时不持有锁，页面无响应时其他工作器不会被阻塞
+func TestTamperReferenceUnlockedFetch(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+		server.ServeTamperPage(w, r)
+	}))
+	defer page.Close()
+	checker := NewTamperChecker(page.URL, nil)
+	done := make(chan error)
+	go func() {
+		_, _, err := checker.reference()
+		done <- err
+	}()
+	<-received
+	if !checker.lock.TryLock() {
+		t.Errorf("lock held during reference fetch")
+	} else {
+		checker.lock.Unlock()
+	}
+	close(release)
+	if err := <-done; err != nil || checker.size == 0 {
+		t.Errorf("reference = %d, %v", checker.size, err)
+	}
+}
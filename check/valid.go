@@ -0,0 +1,214 @@
+package check
+
+import (
+	"context"
+	"crypto/tls"
+	"fproxy/core"
+	"fproxy/geo"
+	"fproxy/stats"
+	"fproxy/store"
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+//评分池复检的默认值
+const (
+	VALID_CHECK_INTERVAL = 5 * time.Minute
+	VALID_MAX_FAILS      = 2
+)
+
+/*
+*评分池复检，定期以判定服务重新检测各匿名级别池中的代理
+*匿名级别变化的代理移到对应的池，连续失败maxFails次的代理移出评分池，仍留在历史池等待复活
+ */
+type ValidChecker struct {
+	Store    store.ProxyStore
+	Worker   AnonyCheckWorker
+	NWorkers int
+	MaxFails int
+	Interval time.Duration
+	Stats    *stats.Recorder
+}
+
+func NewValidChecker(judges *JudgePool, proxyStore store.ProxyStore, nWorkers, maxBodySize int, recorder *stats.Recorder, httpsCheckUrl string, tlsConfig *tls.Config, tamperCheckUrl string, maxFails int, interval time.Duration,
+	locator *geo.Locator, profiles *ProfileChecker) *ValidChecker {
+	if nWorkers < 1 {
+		nWorkers = 10
+	}
+	if maxFails <= 0 {
+		maxFails = VALID_MAX_FAILS
+	}
+	if interval <= 0 {
+		interval = VALID_CHECK_INTERVAL
+	}
+	worker := AnonyCheckWorker{Judges: judges, Store: proxyStore, MaxBodySize: maxBodySize, Stats: recorder,
+		HttpsCheckUrl: httpsCheckUrl, TLSConfig: tlsConfig, Geo: locator, Profiles: profiles}
+	if tamperCheckUrl != "" {
+		worker.Tamper = NewTamperChecker(tamperCheckUrl, tlsConfig)
+	}
+	return &ValidChecker{Store: proxyStore, Worker: worker, NWorkers: nWorkers, MaxFails: maxFails, Interval: interval, Stats: recorder}
+}
+
+func (v *ValidChecker) CheckAll(ctx context.Context) {
+	for {
+		evicted, err := v.CheckOnce(ctx)
+		if err != nil {
+			glog.Errorln("valid pool check error: ", err)
+		}
+		if evicted > 0 {
+			glog.Infoln("evict ", evicted, " dead proxies from scored pools")
+		}
+		if !sleepContext(ctx, v.Interval) {
+			return
+		}
+	}
+}
+
+//检测一轮全部评分池，返回移出评分池的代理数
+func (v *ValidChecker) CheckOnce(ctx context.Context) (int, error) {
+	proxies := make([]pooledProxy, 0)
+	for _, pool := range core.ANONYMITY_POOLS {
+		n, err := v.Store.Zcard(ctx, pool)
+		if err != nil {
+			return 0, err
+		}
+		pooled, err := store.TopProxies(ctx, v.Store, pool, n)
+		if err != nil {
+			return 0, err
+		}
+		for _, proxy := range pooled {
+			proxies = append(proxies, pooledProxy{Proxy: proxy, Pool: pool})
+		}
+	}
+	proxyChan := make(chan pooledProxy)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	evicted := 0
+	for i := 0; i < v.NWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for proxy := range proxyChan {
+				if v.check(ctx, proxy.Proxy, proxy.Pool) {
+					lock.Lock()
+					evicted++
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, proxy := range proxies {
+		select {
+		case proxyChan <- proxy:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(proxyChan)
+	wg.Wait()
+	return evicted, ctx.Err()
+}
+
+type pooledProxy struct {
+	Proxy core.Proxy
+	Pool  string
+}
+
+//复检成功时写入的字段，来源、认证、带宽等由其他组件维护的字段不覆盖
+var validCheckFields = []string{"protocol", "protocols", "anonymity", "lastChecked", "successCount", "consecutiveFails", "latency", "dnsTime", "connectTime", "tlsTime",
+	"firstByteTime", "score", "leakedHeaders", "ipLeaked", "https", "tlsIntercepted", "tampered", "country", "city", "asn", "asnOrg", "profiles"}
+
+//复检失败时只更新失败计数及评分
+var validFailFields = []string{"lastChecked", "failCount", "consecutiveFails", "score"}
+
+func pickFields(hash map[string]string, fields []string) map[string]string {
+	picked := make(map[string]string, len(fields))
+	for _, field := range fields {
+		picked[field] = hash[field]
+	}
+	return picked
+}
+
+/*
+*复检一个代理，oldPool为取快照时代理所在的池，返回是否被移出评分池
+*快照之后代理可能已被历史池复检或高匿检测移出评分池、改写记录，检测前重新读取，已不在oldPool中的代理跳过
+ */
+func (v *ValidChecker) check(ctx context.Context, snapshot core.Proxy, oldPool string) bool {
+	addr := snapshot.Addr()
+	_, err := v.Store.Zscore(ctx, oldPool, addr)
+	if err != nil {
+		if err != store.ErrNil {
+			glog.Errorln("recheck proxy ", addr, " load score error: ", err)
+		}
+		return false
+	}
+	proxy, err := store.LoadProxy(ctx, v.Store, addr)
+	if err != nil {
+		proxy = snapshot
+	}
+	verdict, err := v.Worker.judge(&proxy)
+	if err == ErrNoJudge {
+		//判定服务不可用，本轮不复检
+		glog.Errorln("skip recheck proxy ", addr, ": ", err)
+		return false
+	}
+	if err != nil {
+		glog.Infoln("recheck proxy ", addr, " error: ", err)
+		return v.fail(ctx, proxy, oldPool)
+	}
+	recordTiming(&proxy, verdict.Timing)
+	v.Worker.inspect(&proxy, verdict)
+	v.Worker.checkTampering(ctx, &proxy)
+	v.Worker.locate(&proxy)
+	v.Worker.checkProfiles(&proxy)
+	proxy.UpdateScore()
+	//篡改内容的代理移出评分池
+	levelPool := proxy.Pool()
+	err = v.Store.Pipelined(ctx, func(pipe store.Pipeliner) {
+		pipe.Hmset(core.GetProxyDataKey(addr), pickFields(proxy.ToHash(), validCheckFields))
+		for _, pool := range core.ANONYMITY_POOLS {
+			if pool == levelPool {
+				pipe.Zadd(pool, proxy.Score, addr)
+			} else {
+				pipe.Zrem(pool, addr)
+			}
+		}
+		if oldPool == core.PROXY_POOL_VALID && levelPool != core.PROXY_POOL_VALID {
+			v.Stats.IncrPipelined(pipe, stats.METRIC_EVICTED, proxy.Source, 1)
+		}
+	})
+	if err != nil {
+		glog.Errorln("save rechecked proxy ", addr, " error: ", err)
+	}
+	return levelPool == ""
+}
+
+//记录一次复检失败，连续失败MaxFails次时移出评分池，否则只在代理仍在池中时更新评分
+func (v *ValidChecker) fail(ctx context.Context, proxy core.Proxy, oldPool string) bool {
+	addr := proxy.Addr()
+	proxy.RecordFail()
+	proxy.UpdateScore()
+	evict := proxy.ConsecutiveFails >= v.MaxFails
+	err := v.Store.Pipelined(ctx, func(pipe store.Pipeliner) {
+		pipe.Hmset(core.GetProxyDataKey(addr), pickFields(proxy.ToHash(), validFailFields))
+		if !evict {
+			return
+		}
+		for _, pool := range core.ANONYMITY_POOLS {
+			pipe.Zrem(pool, addr)
+		}
+		if oldPool == core.PROXY_POOL_VALID {
+			v.Stats.IncrPipelined(pipe, stats.METRIC_EVICTED, proxy.Source, 1)
+		}
+	})
+	if err == nil && !evict {
+		err = store.UpdatePoolScore(ctx, v.Store, proxy.Pool(), proxy)
+	}
+	if err != nil {
+		glog.Errorln("save rechecked proxy ", addr, " error: ", err)
+	}
+	return evict
+}
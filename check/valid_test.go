@@ -0,0 +1,91 @@
+package check
+
+import (
+	"context"
+	"fproxy/core"
+	"fproxy/server"
+	"fproxy/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestValidCheckEvictAndDemote(t *testing.T) {
+	judge := httptest.NewServer(&server.JudgeHandler{RealIpHeader: "X-Test-Egress"})
+	defer judge.Close()
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	alive := proxyFromServer(t, newForwardProxy(t, map[string]string{"X-Test-Egress": "10.0.0.2"}, false))
+	leaking := proxyFromServer(t, newForwardProxy(t, map[string]string{"X-Test-Egress": "10.0.0.3", "Via": "1.1 squid"}, false))
+	failing := core.NewProxy("127.0.0.1", 1, core.PROXY_SOURCE_SCAN, "")
+	dead := core.NewProxy("127.0.0.1", 2, core.PROXY_SOURCE_SCAN, "")
+	dead.ConsecutiveFails = 1
+	for _, proxy := range []core.Proxy{alive, leaking, failing, dead} {
+		proxy.Anonymity = core.HighAnonymous
+		store.SaveProxy(ctx, s, proxy)
+		s.Zadd(ctx, core.PROXY_POOL_VALID, 50, proxy.Addr())
+	}
+	checker := NewValidChecker(singleJudge(judge.URL), s, 2, 0, nil, "", nil, "", 2, time.Minute, nil, nil)
+	evicted, err := checker.CheckOnce(ctx)
+	if err != nil || evicted != 1 {
+		t.Fatalf("check once = %d, %v", evicted, err)
+	}
+	expected := map[string]string{alive.Addr(): core.PROXY_POOL_VALID, leaking.Addr(): core.PROXY_POOL_ANONYMOUS, failing.Addr(): core.PROXY_POOL_VALID, dead.Addr(): ""}
+	for addr, expectedPool := range expected {
+		for _, pool := range core.ANONYMITY_POOLS {
+			_, err := s.Zscore(ctx, pool, addr)
+			if (err == nil) != (pool == expectedPool) {
+				t.Errorf("%s in %s: %v, want pool %q", addr, pool, err == nil, expectedPool)
+			}
+		}
+	}
+	if record, _ := store.LoadProxy(ctx, s, failing.Addr()); record.ConsecutiveFails != 1 || record.FailCount != 1 {
+		t.Errorf("failing record = %+v", record)
+	}
+}
+
+//取快照后被其他检测移出评分池的代理不再放回，记录不被快照覆盖
+func TestValidCheckRemovedAfterSnapshot(t *testing.T) {
+	judge := httptest.NewServer(&server.JudgeHandler{})
+	defer judge.Close()
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	checker := NewValidChecker(singleJudge(judge.URL), s, 1, 0, nil, "", nil, "", 2, time.Minute, nil, nil)
+	//检测前已移出
+	demoted := core.NewProxy("127.0.0.1", 1, core.PROXY_SOURCE_SCAN, "")
+	demoted.Anonymity = core.HighAnonymous
+	snapshot := demoted
+	demoted.ConsecutiveFails, demoted.FailCount = 1, 1
+	store.SaveProxy(ctx, s, demoted)
+	if checker.check(ctx, snapshot, core.PROXY_POOL_VALID) {
+		t.Errorf("removed proxy evicted again")
+	}
+	//检测期间移出，代理请求失败
+	var dying core.Proxy
+	dyingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Zrem(ctx, core.PROXY_POOL_VALID, dying.Addr())
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer dyingServer.Close()
+	dying = proxyFromServer(t, dyingServer)
+	dying.Anonymity = core.HighAnonymous
+	store.SaveProxy(ctx, s, dying)
+	s.Zadd(ctx, core.PROXY_POOL_VALID, 50, dying.Addr())
+	if checker.check(ctx, dying, core.PROXY_POOL_VALID) {
+		t.Errorf("proxy with one failure evicted")
+	}
+	for _, proxy := range []core.Proxy{demoted, dying} {
+		for _, pool := range core.ANONYMITY_POOLS {
+			if _, err := s.Zscore(ctx, pool, proxy.Addr()); err != store.ErrNil {
+				t.Errorf("%s back in %s: %v", proxy.Addr(), pool, err)
+			}
+		}
+	}
+	if record, _ := store.LoadProxy(ctx, s, demoted.Addr()); record.ConsecutiveFails != 1 || record.FailCount != 1 {
+		t.Errorf("demoted record rolled back: %+v", record)
+	}
+	if record, _ := store.LoadProxy(ctx, s, dying.Addr()); record.ConsecutiveFails != 1 || record.Source != core.PROXY_SOURCE_SCAN {
+		t.Errorf("dying record = %+v", record)
+	}
+}
@@ -14,11 +14,27 @@ type Config struct {
 		MaxIdle   int
 		MaxActive int
 		Timeout   int
+		//standalone、sentinel或cluster，为空时使用host与port连接单机redis
+		Mode string `yaml:"mode"`
+		//哨兵地址或集群种子节点地址
+		Addrs            []string `yaml:"addrs"`
+		MasterName       string   `yaml:"masterName"`
+		SentinelPassword string   `yaml:"sentinelPassword"`
+		Tls              struct {
+			Enabled            bool   `yaml:"enabled"`
+			CertFile           string `yaml:"certFile"`
+			KeyFile            string `yaml:"keyFile"`
+			CaFile             string `yaml:"caFile"`
+			ServerName         string `yaml:"serverName"`
+			InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+		} `yaml:"tls"`
 	}
 	Scan struct {
 		NWorkers int
 		Ports    []int `yaml:",flow"`
 		Requests string
+		//扫描任务的可见超时，单位秒
+		Visibility int `yaml:"visibility"`
 	}
 	Craw struct {
 		Template  string
@@ -26,18 +42,88 @@ type Config struct {
 		UserAgent string
 		Distance  int
 	}
+	Store struct {
+		Type string `yaml:"type"`
+		Path string `yaml:"path"`
+		//key前缀，多套部署共用一个redis时区分
+		Namespace string `yaml:"namespace"`
+	}
+	Dedup struct {
+		//候选代理去重的时间窗口，单位秒
+		TTL int `yaml:"ttl"`
+	}
+	Stats struct {
+		//每小时统计的保留时长，单位小时
+		HourRetention int `yaml:"hourRetention"`
+		//每天统计的保留时长，单位天
+		DayRetention int `yaml:"dayRetention"`
+		//池大小的采样间隔，单位秒
+		SampleInterval int `yaml:"sampleInterval"`
+	}
+	Http struct {
+		Host string `yaml:"host"`
+		Port int    `yaml:"port"`
+		//判定服务部署在反向代理后时读取客户端地址的请求头，如X-Real-IP
+		JudgeRealIpHeader string `yaml:"judgeRealIpHeader"`
+		//https判定服务的端口及证书，端口为0时不开启
+		JudgeTlsPort     int    `yaml:"judgeTlsPort"`
+		JudgeTlsCertFile string `yaml:"judgeTlsCertFile"`
+		JudgeTlsKeyFile  string `yaml:"judgeTlsKeyFile"`
+	}
+	//GeoLite2数据库文件，检测通过的代理按地址查询国家、城市及自治系统，为空时不查询
+	Geo struct {
+		CityFile string `yaml:"cityFile"`
+		AsnFile  string `yaml:"asnFile"`
+	}
 	Checker struct {
-		Anony struct {
-			CheckUrl    string `yaml:"checkUrl"`
+		//目标站点验证配置文件，为空时不做验证
+		Profiles string `yaml:"profiles"`
+		Anony    struct {
+			CheckUrl string `yaml:"checkUrl"`
+			//多个判定服务，按weight加权轮转，配置后不再使用checkUrl
+			Judges []struct {
+				Url    string `yaml:"url"`
+				Weight int    `yaml:"weight"`
+			} `yaml:"judges"`
+			//至少quorum个判定服务划分的匿名级别一致才采用，默认为1
+			Quorum      int `yaml:"quorum"`
 			NWorkers    int
-			CheckSize   int
 			MaxBodySize int
+			//检测队列的可见超时，单位秒
+			Visibility int `yaml:"visibility"`
+			//https判定服务地址，为空时不检测https隧道
+			HttpsCheckUrl string `yaml:"httpsCheckUrl"`
+			//https判定服务使用自签名证书时的CA证书
+			HttpsCaFile string `yaml:"httpsCaFile"`
+			//https判定服务证书的sha256指纹，配置后只接受该证书，证书被替换的代理记为拦截TLS
+			HttpsPins []string `yaml:"httpsPins,flow"`
+			//测量带宽的定长数据地址，如判定服务的/judge/payload，为空时不测量
+			BandwidthCheckUrl string `yaml:"bandwidthCheckUrl"`
+			//检测内容篡改的固定页面地址，如判定服务的/judge/page，为空时不检测
+			TamperCheckUrl string `yaml:"tamperCheckUrl"`
+		}
+		//评分池复检，检测地址使用anony的配置
+		Valid struct {
+			NWorkers int `yaml:"nWorkers"`
+			//连续失败达到该次数时移出评分池
+			MaxFails int `yaml:"maxFails"`
+			//两轮复检的间隔，单位秒
+			Interval int `yaml:"interval"`
 		}
 		History struct {
-			NWorkers  int
-			CheckUrls []string
-			CheckSize int
-			UserAgent string
+			NWorkers int `yaml:"nWorkers"`
+			//检测地址，不能为空，否则全部代理都会被判为失败
+			CheckUrls []string `yaml:"checkUrls"`
+			CheckSize int      `yaml:"checkSize"`
+			UserAgent string   `yaml:"userAgent"`
+			//连续失败达到demoteFails次移出评分池，达到archiveFails次移入归档池
+			DemoteFails  int `yaml:"demoteFails"`
+			ArchiveFails int `yaml:"archiveFails"`
+			//每个代理两次检测的最短及最长间隔，单位秒，稳定的代理间隔更长，失败的代理指数退避
+			MinInterval int `yaml:"minInterval"`
+			MaxInterval int `yaml:"maxInterval"`
+			//每个进程每秒最多检测的代理数，0为不限制
+			MaxChecksPerSecond float64 `yaml:"maxChecksPerSecond"`
 		}
 	}
 }
@@ -1,36 +1,64 @@
 package core
 
-import (
-	"strings"
-	"time"
+//代理类型
+const (
+	Unknown       = iota - 1 //未检测
+	Transparent              //透明
+	Anonymous                //匿名
+	HighAnonymous            //高匿
 )
 
-//代理类型
+//代理协议
 const (
-	Transparent   = iota //透明
-	Anonymous            //匿名
-	HighAnonymous        //高匿
+	PROXY_PROTOCOL_HTTP    = "http"
+	PROXY_PROTOCOL_SOCKS4  = "socks4"
+	PROXY_PROTOCOL_SOCKS4A = "socks4a"
+	PROXY_PROTOCOL_SOCKS5  = "socks5"
+	//http代理的CONNECT隧道，只用于记录代理支持的协议
+	PROXY_PROTOCOL_CONNECT = "connect"
 )
 
 const (
-	PROXY_SOURCE_CRAW = "craw"
-	PROXY_SOURCE_SCAN = "scan"
+	PROXY_SOURCE_CRAW   = "craw"
+	PROXY_SOURCE_SCAN   = "scan"
+	PROXY_SOURCE_IMPORT = "import"
 )
 
 const (
-	PROXY_CHECK_QUEUE   = "proxy:q:check"
-	PROXY_POOL_VALID    = "proxy:pool:valid"
-	PROXY_POOL_HISTORY  = "proxy:pool:history"
-	PROXY_COUNT_SCAN    = "proxy:count:scan:"
-	PROXY_COUNT_CRAW    = "proxy:count:craw"
-	PROXY_COUNT_HISTORY = "proxy:count:history"
+	PROXY_CHECK_QUEUE      = "proxy:q:check"
+	PROXY_POOL_VALID       = "proxy:pool:valid" //高匿代理
+	PROXY_POOL_ANONYMOUS   = "proxy:pool:anonymous"
+	PROXY_POOL_TRANSPARENT = "proxy:pool:transparent"
+	PROXY_POOL_HISTORY     = "proxy:pool:history"
+	PROXY_POOL_ARCHIVE     = "proxy:pool:archive" //连续失败过多、不再检测的代理
+	PROXY_SCHEDULE         = "proxy:schedule"     //历史池代理的下次检测时间
+	PROXY_DATA             = "proxy:data:"
+	PROXY_SEEN             = "proxy:seen:"
 )
 
-func GetProxyTimeKey(src string) string {
-	now := time.Now()
-	timestr := now.Format("20060102")
-	if strings.HasSuffix(src, ":") {
-		return src + timestr
+//按匿名级别划分的评分池
+var ANONYMITY_POOLS = []string{PROXY_POOL_VALID, PROXY_POOL_ANONYMOUS, PROXY_POOL_TRANSPARENT}
+
+//匿名级别对应的评分池，未检测时返回空
+func GetAnonymityPool(anonymity int) string {
+	switch anonymity {
+	case HighAnonymous:
+		return PROXY_POOL_VALID
+	case Anonymous:
+		return PROXY_POOL_ANONYMOUS
+	case Transparent:
+		return PROXY_POOL_TRANSPARENT
+	default:
+		return ""
 	}
-	return src + ":" + timestr
+}
+
+//代理记录的哈希key，addr为ip:port
+func GetProxyDataKey(addr string) string {
+	return PROXY_DATA + addr
+}
+
+//候选代理最近入队的标记key，带过期时间
+func GetProxySeenKey(addr string) string {
+	return PROXY_SEEN + addr
 }
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProxyHashRoundTrip(t *testing.T) {
+	proxy := NewProxy("1.2.3.4", 8080, PROXY_SOURCE_CRAW, "http://example.com/list")
+	proxy.RecordSuccess(120 * time.Millisecond)
+	proxy.RecordFail()
+	if proxy.ConsecutiveFails != 1 {
+		t.Errorf("consecutive fails %d", proxy.ConsecutiveFails)
+	}
+	proxy.LeakedHeaders = []string{"Via", "X-Forwarded-For"}
+	proxy.IpLeaked = true
+	proxy.Https = true
+	proxy.Tampered = true
+	proxy.TlsIntercepted = true
+	proxy.Profiles = []string{"baidu", "sina"}
+	proxy.Country, proxy.City, proxy.Asn, proxy.AsnOrg = "US", "San Francisco", 13335, "CLOUDFLARENET"
+	proxy.Protocols = []string{PROXY_PROTOCOL_HTTP, PROXY_PROTOCOL_CONNECT}
+	proxy.DnsTime, proxy.ConnectTime, proxy.TlsTime, proxy.FirstByteTime, proxy.Bandwidth = 1, 30, 40, 80, 204800
+	restored, err := NewProxyFromHash(proxy.ToHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored, proxy) {
+		t.Errorf("restored proxy %+v, want %+v", restored, proxy)
+	}
+	if restored.Addr() != "1.2.3.4:8080" {
+		t.Errorf("addr %s", restored.Addr())
+	}
+	if !restored.PassesProfile("sina") || restored.PassesProfile("qq") {
+		t.Errorf("profiles %v", restored.Profiles)
+	}
+	if restored.ServesHttps() {
+		t.Errorf("tls intercepting proxy serves https")
+	}
+	if restored.Pool() != "" {
+		t.Errorf("tampering proxy pool %q", restored.Pool())
+	}
+	restored.Tampered, restored.Anonymity = false, HighAnonymous
+	if restored.Pool() != PROXY_POOL_VALID {
+		t.Errorf("high anonymous proxy pool %q", restored.Pool())
+	}
+}
+
+func TestProxyFromEmptyHash(t *testing.T) {
+	_, err := NewProxyFromHash(map[string]string{})
+	if err == nil {
+		t.Error("empty hash should be an error")
+	}
+}
+
+func TestComputeScore(t *testing.T) {
+	now := time.Now()
+	fast := Proxy{SuccessCount: 9, FailCount: 1, Latency: 200, LastChecked: now.Unix()}
+	slow := fast
+	slow.Latency = 3000
+	stale := fast
+	stale.LastChecked = now.Add(-24 * time.Hour).Unix()
+	failing := fast
+	failing.SuccessCount, failing.FailCount = 1, 9
+	fastScore := ComputeScore(fast, now)
+	if fastScore <= ComputeScore(slow, now) || fastScore <= ComputeScore(stale, now) || fastScore <= ComputeScore(failing, now) {
+		t.Errorf("fast, fresh and reliable proxy should score highest: %v", fastScore)
+	}
+	narrow := fast
+	narrow.Bandwidth = 10 * 1024
+	wide := fast
+	wide.Bandwidth = 1024 * 1024
+	if ComputeScore(wide, now) <= ComputeScore(narrow, now) {
+		t.Errorf("higher bandwidth should score higher")
+	}
+	if fastScore > 100 || ComputeScore(Proxy{}, now) < 0 {
+		t.Errorf("score out of range")
+	}
+}
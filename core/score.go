@@ -0,0 +1,55 @@
+package core
+
+import (
+	"math"
+	"time"
+)
+
+//评分权重，成功率、延迟、带宽、最近检测时间
+const (
+	SCORE_WEIGHT_SUCCESS   = 0.45
+	SCORE_WEIGHT_LATENCY   = 0.25
+	SCORE_WEIGHT_BANDWIDTH = 0.1
+	SCORE_WEIGHT_RECENCY   = 0.2
+)
+
+//延迟为该值(毫秒)时延迟得分减半
+const SCORE_LATENCY_HALF = 1000
+
+//带宽为该值(字节/秒)时带宽得分为一半
+const SCORE_BANDWIDTH_HALF = 100 * 1024
+
+//距上次检测超过该时长(秒)时新鲜度得分减半
+const SCORE_RECENCY_HALF = 3600
+
+/*
+*计算代理评分，取值0~100
+ */
+func ComputeScore(proxy Proxy, now time.Time) float64 {
+	total := float64(proxy.SuccessCount + proxy.FailCount)
+	successRate := (float64(proxy.SuccessCount) + 1) / (total + 2)
+	latencyScore := 0.0
+	if proxy.SuccessCount > 0 {
+		latencyScore = SCORE_LATENCY_HALF / (SCORE_LATENCY_HALF + float64(proxy.Latency))
+	}
+	bandwidthScore := 0.0
+	if proxy.Bandwidth > 0 {
+		bandwidthScore = float64(proxy.Bandwidth) / (SCORE_BANDWIDTH_HALF + float64(proxy.Bandwidth))
+	}
+	recencyScore := 0.0
+	if proxy.LastChecked > 0 {
+		age := now.Unix() - proxy.LastChecked
+		if age < 0 {
+			age = 0
+		}
+		recencyScore = math.Pow(0.5, float64(age)/SCORE_RECENCY_HALF)
+	}
+	score := SCORE_WEIGHT_SUCCESS*successRate + SCORE_WEIGHT_LATENCY*latencyScore + SCORE_WEIGHT_BANDWIDTH*bandwidthScore + SCORE_WEIGHT_RECENCY*recencyScore
+	return math.Round(score*10000) / 100
+}
+
+//重新计算并记录评分
+func (p *Proxy) UpdateScore() float64 {
+	p.Score = ComputeScore(*p, time.Now())
+	return p.Score
+}
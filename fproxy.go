@@ -1,25 +1,55 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	builder "fproxy/builder"
 	"fproxy/builder/processor"
 	"fproxy/check"
 	"fproxy/config"
+	"fproxy/core"
+	"fproxy/geo"
+	"fproxy/httputil"
 	server "fproxy/server"
+	"fproxy/stats"
 	store "fproxy/store"
+	"fproxy/transfer"
 	"github.com/golang/glog"
 	"github.com/robfig/cron"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
+const (
+	STORE_TYPE_REDIS  = "redis"
+	STORE_TYPE_MEMORY = "memory"
+	STORE_TYPE_BOLT   = "bolt"
+)
+
 type CmdArgs struct {
-	Conf         string
-	Craw         bool
-	Scan         bool
-	HistoryCheck bool
-	AnonyCheck   bool
-	Http         bool
+	Conf          string
+	Craw          bool
+	Scan          bool
+	HistoryCheck  bool
+	AnonyCheck    bool
+	ValidCheck    bool
+	Http          bool
+	Namespace     string
+	ListNamespace bool
+	DropNamespace bool
+	Export        string
+	Import        string
+	Format        string
+	Pools         string
+	Into          string
+	Pool          string
 }
 
 func main() {
@@ -31,47 +61,106 @@ func main() {
 		return
 	}
 	glog.Infoln("read config complete")
-	redis, err := NewRedisManager(config)
+	if cmdArgs.Namespace != "" {
+		config.Store.Namespace = cmdArgs.Namespace
+	}
+	baseStore, err := NewProxyStore(config)
+	if err != nil {
+		glog.Errorln("create proxy store error: ", err)
+		return
+	}
+	if cmdArgs.ListNamespace || cmdArgs.DropNamespace {
+		manageNamespace(cmdArgs, baseStore, config.Store.Namespace)
+		return
+	}
+	proxyStore, err := store.WithNamespace(baseStore, config.Store.Namespace)
 	if err != nil {
-		glog.Errorln("create redis client error: ", err)
+		glog.Errorln("create proxy store error: ", err)
+		return
+	}
+	if cmdArgs.Export != "" || cmdArgs.Import != "" {
+		transferPools(cmdArgs, config, proxyStore)
 		return
 	}
-	glog.Infoln("connect redis complete")
+	glog.Infoln("create proxy store complete: ", config.Store.Type, ", namespace: ", config.Store.Namespace)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recorder := NewStatsRecorder(config, proxyStore)
+	var locator *geo.Locator
+	var profiles *check.ProfileChecker
+	if cmdArgs.AnonyCheck || cmdArgs.ValidCheck {
+		profiles, err = loadProfiles(config)
+		if err != nil {
+			glog.Errorln("load validation profiles error: ", err)
+			return
+		}
+		locator, err = geo.NewLocator(config.Geo.CityFile, config.Geo.AsnFile)
+		if err != nil {
+			glog.Errorln("open geoip database error: ", err)
+			return
+		}
+		if locator != nil {
+			defer locator.Close()
+		}
+	}
 	if cmdArgs.Scan {
-		scanner, err := NewScanner(config, redis)
+		scanner, err := NewScanner(config, proxyStore, recorder)
 		if err != nil {
 			glog.Errorln("new scanner error: ", err)
 			return
 		}
 		glog.Infoln("scanner: ", scanner)
-		go scanner.Start()
+		go scanner.Start(ctx)
 	}
 	if cmdArgs.HistoryCheck {
-		historyChecker := NewHistoryChecker(config, redis)
-		go historyChecker.CheckAll()
+		historyChecker, err := NewHistoryChecker(config, proxyStore, recorder)
+		if err != nil {
+			glog.Errorln("create history checker error: ", err)
+			return
+		}
+		go historyChecker.CheckAll(ctx)
 	}
 	if cmdArgs.AnonyCheck {
-		anonyChecker := NewAnonyChecker(config, redis)
-		go anonyChecker.CheckAll()
+		anonyChecker, err := NewAnonyChecker(config, proxyStore, recorder, locator, profiles)
+		if err != nil {
+			glog.Errorln("create anony checker error: ", err)
+			return
+		}
+		go anonyChecker.CheckAll(ctx)
+	}
+	if cmdArgs.ValidCheck {
+		validChecker, err := NewValidChecker(config, proxyStore, recorder, locator, profiles)
+		if err != nil {
+			glog.Errorln("create valid checker error: ", err)
+			return
+		}
+		go validChecker.CheckAll(ctx)
 	}
 	if cmdArgs.Craw {
 		glog.Infoln("create crawler...")
-		simpleCrawler, err := NewSimpleCrawler(config, redis)
+		simpleCrawler, err := NewSimpleCrawler(config, proxyStore, recorder)
 		if err != nil {
 			glog.Errorln("create simple crawler error: ", err)
 			return
 		}
 		croner := cron.New()
-		setCrawTask(croner, simpleCrawler)
+		setCrawTask(ctx, croner, simpleCrawler)
 		croner.Start()
 	}
 	if cmdArgs.Http {
 		server := server.NewFProxyServer()
 		server.Init()
+		setHttpHandlers(server, config, proxyStore, recorder)
+		go server.Run(config.Http.Host, config.Http.Port)
 	}
-	for {
-		time.Sleep(10 * time.Second)
+	if cmdArgs.Scan || cmdArgs.Craw || cmdArgs.AnonyCheck || cmdArgs.HistoryCheck || cmdArgs.ValidCheck {
+		sampler := NewStatsSampler(config, proxyStore, recorder)
+		go sampler.Run(ctx)
 	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	glog.Infoln("shutting down...")
 }
 
 func readCmd() CmdArgs {
@@ -80,34 +169,156 @@ func readCmd() CmdArgs {
 	scan := flag.Bool("scan", false, "开启扫描")
 	historyCheck := flag.Bool("check-history", false, "开启历史池轮询")
 	anonyCheck := flag.Bool("check-anony", false, "开启高匿检测")
+	validCheck := flag.Bool("check-valid", false, "开启评分池复检")
 	http := flag.Bool("http", false, "开启http服务")
+	namespace := flag.String("namespace", "", "key前缀，覆盖配置文件中的store.namespace")
+	listNamespace := flag.Bool("list-namespace", false, "列出命名空间下的全部key后退出")
+	dropNamespace := flag.Bool("drop-namespace", false, "删除命名空间下的全部key后退出")
+	export := flag.String("export", "", "导出代理池到文件后退出，-表示标准输出")
+	imports := flag.String("import", "", "从文件导入代理后退出，-表示标准输入")
+	format := flag.String("format", "", "导出导入格式：jsonl、csv或text，为空时按文件扩展名判断")
+	pools := flag.String("pools", "valid,anonymous,transparent,history,vps", "导出的代理池，逗号分隔")
+	into := flag.String("into", transfer.IMPORT_POOL, "导入目标：pool写回代理池，queue放入检测队列")
+	pool := flag.String("pool", transfer.POOL_HISTORY, "导入记录未指定代理池时使用的池")
 	flag.Parse()
-	cmdArgs := CmdArgs{Conf: *conf, Craw: *craw, Scan: *scan, HistoryCheck: *historyCheck, AnonyCheck: *anonyCheck, Http: *http}
+	cmdArgs := CmdArgs{Conf: *conf, Craw: *craw, Scan: *scan, HistoryCheck: *historyCheck, AnonyCheck: *anonyCheck, ValidCheck: *validCheck, Http: *http,
+		Namespace: *namespace, ListNamespace: *listNamespace, DropNamespace: *dropNamespace,
+		Export: *export, Import: *imports, Format: *format, Pools: *pools, Into: *into, Pool: *pool}
 	return cmdArgs
 }
 
+func transferPools(cmdArgs CmdArgs, config config.Config, proxyStore store.ProxyStore) {
+	ctx := context.Background()
+	if cmdArgs.Export != "" {
+		format := cmdArgs.Format
+		if format == "" {
+			format = transfer.FormatFromPath(cmdArgs.Export)
+		}
+		out := os.Stdout
+		if cmdArgs.Export != "-" {
+			file, err := os.Create(cmdArgs.Export)
+			if err != nil {
+				glog.Errorln("create export file error: ", err)
+				return
+			}
+			defer file.Close()
+			out = file
+		}
+		n, err := transfer.Export(ctx, proxyStore, out, format, strings.Split(cmdArgs.Pools, ","))
+		if err != nil {
+			glog.Errorln("export proxy pools error: ", err)
+			return
+		}
+		fmt.Fprintln(os.Stderr, "exported", n, "proxies to", cmdArgs.Export)
+		return
+	}
+	format := cmdArgs.Format
+	if format == "" {
+		format = transfer.FormatFromPath(cmdArgs.Import)
+	}
+	in := os.Stdin
+	if cmdArgs.Import != "-" {
+		file, err := os.Open(cmdArgs.Import)
+		if err != nil {
+			glog.Errorln("open import file error: ", err)
+			return
+		}
+		defer file.Close()
+		in = file
+	}
+	dedup := store.NewDeduper(proxyStore, time.Duration(config.Dedup.TTL)*time.Second)
+	n, err := transfer.Import(ctx, proxyStore, in, format, cmdArgs.Into, cmdArgs.Pool, dedup, NewStatsRecorder(config, proxyStore))
+	if err != nil {
+		glog.Errorln("import proxies error after ", n, " records: ", err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, "imported", n, "proxies into", cmdArgs.Into)
+}
+
+func manageNamespace(cmdArgs CmdArgs, proxyStore store.ProxyStore, namespace string) {
+	ctx := context.Background()
+	if cmdArgs.DropNamespace {
+		n, err := store.DropNamespace(ctx, proxyStore, namespace)
+		if err != nil {
+			glog.Errorln("drop namespace ", namespace, " error: ", err)
+			return
+		}
+		fmt.Println("dropped", n, "keys in namespace", namespace)
+		return
+	}
+	keys, err := store.ListNamespace(ctx, proxyStore, namespace)
+	if err != nil {
+		glog.Errorln("list namespace ", namespace, " error: ", err)
+		return
+	}
+	for _, key := range keys {
+		fmt.Println(key)
+	}
+}
+
+func NewProxyStore(config config.Config) (store.ProxyStore, error) {
+	storeConfig := config.Store
+	switch storeConfig.Type {
+	case "", STORE_TYPE_REDIS:
+		return NewRedisManager(config)
+	case STORE_TYPE_MEMORY:
+		return store.NewMemoryStore(), nil
+	case STORE_TYPE_BOLT:
+		return store.NewBoltStore(storeConfig.Path)
+	default:
+		return nil, errors.New("unknown store type: " + storeConfig.Type)
+	}
+}
+
 func NewRedisManager(config config.Config) (*store.RedisManager, error) {
 	redisConfig := config.Redis
 	timeout := time.Duration(redisConfig.Timeout) * time.Second
-	return store.NewRedisManager(redisConfig.Host, redisConfig.Port, redisConfig.Password, redisConfig.Db, redisConfig.MaxIdle, redisConfig.MaxActive, timeout)
+	addrs := redisConfig.Addrs
+	if len(addrs) == 0 {
+		addrs = []string{redisConfig.Host + ":" + strconv.Itoa(redisConfig.Port)}
+	}
+	options := store.RedisOptions{
+		Mode:             redisConfig.Mode,
+		Addrs:            addrs,
+		MasterName:       redisConfig.MasterName,
+		Password:         redisConfig.Password,
+		SentinelPassword: redisConfig.SentinelPassword,
+		Db:               redisConfig.Db,
+		MaxIdle:          redisConfig.MaxIdle,
+		MaxActive:        redisConfig.MaxActive,
+		IdleTimeout:      timeout,
+		DialTimeout:      timeout,
+	}
+	tlsConfig := redisConfig.Tls
+	if tlsConfig.Enabled {
+		var err error
+		options.TLSConfig, err = store.LoadTLSConfig(tlsConfig.CertFile, tlsConfig.KeyFile, tlsConfig.CaFile, tlsConfig.ServerName, tlsConfig.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store.NewRedisStore(options)
 }
 
-func NewScanner(config config.Config, redisManager *store.RedisManager) (*builder.Scanner, error) {
+func NewScanner(config config.Config, proxyStore store.ProxyStore, recorder *stats.Recorder) (*builder.Scanner, error) {
 	scanConfig := config.Scan
 	requests, err := processor.ParseRequestXml(scanConfig.Requests)
 	if err != nil {
 		return nil, err
 	}
-	return builder.NewScanner(scanConfig.NWorkers, scanConfig.Ports, redisManager, requests), nil
+	visibility := time.Duration(scanConfig.Visibility) * time.Second
+	dedupTTL := time.Duration(config.Dedup.TTL) * time.Second
+	return builder.NewScanner(scanConfig.NWorkers, scanConfig.Ports, proxyStore, requests, visibility, dedupTTL, recorder), nil
 }
 
-func NewSimpleCrawler(config config.Config, redis *store.RedisManager) (*builder.SimpleCrawler, error) {
+func NewSimpleCrawler(config config.Config, proxyStore store.ProxyStore, recorder *stats.Recorder) (*builder.SimpleCrawler, error) {
 	crawConfig := config.Craw
 	crawTasks, err := loadCrawTasks(config)
 	if err != nil {
 		return nil, err
 	}
-	return builder.NewSimpleCrawler(crawConfig.UserAgent, crawTasks, redis, crawConfig.Distance), nil
+	dedupTTL := time.Duration(config.Dedup.TTL) * time.Second
+	return builder.NewSimpleCrawler(crawConfig.UserAgent, crawTasks, proxyStore, crawConfig.Distance, dedupTTL, recorder), nil
 }
 
 func loadCrawTasks(config config.Config) ([]builder.CrawTask, error) {
@@ -121,20 +332,115 @@ func loadCrawTasks(config config.Config) ([]builder.CrawTask, error) {
 	return tasks, nil
 }
 
-func setCrawTask(croner *cron.Cron, simpleCrawler *builder.SimpleCrawler) {
+func setCrawTask(ctx context.Context, croner *cron.Cron, simpleCrawler *builder.SimpleCrawler) {
 	croner.AddFunc("0 0/30 * * * *", func() {
 		glog.Infoln("start craw...")
-		simpleCrawler.Craw()
+		simpleCrawler.Craw(ctx)
 	})
 }
 
-func NewHistoryChecker(config config.Config, redis *store.RedisManager) *check.HistoryChecker {
+func NewHistoryChecker(config config.Config, proxyStore store.ProxyStore, recorder *stats.Recorder) (*check.HistoryChecker, error) {
 	historyConfig := config.Checker.History
-	return check.NewHistoryChecker(redis, historyConfig.NWorkers, historyConfig.CheckSize, historyConfig.UserAgent, historyConfig.CheckUrls)
+	schedule := check.NewSchedule(time.Duration(historyConfig.MinInterval)*time.Second, time.Duration(historyConfig.MaxInterval)*time.Second)
+	return check.NewHistoryChecker(proxyStore, historyConfig.NWorkers, historyConfig.CheckSize, historyConfig.UserAgent, historyConfig.CheckUrls, recorder,
+		historyConfig.DemoteFails, historyConfig.ArchiveFails, schedule, historyConfig.MaxChecksPerSecond)
 }
 
-func NewAnonyChecker(config config.Config, redis *store.RedisManager) check.AnonyChecker {
+func NewAnonyChecker(config config.Config, proxyStore store.ProxyStore, recorder *stats.Recorder, locator *geo.Locator, profiles *check.ProfileChecker) (check.AnonyChecker, error) {
 	anonyConfig := config.Checker.Anony
 	glog.Infoln("anony check config: ", anonyConfig)
-	return check.NewAnonyChecker(anonyConfig.CheckUrl, redis, anonyConfig.NWorkers, anonyConfig.CheckSize, anonyConfig.MaxBodySize)
+	visibility := time.Duration(anonyConfig.Visibility) * time.Second
+	tlsConfig, err := loadHttpsCheckTLSConfig(config)
+	if err != nil {
+		return check.AnonyChecker{}, err
+	}
+	return check.NewAnonyChecker(newJudgePool(config), proxyStore, anonyConfig.NWorkers, anonyConfig.MaxBodySize, visibility, recorder, anonyConfig.HttpsCheckUrl, tlsConfig, anonyConfig.BandwidthCheckUrl, anonyConfig.TamperCheckUrl, locator, profiles), nil
+}
+
+func NewValidChecker(config config.Config, proxyStore store.ProxyStore, recorder *stats.Recorder, locator *geo.Locator, profiles *check.ProfileChecker) (*check.ValidChecker, error) {
+	anonyConfig := config.Checker.Anony
+	validConfig := config.Checker.Valid
+	glog.Infoln("valid check config: ", validConfig)
+	tlsConfig, err := loadHttpsCheckTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(validConfig.Interval) * time.Second
+	return check.NewValidChecker(newJudgePool(config), proxyStore, validConfig.NWorkers, anonyConfig.MaxBodySize, recorder, anonyConfig.HttpsCheckUrl, tlsConfig, anonyConfig.TamperCheckUrl, validConfig.MaxFails, interval, locator, profiles), nil
+}
+
+//未配置judges时只使用checkUrl
+func newJudgePool(config config.Config) *check.JudgePool {
+	anonyConfig := config.Checker.Anony
+	judges := make([]check.Judge, 0, len(anonyConfig.Judges))
+	for _, judge := range anonyConfig.Judges {
+		judges = append(judges, check.Judge{Url: judge.Url, Weight: judge.Weight})
+	}
+	if len(judges) == 0 {
+		judges = append(judges, check.Judge{Url: anonyConfig.CheckUrl})
+	}
+	return check.NewJudgePool(judges, anonyConfig.Quorum)
+}
+
+//未配置验证文件时返回nil
+func loadProfiles(config config.Config) (*check.ProfileChecker, error) {
+	if config.Checker.Profiles == "" {
+		return nil, nil
+	}
+	profiles, err := check.ParseProfilesXml(config.Checker.Profiles)
+	if err != nil {
+		return nil, err
+	}
+	return check.NewProfileChecker(profiles), nil
+}
+
+//https判定服务使用自签名证书时加载CA证书，配置了证书指纹时固定证书，均未配置时返回nil使用系统证书
+func loadHttpsCheckTLSConfig(config config.Config) (*tls.Config, error) {
+	anonyConfig := config.Checker.Anony
+	var tlsConfig *tls.Config
+	if anonyConfig.HttpsCaFile != "" {
+		var err error
+		tlsConfig, err = store.LoadTLSConfig("", "", anonyConfig.HttpsCaFile, "", false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return httputil.PinTLSConfig(tlsConfig, anonyConfig.HttpsPins), nil
+}
+
+func NewStatsRecorder(config config.Config, proxyStore store.ProxyStore) *stats.Recorder {
+	statsConfig := config.Stats
+	hourRetention := time.Duration(statsConfig.HourRetention) * time.Hour
+	dayRetention := time.Duration(statsConfig.DayRetention) * 24 * time.Hour
+	return stats.NewRecorder(proxyStore, hourRetention, dayRetention)
+}
+
+func NewStatsSampler(config config.Config, proxyStore store.ProxyStore, recorder *stats.Recorder) *stats.Sampler {
+	queues := map[string]string{"check": core.PROXY_CHECK_QUEUE, "scan": builder.KEY_SCAN_TASK}
+	interval := time.Duration(config.Stats.SampleInterval) * time.Second
+	return stats.NewSampler(recorder, proxyStore, queues, interval)
+}
+
+func setHttpHandlers(fserver *server.FProxyServer, config config.Config, proxyStore store.ProxyStore, recorder *stats.Recorder) {
+	vpsHandler := &server.VPSHandler{VPS: &builder.VPS{Store: proxyStore}}
+	fserver.DoGet("/vps/add/{vps}/{ip}/{port:int}", vpsHandler.HandleAaddVPS)
+	poolHandler := &server.PoolHandler{Store: proxyStore}
+	fserver.DoGet("/proxy/valid", poolHandler.HandleValidProxies)
+	fserver.DoGet("/proxy/anonymous", poolHandler.HandleAnonymousProxies)
+	fserver.DoGet("/proxy/transparent", poolHandler.HandleTransparentProxies)
+	fserver.DoGet("/proxy/history", poolHandler.HandleHistoryProxies)
+	fserver.DoGet("/proxy/archive", poolHandler.HandleArchivedProxies)
+	fserver.DoGet("/proxy/{addr}", poolHandler.HandleProxy)
+	judgeHandler := &server.JudgeHandler{RealIpHeader: config.Http.JudgeRealIpHeader}
+	fserver.DoGet("/judge", judgeHandler.HandleJudge)
+	fserver.DoGet("/judge/payload", server.HandlePayload)
+	fserver.DoGet("/judge/page", server.HandleTamperPage)
+	if config.Http.JudgeTlsPort > 0 {
+		go func() {
+			err := server.ServeJudgeTLS(config.Http.Host, config.Http.JudgeTlsPort, config.Http.JudgeTlsCertFile, config.Http.JudgeTlsKeyFile, judgeHandler)
+			glog.Errorln("https judge server stopped: ", err)
+		}()
+	}
+	statsHandler := &server.StatsHandler{Recorder: recorder}
+	fserver.DoGet("/stats", statsHandler.HandleStats)
 }
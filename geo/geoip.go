@@ -0,0 +1,91 @@
+package geo
+
+import (
+	"errors"
+	"github.com/oschwald/geoip2-golang"
+	"net"
+)
+
+//城市名使用的语言
+const CITY_NAME_LANGUAGE = "en"
+
+/*
+*一个地址所在的国家、城市及自治系统，查不到的字段为空
+ */
+type Location struct {
+	//国家ISO代码，如US
+	Country string
+	City    string
+	Asn     int
+	AsnOrg  string
+}
+
+/*
+*离线地理位置查询，读取本地的GeoLite2 City及ASN数据库(.mmdb)
+*两个数据库均可不配置，未配置的数据库不查询
+ */
+type Locator struct {
+	city *geoip2.Reader
+	asn  *geoip2.Reader
+}
+
+//两个数据库均未配置时返回nil，不做查询
+func NewLocator(cityFile, asnFile string) (*Locator, error) {
+	if cityFile == "" && asnFile == "" {
+		return nil, nil
+	}
+	locator := &Locator{}
+	var err error
+	if cityFile != "" {
+		locator.city, err = geoip2.Open(cityFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if asnFile != "" {
+		locator.asn, err = geoip2.Open(asnFile)
+		if err != nil {
+			locator.Close()
+			return nil, err
+		}
+	}
+	return locator, nil
+}
+
+func (l *Locator) Lookup(ip string) (Location, error) {
+	location := Location{}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return location, errors.New("invalid ip: " + ip)
+	}
+	if l.city != nil {
+		city, err := l.city.City(addr)
+		if err != nil {
+			return location, err
+		}
+		location.Country = city.Country.IsoCode
+		location.City = city.City.Names[CITY_NAME_LANGUAGE]
+	}
+	if l.asn != nil {
+		asn, err := l.asn.ASN(addr)
+		if err != nil {
+			return location, err
+		}
+		location.Asn = int(asn.AutonomousSystemNumber)
+		location.AsnOrg = asn.AutonomousSystemOrganization
+	}
+	return location, nil
+}
+
+func (l *Locator) Close() error {
+	var err error
+	if l.city != nil {
+		err = l.city.Close()
+	}
+	if l.asn != nil {
+		if asnErr := l.asn.Close(); asnErr != nil {
+			err = asnErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package geo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+//按MaxMind DB格式编码数据，只支持测试用到的map、string、uint32及array
+func encodeMmdb(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		//长度29至284时控制字节的长度为29，后跟一字节的长度-29
+		if len(v) < 29 {
+			buf.WriteByte(2<<5 | byte(len(v)))
+		} else {
+			buf.WriteByte(2<<5 | 29)
+			buf.WriteByte(byte(len(v) - 29))
+		}
+		buf.WriteString(v)
+	case uint32:
+		bs := []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+		for len(bs) > 0 && bs[0] == 0 {
+			bs = bs[1:]
+		}
+		buf.WriteByte(6<<5 | byte(len(bs)))
+		buf.Write(bs)
+	case []string:
+		//array为扩展类型11
+		buf.WriteByte(byte(len(v)))
+		buf.WriteByte(11 - 7)
+		for _, item := range v {
+			encodeMmdb(buf, item)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf.WriteByte(7<<5 | byte(len(v)))
+		for _, key := range keys {
+			encodeMmdb(buf, key)
+			encodeMmdb(buf, v[key])
+		}
+	}
+}
+
+//只有一个节点的ipv4数据库，首位为0的地址查到low，首位为1的地址查到high
+func writeMmdb(t *testing.T, dbType string, low, high map[string]interface{}) string {
+	var data bytes.Buffer
+	encodeMmdb(&data, low)
+	highOffset := data.Len()
+	encodeMmdb(&data, high)
+	//节点数为1，数据指针为节点数+16+数据偏移，记录长度24位
+	var db bytes.Buffer
+	for _, record := range []int{1 + 16, 1 + 16 + highOffset} {
+		db.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+	db.WriteString("\xab\xcd\xefMaxMind.com")
+	encodeMmdb(&db, map[string]interface{}{
+		"binary_format_major_version": uint32(2),
+		"binary_format_minor_version": uint32(0),
+		"build_epoch":                 uint32(1700000000),
+		"database_type":               dbType,
+		"description":                 map[string]interface{}{"en": "fproxy test"},
+		"ip_version":                  uint32(4),
+		"languages":                   []string{"en"},
+		"node_count":                  uint32(1),
+		"record_size":                 uint32(24),
+	})
+	path := filepath.Join(t.TempDir(), dbType+".mmdb")
+	if err := os.WriteFile(path, db.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func cityRecord(country, city string) map[string]interface{} {
+	return map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": country},
+		"city":    map[string]interface{}{"names": map[string]interface{}{"en": city}},
+	}
+}
+
+func asnRecord(asn uint32, org string) map[string]interface{} {
+	return map[string]interface{}{"autonomous_system_number": asn, "autonomous_system_organization": org}
+}
+
+func TestLocator(t *testing.T) {
+	cityFile := writeMmdb(t, "GeoLite2-City", cityRecord("US", "San Francisco"), cityRecord("DE", "Berlin"))
+	asnFile := writeMmdb(t, "GeoLite2-ASN", asnRecord(13335, "CLOUDFLARENET"), asnRecord(3320, "Deutsche Telekom AG"))
+	locator, err := NewLocator(cityFile, asnFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locator.Close()
+	cases := map[string]Location{
+		"1.1.1.1":   {Country: "US", City: "San Francisco", Asn: 13335, AsnOrg: "CLOUDFLARENET"},
+		"200.1.2.3": {Country: "DE", City: "Berlin", Asn: 3320, AsnOrg: "Deutsche Telekom AG"},
+	}
+	for ip, want := range cases {
+		location, err := locator.Lookup(ip)
+		if err != nil || location != want {
+			t.Errorf("lookup %s = %+v, %v", ip, location, err)
+		}
+	}
+	if _, err := locator.Lookup("not an ip"); err == nil {
+		t.Errorf("invalid ip looked up")
+	}
+	asnOnly, err := NewLocator("", asnFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer asnOnly.Close()
+	if location, err := asnOnly.Lookup("1.1.1.1"); err != nil || location != (Location{Asn: 13335, AsnOrg: "CLOUDFLARENET"}) {
+		t.Errorf("asn only lookup = %+v, %v", location, err)
+	}
+	//ASN数据库不能当作City数据库使用
+	wrong, err := NewLocator(asnFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wrong.Close()
+	if _, err := wrong.Lookup("1.1.1.1"); err == nil {
+		t.Errorf("asn database used as city database")
+	}
+	if locator, err := NewLocator("", ""); locator != nil || err != nil {
+		t.Errorf("locator without database = %v, %v", locator, err)
+	}
+	if _, err := NewLocator(filepath.Join(t.TempDir(), "missing.mmdb"), ""); err == nil {
+		t.Errorf("missing database opened")
+	}
+}
@@ -2,7 +2,11 @@ package httputil
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHttpProxy(t *testing.T) {
@@ -13,3 +17,26 @@ func TestHttpProxy(t *testing.T) {
 	}
 	fmt.Println(string(bs))
 }
+
+func TestDoHttpGetTimed(t *testing.T) {
+	body := strings.Repeat("x", 64*1024)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(body))
+	}))
+	defer target.Close()
+	bs, timing, err := DoHttpGetTimed(target.URL, "", nil, nil, 0)
+	if err != nil || string(bs) != body {
+		t.Fatalf("timed get = %d bytes, %v", len(bs), err)
+	}
+	if timing.Bytes != int64(len(body)) || timing.FirstByte < 20*time.Millisecond || timing.Total < timing.FirstByte || timing.Throughput() <= 0 {
+		t.Errorf("timing = %+v", timing)
+	}
+	//https目标站点记录TLS握手耗时
+	tlsTarget := httptest.NewTLSServer(target.Config.Handler)
+	defer tlsTarget.Close()
+	_, timing, err = DoHttpGetTimed(tlsTarget.URL, "", tlsTarget.Client().Transport.(*http.Transport).TLSClientConfig, nil, 0)
+	if err != nil || timing.TLSHandshake <= 0 || timing.Connect <= 0 {
+		t.Errorf("tls timing = %+v, %v", timing, err)
+	}
+}
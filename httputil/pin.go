@@ -0,0 +1,69 @@
+package httputil
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+/*
+*对端证书与固定的指纹不符，经代理访问时说明代理替换了证书链
+ */
+type CertificateMismatchError struct {
+	Fingerprint string
+}
+
+func (e *CertificateMismatchError) Error() string {
+	return "tls: certificate fingerprint " + e.Fingerprint + " does not match pinned fingerprints"
+}
+
+//证书DER编码的sha256，小写十六进制
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+*固定对端证书的指纹，只接受叶子证书指纹在fingerprints中的连接，不再校验证书链
+*指纹可带冒号分隔，不区分大小写，fingerprints为空时返回原配置
+ */
+func PinTLSConfig(tlsConfig *tls.Config, fingerprints []string) *tls.Config {
+	pins := make(map[string]bool)
+	for _, fingerprint := range fingerprints {
+		fingerprint = strings.ToLower(strings.Replace(strings.TrimSpace(fingerprint), ":", "", -1))
+		if fingerprint != "" {
+			pins[fingerprint] = true
+		}
+	}
+	if len(pins) == 0 {
+		return tlsConfig
+	}
+	pinned := &tls.Config{}
+	if tlsConfig != nil {
+		pinned = tlsConfig.Clone()
+	}
+	pinned.InsecureSkipVerify = true
+	pinned.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("tls: no peer certificate")
+		}
+		fingerprint := CertificateFingerprint(state.PeerCertificates[0])
+		if !pins[fingerprint] {
+			return &CertificateMismatchError{Fingerprint: fingerprint}
+		}
+		return nil
+	}
+	return pinned
+}
+
+//是否为证书被替换导致的错误，包括固定指纹不符及证书链不受信任、域名不符
+func IsTLSInterception(err error) bool {
+	var mismatch *CertificateMismatchError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &mismatch) || errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid)
+}
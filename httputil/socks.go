@@ -0,0 +1,234 @@
+package httputil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	PROTOCOL_SOCKS4  = "socks4"
+	PROTOCOL_SOCKS4A = "socks4a"
+	PROTOCOL_SOCKS5  = "socks5"
+)
+
+//ctx未设置超时时socks握手的超时
+const SOCKS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+var socks5Replies = []string{"succeeded", "general socks server failure", "connection not allowed by ruleset", "network unreachable",
+	"host unreachable", "connection refused", "ttl expired", "command not supported", "address type not supported"}
+
+/*
+*socks代理拨号器，支持socks4、socks4a及socks5，socks5支持用户名密码认证
+*socks4在本地解析域名，socks4a与socks5由代理解析
+ */
+type SocksDialer struct {
+	Protocol string
+	Addr     string
+	Username string
+	Password string
+	Dialer   *net.Dialer
+}
+
+func IsSocksProtocol(protocol string) bool {
+	return protocol == PROTOCOL_SOCKS4 || protocol == PROTOCOL_SOCKS4A || protocol == PROTOCOL_SOCKS5
+}
+
+func (s *SocksDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.New("socks: unsupported network " + network)
+	}
+	dialer := s.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(SOCKS_HANDSHAKE_TIMEOUT)
+	}
+	conn.SetDeadline(deadline)
+	switch s.Protocol {
+	case PROTOCOL_SOCKS5:
+		err = s.socks5Connect(conn, addr)
+	case PROTOCOL_SOCKS4, PROTOCOL_SOCKS4A:
+		err = s.socks4Connect(ctx, conn, addr)
+	default:
+		err = errors.New("socks: unsupported protocol " + s.Protocol)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func splitSocksAddr(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, errors.New("socks: invalid port " + portStr)
+	}
+	return host, port, nil
+}
+
+func (s *SocksDialer) socks5Connect(conn net.Conn, addr string) error {
+	host, port, err := splitSocksAddr(addr)
+	if err != nil {
+		return err
+	}
+	methods := []byte{0x00}
+	if s.Username != "" || s.Password != "" {
+		methods = append(methods, 0x02)
+	}
+	_, err = conn.Write(append([]byte{0x05, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return errors.New("socks5: invalid version " + strconv.Itoa(int(reply[0])))
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if err = s.socks5Auth(conn); err != nil {
+			return err
+		}
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(append(request, 0x01), ip4...)
+		} else {
+			request = append(append(request, 0x04), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("socks5: host name too long")
+		}
+		request = append(append(request, 0x03, byte(len(host))), host...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err = conn.Write(request); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		message := "unknown error"
+		if int(header[1]) < len(socks5Replies) {
+			message = socks5Replies[header[1]]
+		}
+		return errors.New("socks5: " + message)
+	}
+	//跳过绑定地址
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		size := make([]byte, 1)
+		if _, err = io.ReadFull(conn, size); err != nil {
+			return err
+		}
+		skip = int(size[0])
+	default:
+		return errors.New("socks5: invalid bound address type")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+//RFC1929用户名密码认证
+func (s *SocksDialer) socks5Auth(conn net.Conn) error {
+	if len(s.Username) > 255 || len(s.Password) > 255 {
+		return errors.New("socks5: username or password too long")
+	}
+	request := append([]byte{0x01, byte(len(s.Username))}, s.Username...)
+	request = append(append(request, byte(len(s.Password))), s.Password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("socks5: authentication failed")
+	}
+	return nil
+}
+
+func (s *SocksDialer) socks4Connect(ctx context.Context, conn net.Conn, addr string) error {
+	host, port, err := splitSocksAddr(addr)
+	if err != nil {
+		return err
+	}
+	request := []byte{0x04, 0x01, byte(port >> 8), byte(port)}
+	var hostName string
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		if s.Protocol == PROTOCOL_SOCKS4A {
+			//0.0.0.x表示由代理解析后面的域名
+			ip = net.IPv4(0, 0, 0, 1).To4()
+			hostName = host
+		} else {
+			ip, err = lookupIPv4(ctx, host)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	request = append(append(request, ip...), s.Username...)
+	request = append(request, 0x00)
+	if hostName != "" {
+		request = append(append(request, hostName...), 0x00)
+	}
+	if _, err = conn.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 8)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x00 {
+		return errors.New("socks4: invalid reply version " + strconv.Itoa(int(reply[0])))
+	}
+	if reply[1] != 0x5a {
+		return errors.New("socks4: request rejected, code " + strconv.Itoa(int(reply[1])))
+	}
+	return nil
+}
+
+func lookupIPv4(ctx context.Context, host string) (net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ip := addr.IP.To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("socks4: no ipv4 address for " + host)
+}
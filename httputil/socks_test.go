@@ -0,0 +1,67 @@
+package httputil
+
+import (
+	"fproxy/httputil/sockstest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSocksProxy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.Host))
+	}))
+	defer target.Close()
+	//通过域名访问，socks4在本地解析，socks4a与socks5由代理解析
+	targetUrl := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	open, err := sockstest.NewServer("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	auth, err := sockstest.NewServer("user", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Close()
+	cases := []struct {
+		proxy   string
+		request string
+		ok      bool
+	}{
+		{"socks5://" + open.Addr(), "socks5 localhost", true},
+		{"socks4://" + open.Addr(), "socks4 127.0.0.1", true},
+		{"socks4a://" + open.Addr(), "socks4a localhost", true},
+		{"socks5://user:secret@" + auth.Addr(), "socks5 localhost", true},
+		{"socks4://user@" + auth.Addr(), "socks4 127.0.0.1", true},
+		{"socks5://user:wrong@" + auth.Addr(), "", false},
+		{"socks5://" + auth.Addr(), "", false},
+		{"socks4://other@" + auth.Addr(), "", false},
+	}
+	for _, c := range cases {
+		body, err := DoHttpGet(targetUrl, c.proxy, nil, 0)
+		if c.ok != (err == nil) {
+			t.Errorf("get by %s: %v", c.proxy, err)
+			continue
+		}
+		if c.ok && !strings.HasPrefix(string(body), "hello localhost:") {
+			t.Errorf("get by %s body = %q", c.proxy, body)
+		}
+	}
+	requests := append(open.Requests(), auth.Requests()...)
+	for _, c := range cases {
+		if !c.ok {
+			continue
+		}
+		found := false
+		for _, request := range requests {
+			if strings.HasPrefix(request, c.request+":") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("request %q not seen by socks server: %v", c.request, requests)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package sockstest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+/*
+*测试用的socks服务端，支持socks4、socks4a及socks5
+*Username不为空时socks5要求用户名密码认证，socks4要求userid一致
+ */
+type Server struct {
+	Username string
+	Password string
+	//出站连接使用的本地地址，用于模拟代理的出口地址
+	LocalIp  string
+	listener net.Listener
+	lock     sync.Mutex
+	requests []string
+}
+
+func NewServer(username, password string) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{Username: username, Password: password, listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+//已处理的请求，格式为 协议 目标地址
+func (s *Server) Requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *Server) record(protocol, target string) {
+	s.lock.Lock()
+	s.requests = append(s.requests, protocol+" "+target)
+	s.lock.Unlock()
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	version, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+	var target string
+	switch version {
+	case 0x05:
+		target, err = s.socks5(reader, conn)
+	case 0x04:
+		target, err = s.socks4(reader, conn)
+	default:
+		return
+	}
+	if err != nil {
+		return
+	}
+	dialer := &net.Dialer{}
+	if s.LocalIp != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(s.LocalIp)}
+	}
+	upstream, err := dialer.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	go io.Copy(upstream, reader)
+	io.Copy(conn, upstream)
+}
+
+func (s *Server) socks5(reader *bufio.Reader, conn net.Conn) (string, error) {
+	n, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	methods := make([]byte, n)
+	if _, err = io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+	method := byte(0x00)
+	if s.Username != "" {
+		method = 0x02
+	}
+	accepted := false
+	for _, m := range methods {
+		if m == method {
+			accepted = true
+		}
+	}
+	if !accepted {
+		conn.Write([]byte{0x05, 0xff})
+		return "", io.EOF
+	}
+	conn.Write([]byte{0x05, method})
+	if method == 0x02 {
+		header := make([]byte, 2)
+		if _, err = io.ReadFull(reader, header); err != nil {
+			return "", err
+		}
+		username := make([]byte, header[1])
+		if _, err = io.ReadFull(reader, username); err != nil {
+			return "", err
+		}
+		size, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		password := make([]byte, size)
+		if _, err = io.ReadFull(reader, password); err != nil {
+			return "", err
+		}
+		if string(username) != s.Username || string(password) != s.Password {
+			conn.Write([]byte{0x01, 0x01})
+			return "", io.EOF
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	var host string
+	switch header[3] {
+	case 0x01, 0x04:
+		size := net.IPv4len
+		if header[3] == 0x04 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err = io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		size, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, size)
+		if _, err = io.ReadFull(reader, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	}
+	portBytes := make([]byte, 2)
+	if _, err = io.ReadFull(reader, portBytes); err != nil {
+		return "", err
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes))))
+	if header[1] != 0x01 {
+		conn.Write([]byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return "", io.EOF
+	}
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+	s.record("socks5", target)
+	return target, nil
+}
+
+func (s *Server) socks4(reader *bufio.Reader, conn net.Conn) (string, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	userid, err := reader.ReadString(0x00)
+	if err != nil {
+		return "", err
+	}
+	userid = userid[:len(userid)-1]
+	port := int(binary.BigEndian.Uint16(header[1:3]))
+	ip := net.IP(header[3:7])
+	host := ip.String()
+	protocol := "socks4"
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		name, err := reader.ReadString(0x00)
+		if err != nil {
+			return "", err
+		}
+		host = name[:len(name)-1]
+		protocol = "socks4a"
+	}
+	if header[0] != 0x01 || s.Username != "" && userid != s.Username {
+		conn.Write([]byte{0x00, 0x5b, 0, 0, 0, 0, 0, 0})
+		return "", io.EOF
+	}
+	conn.Write([]byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0})
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	s.record(protocol, target)
+	return target, nil
+}
@@ -0,0 +1,83 @@
+package httputil
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+/*
+*一次请求各阶段的耗时，经代理请求时DNS及连接为到代理的耗时，TLS握手为经隧道与目标站点的握手
+*FirstByte为发出请求到收到响应首字节的耗时，Total为整个请求含读取响应体的耗时，Bytes为响应体长度
+ */
+type Timing struct {
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	FirstByte    time.Duration
+	Total        time.Duration
+	Bytes        int64
+}
+
+//响应体的下载速度，单位字节/秒，不含建立连接及等待首字节的时间
+func (t Timing) Throughput() int64 {
+	transfer := t.Total - t.FirstByte
+	if t.Bytes <= 0 || transfer <= 0 {
+		return 0
+	}
+	return int64(float64(t.Bytes) / transfer.Seconds())
+}
+
+//与DoHttpGet相同，同时返回各阶段耗时，url为https时tlsConfig用于校验证书
+func DoHttpGetTimed(url, proxy string, tlsConfig *tls.Config, headers map[string]string, maxBodyLength int) ([]byte, Timing, error) {
+	timing := Timing{}
+	client := createTLSHttpClient(proxy, tlsConfig)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, timing, err
+	}
+	setHttpHeaders(req, headers)
+	var dnsStart, connectStart, tlsStart, wroteRequest time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			if !dnsStart.IsZero() {
+				timing.DNS = time.Since(dnsStart)
+			}
+		},
+		ConnectStart: func(string, string) { connectStart = time.Now() },
+		ConnectDone: func(string, string, error) {
+			if !connectStart.IsZero() {
+				timing.Connect = time.Since(connectStart)
+			}
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			if !tlsStart.IsZero() {
+				timing.TLSHandshake = time.Since(tlsStart)
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) { wroteRequest = time.Now() },
+		GotFirstResponseByte: func() {
+			if !wroteRequest.IsZero() {
+				timing.FirstByte = time.Since(wroteRequest)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, timing, err
+	}
+	defer res.Body.Close()
+	bs, err := readFromHttpResponse(res, maxBodyLength)
+	timing.Total = time.Since(start)
+	timing.Bytes = int64(len(bs))
+	//socks代理在拨号时完成握手，不触发ConnectStart，以发出请求前的时间作为连接耗时
+	if timing.Connect == 0 && !wroteRequest.IsZero() {
+		timing.Connect = wroteRequest.Sub(start) - timing.TLSHandshake
+	}
+	return bs, timing, err
+}
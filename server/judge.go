@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fproxy/core"
+	ictx "github.com/kataras/iris/context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+*匿名判定服务，返回看到的客户端地址及全部请求头，检测器据此判断代理是否暴露了真实地址
+ */
+type JudgeHandler struct {
+	//判定服务部署在反向代理后时，从该请求头读取客户端地址，该头不会出现在返回结果中
+	RealIpHeader string
+}
+
+func (j *JudgeHandler) HandleJudge(ctx ictx.Context) {
+	j.ServeHTTP(ctx.ResponseWriter(), ctx.Request())
+}
+
+func (j *JudgeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bs, err := json.Marshal(j.Judge(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(bs)
+}
+
+//定长数据的默认及最大长度
+const (
+	JUDGE_PAYLOAD_SIZE     = 256 * 1024
+	JUDGE_MAX_PAYLOAD_SIZE = 10 * 1024 * 1024
+)
+
+var payloadChunk = bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+//返回size字节的数据用于测量代理带宽，如 /judge/payload?size=262144
+func HandlePayload(ctx ictx.Context) {
+	ServePayload(ctx.ResponseWriter(), ctx.Request())
+}
+
+func ServePayload(w http.ResponseWriter, r *http.Request) {
+	size := JUDGE_PAYLOAD_SIZE
+	if sizeParam := r.URL.Query().Get("size"); sizeParam != "" {
+		var err error
+		size, err = strconv.Atoi(sizeParam)
+		if err != nil || size < 0 || size > JUDGE_MAX_PAYLOAD_SIZE {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	w.Header().Set("Cache-Control", "no-store")
+	for size > 0 {
+		chunk := payloadChunk
+		if size < len(chunk) {
+			chunk = chunk[:size]
+		}
+		_, err := w.Write(chunk)
+		if err != nil {
+			return
+		}
+		size -= len(chunk)
+	}
+}
+
+//固定内容的页面，带有脚本、链接及图片，用于检测代理是否篡改内容
+const JUDGE_TAMPER_PAGE = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>fproxy judge</title>
+<script src="/judge/static/app.js"></script>
+</head>
+<body>
+<h1>fproxy judge page</h1>
+<p>This page is served unchanged. Any difference seen through a proxy means the proxy rewrote it.</p>
+<a href="http://example.com/download/setup.exe">download</a>
+<img src="http://example.com/logo.png" alt="logo">
+<script>document.title = "fproxy judge";</script>
+</body>
+</html>
+`
+
+func HandleTamperPage(ctx ictx.Context) {
+	ServeTamperPage(ctx.ResponseWriter(), ctx.Request())
+}
+
+func ServeTamperPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(JUDGE_TAMPER_PAGE)))
+	w.Header().Set("Cache-Control", "no-store, no-transform")
+	w.Write([]byte(JUDGE_TAMPER_PAGE))
+}
+
+//以https提供判定服务，用于检测代理的CONNECT隧道
+func ServeJudgeTLS(host string, port int, certFile, keyFile string, judge *JudgeHandler) error {
+	mux := http.NewServeMux()
+	mux.Handle("/judge", judge)
+	mux.HandleFunc("/judge/payload", ServePayload)
+	mux.HandleFunc("/judge/page", ServeTamperPage)
+	addr := host + ":" + strconv.Itoa(port)
+	return http.ListenAndServeTLS(addr, certFile, keyFile, mux)
+}
+
+func (j *JudgeHandler) Judge(r *http.Request) core.JudgeResult {
+	headers := r.Header.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	//Host不在Header中，代理可能改写，一并返回
+	headers.Set("Host", r.Host)
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if j.RealIpHeader != "" {
+		if realIp := strings.TrimSpace(headers.Get(j.RealIpHeader)); realIp != "" {
+			ip = realIp
+		}
+		headers.Del(j.RealIpHeader)
+	}
+	return core.JudgeResult{Ip: ip, Headers: headers}
+}
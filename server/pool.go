@@ -0,0 +1,297 @@
+package server
+
+import (
+	"errors"
+	"fproxy/core"
+	"fproxy/store"
+	"github.com/golang/glog"
+	ictx "github.com/kataras/iris/context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//代理池的排序方式，默认按评分
+const (
+	SORT_LATENCY   = "latency"
+	SORT_BANDWIDTH = "bandwidth"
+)
+
+type PoolHandler struct {
+	Store store.ProxyStore
+}
+
+//有效代理按评分排序，top取前N个，minScore过滤最低评分
+func (p *PoolHandler) HandleValidProxies(ctx ictx.Context) {
+	p.writeScoredPool(ctx, core.PROXY_POOL_VALID)
+}
+
+func (p *PoolHandler) HandleAnonymousProxies(ctx ictx.Context) {
+	p.writeScoredPool(ctx, core.PROXY_POOL_ANONYMOUS)
+}
+
+func (p *PoolHandler) HandleTransparentProxies(ctx ictx.Context) {
+	p.writeScoredPool(ctx, core.PROXY_POOL_TRANSPARENT)
+}
+
+func (p *PoolHandler) HandleHistoryProxies(ctx ictx.Context) {
+	p.writePool(ctx, core.PROXY_POOL_HISTORY)
+}
+
+func (p *PoolHandler) HandleArchivedProxies(ctx ictx.Context) {
+	p.writePool(ctx, core.PROXY_POOL_ARCHIVE)
+}
+
+func (p *PoolHandler) HandleProxy(ctx ictx.Context) {
+	addr := ctx.Params().Get("addr")
+	proxy, err := store.LoadProxy(ctx.Request().Context(), p.Store, addr)
+	if err != nil {
+		ctx.StatusCode(http.StatusNotFound)
+		ctx.WriteString(err.Error())
+		return
+	}
+	ctx.JSON(proxy)
+}
+
+func (p *PoolHandler) writePool(ctx ictx.Context, pool string) {
+	filter, err := parseProxyFilter(ctx)
+	if err != nil {
+		ctx.StatusCode(http.StatusBadRequest)
+		ctx.WriteString(err.Error())
+		return
+	}
+	members, err := p.Store.Smembers(ctx.Request().Context(), pool)
+	if err != nil {
+		glog.Errorln("get proxy pool ", pool, " error: ", err)
+		ctx.StatusCode(http.StatusInternalServerError)
+		ctx.WriteString(err.Error())
+		return
+	}
+	ctx.JSON(filter.apply(store.LoadProxies(ctx.Request().Context(), p.Store, members)))
+}
+
+func (p *PoolHandler) writeScoredPool(ctx ictx.Context, pool string) {
+	reqCtx := ctx.Request().Context()
+	top := ctx.URLParamIntDefault("top", -1)
+	filter, err := parseProxyFilter(ctx)
+	if err != nil {
+		ctx.StatusCode(http.StatusBadRequest)
+		ctx.WriteString(err.Error())
+		return
+	}
+	var proxies []core.Proxy
+	if ctx.URLParamExists("minScore") {
+		minScore, perr := strconv.ParseFloat(ctx.URLParam("minScore"), 64)
+		if perr != nil {
+			ctx.StatusCode(http.StatusBadRequest)
+			ctx.WriteString("invalid minScore")
+			return
+		}
+		proxies, err = store.ProxiesAboveScore(reqCtx, p.Store, pool, minScore)
+	} else {
+		//需要过滤时先取全部，过滤后再截取
+		limit := top
+		if limit < 0 || filter.active() {
+			limit, err = p.Store.Zcard(reqCtx, pool)
+		}
+		if err == nil {
+			proxies, err = store.TopProxies(reqCtx, p.Store, pool, limit)
+		}
+	}
+	if err != nil {
+		glog.Errorln("get scored proxy pool ", pool, " error: ", err)
+		ctx.StatusCode(http.StatusInternalServerError)
+		ctx.WriteString(err.Error())
+		return
+	}
+	proxies = filter.apply(proxies)
+	if top >= 0 && top < len(proxies) {
+		proxies = proxies[:top]
+	}
+	ctx.JSON(proxies)
+}
+
+/*
+*按泄露情况及能力过滤，exclude为不允许泄露的请求头，逗号分隔，*表示不允许泄露任何请求头
+*ipLeaked=false时排除暴露了出口地址的代理，https=true时只返回支持https隧道且未拦截TLS的代理
+*maxLatency为最大延迟(毫秒)，minBandwidth为最小带宽(字节/秒)，sort=latency按延迟升序，sort=bandwidth按带宽降序
+*protocol为允许的代理协议，逗号分隔，如socks4,socks5，代理支持其中任一协议即可，connect表示支持CONNECT隧道
+*profile为目标站点验证配置名，逗号分隔，代理须在最近一次检测中通过全部配置
+*country为国家ISO代码，city为城市英文名，asn为自治系统号，均可逗号分隔多个值，代理符合其中任一值即可，不区分大小写
+ */
+type proxyFilter struct {
+	exclude      []string
+	ipLeaked     *bool
+	https        *bool
+	protocols    []string
+	maxLatency   *int64
+	minBandwidth *int64
+	sort         string
+	countries    []string
+	cities       []string
+	asns         []int
+	profiles     []string
+}
+
+func parseProxyFilter(ctx ictx.Context) (proxyFilter, error) {
+	filter := proxyFilter{}
+	for _, header := range strings.Split(ctx.URLParam("exclude"), ",") {
+		header = strings.TrimSpace(header)
+		if header != "" {
+			filter.exclude = append(filter.exclude, header)
+		}
+	}
+	if ctx.URLParamExists("ipLeaked") {
+		ipLeaked, err := strconv.ParseBool(ctx.URLParam("ipLeaked"))
+		if err != nil {
+			return filter, errors.New("invalid ipLeaked")
+		}
+		filter.ipLeaked = &ipLeaked
+	}
+	for _, protocol := range strings.Split(ctx.URLParam("protocol"), ",") {
+		protocol = strings.TrimSpace(protocol)
+		if protocol == "" {
+			continue
+		}
+		if !core.IsProxyProtocol(protocol) && protocol != core.PROXY_PROTOCOL_CONNECT {
+			return filter, errors.New("invalid protocol: " + protocol)
+		}
+		filter.protocols = append(filter.protocols, protocol)
+	}
+	for _, param := range []string{"maxLatency", "minBandwidth"} {
+		if !ctx.URLParamExists(param) {
+			continue
+		}
+		value, err := strconv.ParseInt(ctx.URLParam(param), 10, 64)
+		if err != nil || value < 0 {
+			return filter, errors.New("invalid " + param)
+		}
+		if param == "maxLatency" {
+			filter.maxLatency = &value
+		} else {
+			filter.minBandwidth = &value
+		}
+	}
+	filter.countries = splitParam(ctx, "country")
+	filter.cities = splitParam(ctx, "city")
+	for _, asn := range splitParam(ctx, "asn") {
+		//允许AS13335的写法
+		value, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(asn), "AS"))
+		if err != nil || value <= 0 {
+			return filter, errors.New("invalid asn: " + asn)
+		}
+		filter.asns = append(filter.asns, value)
+	}
+	filter.profiles = splitParam(ctx, "profile")
+	filter.sort = ctx.URLParam("sort")
+	if filter.sort != "" && filter.sort != SORT_LATENCY && filter.sort != SORT_BANDWIDTH {
+		return filter, errors.New("invalid sort: " + filter.sort)
+	}
+	if ctx.URLParamExists("https") {
+		https, err := strconv.ParseBool(ctx.URLParam("https"))
+		if err != nil {
+			return filter, errors.New("invalid https")
+		}
+		filter.https = &https
+	}
+	return filter, nil
+}
+
+//逗号分隔的参数，忽略空值
+func splitParam(ctx ictx.Context, name string) []string {
+	values := make([]string, 0)
+	for _, value := range strings.Split(ctx.URLParam(name), ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func (f proxyFilter) active() bool {
+	return len(f.exclude) > 0 || f.ipLeaked != nil || f.https != nil || len(f.protocols) > 0 ||
+		f.maxLatency != nil || f.minBandwidth != nil || f.sort != "" || len(f.countries) > 0 || len(f.cities) > 0 || len(f.asns) > 0 ||
+		len(f.profiles) > 0
+}
+
+func (f proxyFilter) match(proxy core.Proxy) bool {
+	if f.ipLeaked != nil && proxy.IpLeaked != *f.ipLeaked {
+		return false
+	}
+	if f.https != nil && proxy.ServesHttps() != *f.https {
+		return false
+	}
+	if f.maxLatency != nil && proxy.Latency > *f.maxLatency {
+		return false
+	}
+	if f.minBandwidth != nil && proxy.Bandwidth < *f.minBandwidth {
+		return false
+	}
+	if len(f.protocols) > 0 {
+		matched := false
+		for _, protocol := range f.protocols {
+			if proxy.SupportsProtocol(protocol) && !(protocol == core.PROXY_PROTOCOL_CONNECT && proxy.TlsIntercepted) {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(f.countries) > 0 && !containsFold(f.countries, proxy.Country) || len(f.cities) > 0 && !containsFold(f.cities, proxy.City) {
+		return false
+	}
+	if len(f.asns) > 0 {
+		matched := false
+		for _, asn := range f.asns {
+			if proxy.Asn == asn {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, profile := range f.profiles {
+		if !proxy.PassesProfile(profile) {
+			return false
+		}
+	}
+	for _, header := range f.exclude {
+		if header == "*" && len(proxy.LeakedHeaders) > 0 || proxy.LeaksHeader(header) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(values []string, s string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f proxyFilter) apply(proxies []core.Proxy) []core.Proxy {
+	if !f.active() {
+		return proxies
+	}
+	matched := make([]core.Proxy, 0, len(proxies))
+	for _, proxy := range proxies {
+		if f.match(proxy) {
+			matched = append(matched, proxy)
+		}
+	}
+	//排序稳定，延迟或带宽相同的按原有顺序
+	switch f.sort {
+	case SORT_LATENCY:
+		sort.SliceStable(matched, func(i, j int) bool { return matched[i].Latency < matched[j].Latency })
+	case SORT_BANDWIDTH:
+		sort.SliceStable(matched, func(i, j int) bool { return matched[i].Bandwidth > matched[j].Bandwidth })
+	}
+	return matched
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fproxy/stats"
+	"github.com/golang/glog"
+	ictx "github.com/kataras/iris/context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type StatsHandler struct {
+	Recorder *stats.Recorder
+}
+
+//granularity为hour或day，from与to为unix秒，默认最近24小时或30天
+func (s *StatsHandler) HandleStats(ctx ictx.Context) {
+	granularity := ctx.URLParamDefault("granularity", stats.GRANULARITY_HOUR)
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	if granularity == stats.GRANULARITY_DAY {
+		from = to.AddDate(0, 0, -30)
+	}
+	var err error
+	if ctx.URLParamExists("from") {
+		from, err = parseUnixParam(ctx.URLParam("from"))
+	}
+	if err == nil && ctx.URLParamExists("to") {
+		to, err = parseUnixParam(ctx.URLParam("to"))
+	}
+	if err != nil {
+		ctx.StatusCode(http.StatusBadRequest)
+		ctx.WriteString("invalid time range")
+		return
+	}
+	err = stats.ValidateQuery(granularity, from, to)
+	if err != nil {
+		ctx.StatusCode(http.StatusBadRequest)
+		ctx.WriteString(err.Error())
+		return
+	}
+	points, err := s.Recorder.Query(ctx.Request().Context(), granularity, from, to)
+	if err != nil {
+		glog.Errorln("query stats error: ", err)
+		ctx.StatusCode(http.StatusInternalServerError)
+		ctx.WriteString(err.Error())
+		return
+	}
+	ctx.JSON(points)
+}
+
+func parseUnixParam(value string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0), nil
+}
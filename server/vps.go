@@ -3,6 +3,7 @@ package server
 import (
 	"fproxy/builder"
 	ictx "github.com/kataras/iris/context"
+	"net/http"
 )
 
 type VPSHandler struct {
@@ -14,6 +15,11 @@ func (v *VPSHandler) HandleAaddVPS(ctx ictx.Context) {
 	name := params.Get("vps")
 	ip := params.Get("ip")
 	port, _ := params.GetInt("port")
-	v.VPS.AddVPS(name, ip, port)
+	err := v.VPS.AddVPS(ctx.Request().Context(), name, ip, port)
+	if err != nil {
+		ctx.StatusCode(http.StatusInternalServerError)
+		ctx.WriteString(err.Error())
+		return
+	}
 	ctx.WriteString("ok")
 }
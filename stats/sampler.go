@@ -0,0 +1,79 @@
+package stats
+
+import (
+	"context"
+	"fproxy/core"
+	"fproxy/store"
+	"github.com/golang/glog"
+	"time"
+)
+
+const DEFAULT_SAMPLE_INTERVAL = 5 * time.Minute
+
+/*
+*定期采样有效池、历史池及队列的大小，有效池按来源分组
+ */
+type Sampler struct {
+	Recorder *Recorder
+	Store    store.ProxyStore
+	//队列名称到key，如check与scan
+	Queues   map[string]string
+	Interval time.Duration
+}
+
+func NewSampler(recorder *Recorder, proxyStore store.ProxyStore, queues map[string]string, interval time.Duration) *Sampler {
+	if interval <= 0 {
+		interval = DEFAULT_SAMPLE_INTERVAL
+	}
+	return &Sampler{Recorder: recorder, Store: proxyStore, Queues: queues, Interval: interval}
+}
+
+func (s *Sampler) Run(ctx context.Context) {
+	for {
+		err := s.Sample(ctx)
+		if err != nil && ctx.Err() == nil {
+			glog.Errorln("sample pool sizes error: ", err)
+		}
+		select {
+		case <-time.After(s.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Sampler) Sample(ctx context.Context) error {
+	values := make(map[string]int64)
+	members, err := s.Store.Zrevrange(ctx, core.PROXY_POOL_VALID, 0, -1)
+	if err != nil {
+		return err
+	}
+	addrs := make([]string, len(members))
+	for i, member := range members {
+		addrs[i] = member.Member
+	}
+	values[Field(METRIC_SIZE, GAUGE_VALID, SOURCE_ALL)] = int64(len(addrs))
+	for _, proxy := range store.LoadProxies(ctx, s.Store, addrs) {
+		values[Field(METRIC_SIZE, GAUGE_VALID, proxy.Source)]++
+	}
+	for name, pool := range map[string]string{GAUGE_ANONYMOUS: core.PROXY_POOL_ANONYMOUS, GAUGE_TRANSPARENT: core.PROXY_POOL_TRANSPARENT} {
+		size, err := s.Store.Zcard(ctx, pool)
+		if err != nil {
+			return err
+		}
+		values[Field(METRIC_SIZE, name, SOURCE_ALL)] = int64(size)
+	}
+	historySize, err := s.Store.Scard(ctx, core.PROXY_POOL_HISTORY)
+	if err != nil {
+		return err
+	}
+	values[Field(METRIC_SIZE, GAUGE_HISTORY, SOURCE_ALL)] = int64(historySize)
+	for name, key := range s.Queues {
+		size, err := s.Store.Len(ctx, key)
+		if err != nil {
+			return err
+		}
+		values[Field(METRIC_SIZE, name)] = int64(size)
+	}
+	return s.Recorder.Gauge(ctx, GAUGE_GROUP_POOLS, values)
+}
@@ -0,0 +1,211 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fproxy/store"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//计数指标
+const (
+	METRIC_DISCOVERED = "discovered" //进入检测队列
+	METRIC_VALIDATED  = "validated"  //通过检测进入有效池
+	METRIC_EVICTED    = "evicted"    //移出有效池
+	METRIC_SUPPRESSED = "suppressed" //去重过滤
+	METRIC_PROMOTED   = "promoted"   //历史代理复活，放回检测队列
+	METRIC_ARCHIVED   = "archived"   //连续失败过多，移出历史池
+	METRIC_TAMPERED   = "tampered"   //发现篡改内容
+)
+
+//采样指标，记录采样时的池大小
+const (
+	METRIC_SIZE       = "size"
+	GAUGE_VALID       = "valid"
+	GAUGE_ANONYMOUS   = "anonymous"
+	GAUGE_TRANSPARENT = "transparent"
+	GAUGE_HISTORY     = "history"
+	GAUGE_ALIVE       = "alive"
+	SOURCE_ALL        = "all"
+)
+
+//采样值按写入方分组保存，每次采样替换本组的全部字段，已降为0的来源不会留下旧值
+const (
+	GAUGE_GROUP_POOLS   = "pools"   //采样器记录的池及队列大小
+	GAUGE_GROUP_HISTORY = "history" //历史池复检记录的存活数量
+)
+
+var gaugeGroups = []string{GAUGE_GROUP_POOLS, GAUGE_GROUP_HISTORY}
+
+const (
+	GRANULARITY_HOUR = "hour"
+	GRANULARITY_DAY  = "day"
+)
+
+const (
+	STATS_HOUR_KEY = "proxy:stats:hour:"
+	STATS_DAY_KEY  = "proxy:stats:day:"
+)
+
+const (
+	DEFAULT_HOUR_RETENTION = 7 * 24 * time.Hour
+	DEFAULT_DAY_RETENTION  = 400 * 24 * time.Hour
+	//单次查询最多返回的时间点
+	MAX_QUERY_POINTS = 24 * 400
+)
+
+/*
+*时间序列，每小时与每天各一个计数哈希及每组一个采样哈希，字段为 指标:来源，按保留时长过期
+*时间按UTC分桶
+ */
+type Recorder struct {
+	Store         store.ProxyStore
+	HourRetention time.Duration
+	DayRetention  time.Duration
+}
+
+type Point struct {
+	Time   int64
+	Values map[string]int64
+}
+
+func NewRecorder(proxyStore store.ProxyStore, hourRetention, dayRetention time.Duration) *Recorder {
+	if hourRetention <= 0 {
+		hourRetention = DEFAULT_HOUR_RETENTION
+	}
+	if dayRetention <= 0 {
+		dayRetention = DEFAULT_DAY_RETENTION
+	}
+	return &Recorder{Store: proxyStore, HourRetention: hourRetention, DayRetention: dayRetention}
+}
+
+//指标字段名，来源为空时记为unknown
+func Field(metric string, parts ...string) string {
+	fields := append([]string{metric}, parts...)
+	for i, field := range fields {
+		if field == "" {
+			fields[i] = "unknown"
+		}
+	}
+	return strings.Join(fields, ":")
+}
+
+func bucketKey(granularity string, t time.Time) string {
+	t = t.UTC()
+	if granularity == GRANULARITY_DAY {
+		return STATS_DAY_KEY + t.Format("20060102")
+	}
+	return STATS_HOUR_KEY + t.Format("2006010215")
+}
+
+func truncate(granularity string, t time.Time) time.Time {
+	t = t.UTC()
+	if granularity == GRANULARITY_DAY {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+func step(granularity string) time.Duration {
+	if granularity == GRANULARITY_DAY {
+		return 24 * time.Hour
+	}
+	return time.Hour
+}
+
+//在批量写入中累加计数，r为nil或n为0时忽略
+func (r *Recorder) IncrPipelined(pipe store.Pipeliner, metric, source string, n int64) {
+	if r == nil || n == 0 {
+		return
+	}
+	field := Field(metric, source)
+	now := time.Now()
+	hourKey := bucketKey(GRANULARITY_HOUR, now)
+	dayKey := bucketKey(GRANULARITY_DAY, now)
+	pipe.HincrBy(hourKey, field, n)
+	pipe.Expire(hourKey, r.HourRetention+time.Hour)
+	pipe.HincrBy(dayKey, field, n)
+	pipe.Expire(dayKey, r.DayRetention+24*time.Hour)
+}
+
+func (r *Recorder) Incr(ctx context.Context, metric, source string, n int64) error {
+	if r == nil || n == 0 {
+		return nil
+	}
+	return r.Store.Pipelined(ctx, func(pipe store.Pipeliner) {
+		r.IncrPipelined(pipe, metric, source, n)
+	})
+}
+
+func gaugeKey(granularity string, t time.Time, group string) string {
+	return bucketKey(granularity, t) + ":" + group
+}
+
+//记录一组采样值，同一时间段内后写入的整组替换先写入的
+func (r *Recorder) Gauge(ctx context.Context, group string, values map[string]int64) error {
+	if r == nil || len(values) == 0 {
+		return nil
+	}
+	hash := make(map[string]string, len(values))
+	for field, value := range values {
+		hash[field] = strconv.FormatInt(value, 10)
+	}
+	now := time.Now()
+	hourKey := gaugeKey(GRANULARITY_HOUR, now, group)
+	dayKey := gaugeKey(GRANULARITY_DAY, now, group)
+	return r.Store.Pipelined(ctx, func(pipe store.Pipeliner) {
+		pipe.Del(hourKey)
+		pipe.Hmset(hourKey, hash)
+		pipe.Expire(hourKey, r.HourRetention+time.Hour)
+		pipe.Del(dayKey)
+		pipe.Hmset(dayKey, hash)
+		pipe.Expire(dayKey, r.DayRetention+24*time.Hour)
+	})
+}
+
+//检查查询参数，不合法时返回错误
+func ValidateQuery(granularity string, from, to time.Time) error {
+	if granularity != GRANULARITY_HOUR && granularity != GRANULARITY_DAY {
+		return errors.New("unknown granularity: " + granularity)
+	}
+	if to.Before(from) {
+		return errors.New("query end before start")
+	}
+	if int(to.Sub(truncate(granularity, from))/step(granularity))+1 > MAX_QUERY_POINTS {
+		return errors.New("too many points, narrow the time range")
+	}
+	return nil
+}
+
+//查询[from, to]内的时间点，没有数据的时间点Values为空
+func (r *Recorder) Query(ctx context.Context, granularity string, from, to time.Time) ([]Point, error) {
+	err := ValidateQuery(granularity, from, to)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]Point, 0)
+	for t := truncate(granularity, from); !t.After(to); t = t.Add(step(granularity)) {
+		keys := []string{bucketKey(granularity, t)}
+		for _, group := range gaugeGroups {
+			keys = append(keys, gaugeKey(granularity, t, group))
+		}
+		values := make(map[string]int64)
+		for _, key := range keys {
+			hash, err := r.Store.Hgetall(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			for field, text := range hash {
+				value, err := strconv.ParseInt(text, 10, 64)
+				if err != nil {
+					continue
+				}
+				values[field] = value
+			}
+		}
+		points = append(points, Point{Time: t.Unix(), Values: values})
+	}
+	return points, nil
+}
@@ -0,0 +1,92 @@
+package stats
+
+import (
+	"context"
+	"fproxy/core"
+	"fproxy/store"
+	"testing"
+	"time"
+)
+
+var ctx = context.Background()
+
+func TestRecorderQuery(t *testing.T) {
+	s := store.NewMemoryStore()
+	r := NewRecorder(s, 0, 0)
+	err := s.Pipelined(ctx, func(pipe store.Pipeliner) {
+		r.IncrPipelined(pipe, METRIC_VALIDATED, core.PROXY_SOURCE_CRAW, 2)
+		r.IncrPipelined(pipe, METRIC_VALIDATED, core.PROXY_SOURCE_CRAW, 1)
+		r.IncrPipelined(pipe, METRIC_DISCOVERED, "", 5)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	points, err := r.Query(ctx, GRANULARITY_HOUR, now.Add(-2*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 3 {
+		t.Fatalf("points = %v", points)
+	}
+	last := points[len(points)-1]
+	if last.Values["validated:craw"] != 3 || last.Values["discovered:unknown"] != 5 {
+		t.Errorf("hour values = %v", last.Values)
+	}
+	if len(points[0].Values) != 0 {
+		t.Errorf("empty bucket has values %v", points[0].Values)
+	}
+	points, err = r.Query(ctx, GRANULARITY_DAY, now, now)
+	if err != nil || len(points) != 1 || points[0].Values["validated:craw"] != 3 {
+		t.Errorf("day points = %v, %v", points, err)
+	}
+	if _, err = r.Query(ctx, "minute", now, now); err == nil {
+		t.Errorf("unknown granularity accepted")
+	}
+	if _, err = r.Query(ctx, GRANULARITY_HOUR, now.AddDate(-2, 0, 0), now); err == nil {
+		t.Errorf("too large range accepted")
+	}
+	//未配置统计时忽略
+	var nilRecorder *Recorder
+	if err = nilRecorder.Incr(ctx, METRIC_EVICTED, core.PROXY_SOURCE_SCAN, 1); err != nil {
+		t.Errorf("nil recorder error: %v", err)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	s := store.NewMemoryStore()
+	craw := core.NewProxy("1.1.1.1", 80, core.PROXY_SOURCE_CRAW, "")
+	scan := core.NewProxy("2.2.2.2", 8080, core.PROXY_SOURCE_SCAN, "")
+	for _, proxy := range []core.Proxy{craw, scan} {
+		store.SaveProxy(ctx, s, proxy)
+		s.Zadd(ctx, core.PROXY_POOL_VALID, 10, proxy.Addr())
+	}
+	s.Sadd(ctx, core.PROXY_POOL_HISTORY, craw.Addr(), scan.Addr(), "3.3.3.3:80")
+	s.Rpush(ctx, core.PROXY_CHECK_QUEUE, "a", "b")
+	r := NewRecorder(s, time.Hour, 24*time.Hour)
+	sampler := NewSampler(r, s, map[string]string{"check": core.PROXY_CHECK_QUEUE}, time.Minute)
+	if err := sampler.Sample(ctx); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	points, err := r.Query(ctx, GRANULARITY_HOUR, now, now)
+	if err != nil || len(points) != 1 {
+		t.Fatalf("points = %v, %v", points, err)
+	}
+	expected := map[string]int64{"size:valid:all": 2, "size:valid:craw": 1, "size:valid:scan": 1, "size:history:all": 3, "size:check": 2}
+	for field, value := range expected {
+		if points[0].Values[field] != value {
+			t.Errorf("%s = %d, want %d", field, points[0].Values[field], value)
+		}
+	}
+	//来源降为0后不保留上次的值，其他组的采样值不受影响
+	r.Gauge(ctx, GAUGE_GROUP_HISTORY, map[string]int64{"size:alive:all": 1})
+	s.Zrem(ctx, core.PROXY_POOL_VALID, scan.Addr())
+	if err := sampler.Sample(ctx); err != nil {
+		t.Fatal(err)
+	}
+	points, _ = r.Query(ctx, GRANULARITY_HOUR, now, now)
+	if _, ok := points[0].Values["size:valid:scan"]; ok || points[0].Values["size:valid:all"] != 1 || points[0].Values["size:alive:all"] != 1 {
+		t.Errorf("values after resample = %v", points[0].Values)
+	}
+}
@@ -0,0 +1,388 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var boltBucket = []byte("fproxy")
+
+type boltKeyspace struct {
+	bucket *bolt.Bucket
+	err    error
+}
+
+func (b *boltKeyspace) get(key string) *entry {
+	data := b.bucket.Get([]byte(key))
+	if data == nil {
+		return nil
+	}
+	e := &entry{}
+	err := json.Unmarshal(data, e)
+	if err != nil {
+		b.fail(err)
+		return nil
+	}
+	//只读事务中无法删除，过期的键留到写入时覆盖或定期清理
+	if e.expired(time.Now()) {
+		return nil
+	}
+	return e
+}
+
+func (b *boltKeyspace) put(key string, e *entry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		b.fail(err)
+		return
+	}
+	b.fail(b.bucket.Put([]byte(key), data))
+}
+
+func (b *boltKeyspace) remove(key string) {
+	b.fail(b.bucket.Delete([]byte(key)))
+}
+
+func (b *boltKeyspace) keys() []string {
+	keys := make([]string, 0)
+	b.fail(b.bucket.ForEach(func(k, v []byte) error {
+		key := string(k)
+		if b.get(key) != nil {
+			keys = append(keys, key)
+		}
+		return nil
+	}))
+	return keys
+}
+
+//只解析过期时间，不解析整个值
+func (b *boltKeyspace) sweep(now time.Time) int {
+	expired := make([][]byte, 0)
+	b.fail(b.bucket.ForEach(func(k, v []byte) error {
+		var e struct{ ExpireAt int64 }
+		err := json.Unmarshal(v, &e)
+		if err != nil {
+			return err
+		}
+		if (&entry{ExpireAt: e.ExpireAt}).expired(now) {
+			expired = append(expired, append([]byte{}, k...))
+		}
+		return nil
+	}))
+	for _, key := range expired {
+		b.fail(b.bucket.Delete(key))
+	}
+	return len(expired)
+}
+
+func (b *boltKeyspace) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+/*
+*本地文件存储，基于BoltDB，用于单机运行
+ */
+type BoltStore struct {
+	db *bolt.DB
+	//由写事务串行访问
+	sweepInterval time.Duration
+	sweptAt       time.Time
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db, sweepInterval: EXPIRE_SWEEP_INTERVAL, sweptAt: time.Now()}, nil
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltStore) update(ctx context.Context, fn func(ks keyspace) error) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		ks := &boltKeyspace{bucket: tx.Bucket(boltBucket)}
+		//只读事务中无法删除，每隔sweepInterval在一次写入中顺带清理过期键
+		if now := time.Now(); now.Sub(b.sweptAt) >= b.sweepInterval {
+			ks.sweep(now)
+			b.sweptAt = now
+		}
+		err := fn(ks)
+		if err != nil {
+			return err
+		}
+		return ks.err
+	})
+}
+
+func (b *BoltStore) view(ctx context.Context, fn func(ks keyspace) error) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	return b.db.View(func(tx *bolt.Tx) error {
+		ks := &boltKeyspace{bucket: tx.Bucket(boltBucket)}
+		err := fn(ks)
+		if err != nil {
+			return err
+		}
+		return ks.err
+	})
+}
+
+func (b *BoltStore) Set(ctx context.Context, key string, value string) error {
+	return b.update(ctx, func(ks keyspace) error {
+		ksSet(ks, key, value)
+		return nil
+	})
+}
+
+func (b *BoltStore) SetNX(ctx context.Context, key string, value string, ttl time.Duration) (ok bool, err error) {
+	err = b.update(ctx, func(ks keyspace) error {
+		ok = ksSetNX(ks, key, value, ttl)
+		return nil
+	})
+	return
+}
+
+func (b *BoltStore) Get(ctx context.Context, key string) (value string, err error) {
+	err = b.view(ctx, func(ks keyspace) error {
+		value, err = ksGet(ks, key)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Keys(ctx context.Context, pattern string) (keys []string, err error) {
+	err = b.view(ctx, func(ks keyspace) error {
+		keys = ksKeys(ks, pattern)
+		return nil
+	})
+	return
+}
+
+func (b *BoltStore) Rename(ctx context.Context, key, newkey string) error {
+	return b.update(ctx, func(ks keyspace) error {
+		return ksRename(ks, key, newkey)
+	})
+}
+
+func (b *BoltStore) Del(ctx context.Context, key string) error {
+	return b.update(ctx, func(ks keyspace) error {
+		ks.remove(key)
+		return nil
+	})
+}
+
+func (b *BoltStore) Expire(ctx context.Context, key string, ttl time.Duration) (ok bool, err error) {
+	err = b.update(ctx, func(ks keyspace) error {
+		ok = ksExpire(ks, key, ttl)
+		return nil
+	})
+	return
+}
+
+func (b *BoltStore) Incr(ctx context.Context, key string) (value int64, err error) {
+	err = b.update(ctx, func(ks keyspace) error {
+		value, err = ksIncr(ks, key)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) IncrBy(ctx context.Context, key string, increment int64) (value int64, err error) {
+	err = b.update(ctx, func(ks keyspace) error {
+		value, err = ksIncrBy(ks, key, increment)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Sadd(ctx context.Context, key string, members ...string) (n int, err error) {
+	err = b.update(ctx, func(ks keyspace) error {
+		n, err = ksSadd(ks, key, members...)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Srem(ctx context.Context, key string, members ...string) (n int, err error) {
+	err = b.update(ctx, func(ks keyspace) error {
+		n, err = ksSrem(ks, key, members...)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Sismember(ctx context.Context, key string, member string) (ok bool, err error) {
+	err = b.view(ctx, func(ks keyspace) error {
+		ok, err = ksSismember(ks, key, member)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Smembers(ctx context.Context, key string) (members []string, err error) {
+	err = b.view(ctx, func(ks keyspace) error {
+		members, err = ksSmembers(ks, key)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Scard(ctx context.Context, key string) (n int, err error) {
+	err = b.view(ctx, func(ks keyspace) error {
+		n, err = ksScard(ks, key)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Zadd(ctx context.Context, key string, score float64, member string) (n int, err error) {
+	err = b.update(ctx, func(ks keyspace) error {
+		n, err = ksZadd(ks, key, score, member)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Zrem(ctx context.Context, key string, members ...string) (n int, err error) {
+	err = b.update(ctx, func(ks keyspace) error {
+		n, err = ksZrem(ks, key, members...)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Zscore(ctx context.Context, key string, member string) (score float64, err error) {
+	err = b.view(ctx, func(ks keyspace) error {
+		score, err = ksZscore(ks, key, member)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Zcard(ctx context.Context, key string) (n int, err error) {
+	err = b.view(ctx, func(ks keyspace) error {
+		n, err = ksZcard(ks, key)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Zrevrange(ctx context.Context, key string, start, stop int) (members []ScoredMember, err error) {
+	err = b.view(ctx, func(ks keyspace) error {
+		members, err = ksZrevrange(ks, key, start, stop)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) ZrevrangeByScore(ctx context.Context, key string, max, min float64) (members []ScoredMember, err error) {
+	err = b.view(ctx, func(ks keyspace) error {
+		members, err = ksZrevrangeByScore(ks, key, max, min)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Lpop(ctx context.Context, key string) (value string, err error) {
+	err = b.update(ctx, func(ks keyspace) error {
+		value, err = ksLpop(ks, key)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Rpush(ctx context.Context, key string, values ...string) error {
+	return b.update(ctx, func(ks keyspace) error {
+		return ksRpush(ks, key, values...)
+	})
+}
+
+func (b *BoltStore) Lrange(ctx context.Context, key string, start, stop int) (values []string, err error) {
+	err = b.view(ctx, func(ks keyspace) error {
+		values, err = ksLrange(ks, key, start, stop)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Len(ctx context.Context, key string) (n int, err error) {
+	err = b.view(ctx, func(ks keyspace) error {
+		n, err = ksLen(ks, key)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) RpopLpush(ctx context.Context, source, destination string) (value string, err error) {
+	err = b.update(ctx, func(ks keyspace) error {
+		value, err = ksRpopLpush(ks, source, destination)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Lmove(ctx context.Context, source, destination string) (value string, err error) {
+	err = b.update(ctx, func(ks keyspace) error {
+		value, err = ksLmove(ks, source, destination)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Lrem(ctx context.Context, key string, count int, value string) (n int, err error) {
+	err = b.update(ctx, func(ks keyspace) error {
+		n, err = ksLrem(ks, key, count, value)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) Hmset(ctx context.Context, key string, hash map[string]string) error {
+	return b.update(ctx, func(ks keyspace) error {
+		return ksHmset(ks, key, hash)
+	})
+}
+
+func (b *BoltStore) Hgetall(ctx context.Context, key string) (hash map[string]string, err error) {
+	err = b.view(ctx, func(ks keyspace) error {
+		hash, err = ksHgetall(ks, key)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) HincrBy(ctx context.Context, key, field string, increment int64) (value int64, err error) {
+	err = b.update(ctx, func(ks keyspace) error {
+		value, err = ksHincrBy(ks, key, field, increment)
+		return err
+	})
+	return
+}
+
+//批量写入在同一个事务中执行，任一命令出错时整体回滚
+func (b *BoltStore) Pipelined(ctx context.Context, fn func(pipe Pipeliner)) error {
+	batch := &keyspaceBatch{}
+	fn(batch)
+	return b.update(ctx, batch.exec)
+}
@@ -0,0 +1,352 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	CLUSTER_SLOTS         = 16384
+	CLUSTER_MAX_REDIRECTS = 5
+)
+
+/*
+*redis集群执行器，按key的槽位路由到主节点
+*收到MOVED或连接出错时重新拉取槽位分布，集群故障转移后无需重启
+ */
+type clusterExecutor struct {
+	lock    sync.RWMutex
+	options RedisOptions
+	seeds   []string
+	slots   []string
+	pools   map[string]*redis.Pool
+}
+
+func newClusterExecutor(options RedisOptions) *clusterExecutor {
+	return &clusterExecutor{options: options, seeds: options.Addrs, pools: make(map[string]*redis.Pool)}
+}
+
+func (c *clusterExecutor) getPool(addr string) *redis.Pool {
+	c.lock.RLock()
+	pool := c.pools[addr]
+	c.lock.RUnlock()
+	if pool != nil {
+		return pool
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pool = c.pools[addr]
+	if pool == nil {
+		dialOptions := c.options.dialOptions(c.options.Password)
+		pool = newRedisPool(c.options, func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, dialOptions...)
+		}, nil)
+		c.pools[addr] = pool
+	}
+	return pool
+}
+
+//返回key所在槽位的主节点地址，尚未拉取槽位时先拉取
+func (c *clusterExecutor) nodeForKey(ctx context.Context, key string) (string, error) {
+	slot := keySlot(key)
+	c.lock.RLock()
+	var addr string
+	if c.slots != nil {
+		addr = c.slots[slot]
+	}
+	c.lock.RUnlock()
+	if addr != "" {
+		return addr, nil
+	}
+	err := c.refresh(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	addr = c.slots[slot]
+	if addr == "" {
+		return "", errors.New("cluster slot " + strconv.Itoa(slot) + " not served")
+	}
+	return addr, nil
+}
+
+//依次向已知节点与种子节点查询CLUSTER SLOTS，使用第一个成功的结果
+func (c *clusterExecutor) refresh(ctx context.Context) error {
+	c.lock.RLock()
+	addrs := make([]string, 0, len(c.pools)+len(c.seeds))
+	addrs = append(addrs, c.seeds...)
+	for addr := range c.pools {
+		addrs = append(addrs, addr)
+	}
+	c.lock.RUnlock()
+	var lastErr error
+	for _, addr := range addrs {
+		slots, err := c.fetchSlots(ctx, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.lock.Lock()
+		c.slots = slots
+		c.lock.Unlock()
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no cluster node available")
+	}
+	return lastErr
+}
+
+func (c *clusterExecutor) fetchSlots(ctx context.Context, addr string) ([]string, error) {
+	conn, err := c.getPool(addr).GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ranges, err := redis.Values(doWithContext(ctx, conn, "CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	queryHost, _, _ := net.SplitHostPort(addr)
+	slots := make([]string, CLUSTER_SLOTS)
+	for _, r := range ranges {
+		fields, err := redis.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return nil, errors.New("invalid CLUSTER SLOTS reply")
+		}
+		start, err1 := redis.Int(fields[0], nil)
+		end, err2 := redis.Int(fields[1], nil)
+		master, err3 := redis.Values(fields[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(master) < 2 || start < 0 || end >= CLUSTER_SLOTS {
+			return nil, errors.New("invalid CLUSTER SLOTS reply")
+		}
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		//节点未声明地址时使用查询节点的地址
+		if host == "" {
+			host = queryHost
+		}
+		nodeAddr := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = nodeAddr
+		}
+	}
+	return slots, nil
+}
+
+func (c *clusterExecutor) do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	addr, err := c.nodeForKey(ctx, commandKey(args))
+	if err != nil {
+		return nil, err
+	}
+	asking := false
+	for i := 0; i < CLUSTER_MAX_REDIRECTS; i++ {
+		reply, err := c.doOn(ctx, addr, asking, cmd, args...)
+		target, ask, ok := parseRedirect(err)
+		if !ok {
+			if isConnError(err) {
+				c.refresh(ctx)
+			}
+			return reply, err
+		}
+		if !ask {
+			c.refresh(ctx)
+		}
+		addr = target
+		asking = ask
+	}
+	return nil, errors.New("too many cluster redirects for " + cmd)
+}
+
+func (c *clusterExecutor) doOn(ctx context.Context, addr string, asking bool, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := c.getPool(addr).GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if asking {
+		_, err = doWithContext(ctx, conn, "ASKING")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doWithContext(ctx, conn, cmd, args...)
+}
+
+//命令按节点分组发送，被重定向的命令单独重试
+func (c *clusterExecutor) pipeline(ctx context.Context, cmds []redisCommand) error {
+	groups := make(map[string][]redisCommand)
+	order := make([]string, 0)
+	for _, cmd := range cmds {
+		addr, err := c.nodeForKey(ctx, commandKey(cmd.args))
+		if err != nil {
+			return err
+		}
+		if _, ok := groups[addr]; !ok {
+			order = append(order, addr)
+		}
+		groups[addr] = append(groups[addr], cmd)
+	}
+	var firstErr error
+	for _, addr := range order {
+		err := c.pipelineOn(ctx, addr, groups[addr])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (c *clusterExecutor) pipelineOn(ctx context.Context, addr string, cmds []redisCommand) error {
+	conn, err := c.getPool(addr).GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	replies, err := sendPipeline(ctx, conn, cmds)
+	conn.Close()
+	if err != nil {
+		if isConnError(err) {
+			c.refresh(ctx)
+		}
+		return err
+	}
+	var firstErr error
+	for i, reply := range replies {
+		replyErr, ok := reply.(redis.Error)
+		if !ok {
+			continue
+		}
+		if _, _, redirect := parseRedirect(replyErr); redirect {
+			_, replyErr := c.do(ctx, cmds[i].name, cmds[i].args...)
+			if replyErr != nil && firstErr == nil {
+				firstErr = replyErr
+			}
+			continue
+		}
+		if firstErr == nil {
+			firstErr = replyErr
+		}
+	}
+	return firstErr
+}
+
+//在每个主节点上执行SCAN
+func (c *clusterExecutor) scan(ctx context.Context, pattern string) ([]string, error) {
+	err := c.refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.RLock()
+	masters := make(map[string]bool)
+	for _, addr := range c.slots {
+		if addr != "" {
+			masters[addr] = true
+		}
+	}
+	c.lock.RUnlock()
+	keys := make([]string, 0)
+	for addr := range masters {
+		conn, err := c.getPool(addr).GetContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		nodeKeys, err := scanKeys(ctx, conn, pattern)
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, nodeKeys...)
+	}
+	return keys, nil
+}
+
+func (c *clusterExecutor) close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var firstErr error
+	for addr, pool := range c.pools {
+		err := pool.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.pools, addr)
+	}
+	return firstErr
+}
+
+//所有命令的第一个参数为key
+func commandKey(args []interface{}) string {
+	if len(args) == 0 {
+		return ""
+	}
+	switch key := args[0].(type) {
+	case string:
+		return key
+	case []byte:
+		return string(key)
+	default:
+		return ""
+	}
+}
+
+//解析MOVED与ASK重定向，返回目标节点地址及是否为ASK
+func parseRedirect(err error) (string, bool, bool) {
+	replyErr, ok := err.(redis.Error)
+	if !ok {
+		return "", false, false
+	}
+	fields := strings.Fields(string(replyErr))
+	if len(fields) != 3 {
+		return "", false, false
+	}
+	switch fields[0] {
+	case "MOVED":
+		return fields[2], false, true
+	case "ASK":
+		return fields[2], true, true
+	default:
+		return "", false, false
+	}
+}
+
+func isConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(redis.Error); ok {
+		return false
+	}
+	return err != context.Canceled && err != context.DeadlineExceeded
+}
+
+//key的槽位，存在非空的{}时只计算其中的部分，与redis集群一致
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % CLUSTER_SLOTS)
+}
+
+//CRC16-CCITT(XMODEM)
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
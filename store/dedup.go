@@ -0,0 +1,60 @@
+package store
+
+import (
+	"context"
+	"fproxy/core"
+	"time"
+)
+
+const DEFAULT_DEDUP_TTL = time.Hour
+
+/*
+*候选代理去重，已在任一匿名级别池中或ttl内已入队的代理不再进入检测队列，池中的代理由评分池复检
+ */
+type Deduper struct {
+	Store ProxyStore
+	TTL   time.Duration
+}
+
+func NewDeduper(proxyStore ProxyStore, ttl time.Duration) *Deduper {
+	if ttl <= 0 {
+		ttl = DEFAULT_DEDUP_TTL
+	}
+	return &Deduper{Store: proxyStore, TTL: ttl}
+}
+
+//返回需要检测的代理及被过滤的数量，出错时剩余代理不过滤直接返回
+func (d *Deduper) Filter(ctx context.Context, proxies []core.Proxy) ([]core.Proxy, int, error) {
+	fresh := make([]core.Proxy, 0, len(proxies))
+	for i, proxy := range proxies {
+		addr := proxy.Addr()
+		pooled, err := d.pooled(ctx, addr)
+		if err != nil {
+			return append(fresh, proxies[i:]...), i - len(fresh), err
+		}
+		if pooled {
+			continue
+		}
+		ok, err := d.Store.SetNX(ctx, core.GetProxySeenKey(addr), proxy.Source, d.TTL)
+		if err != nil {
+			return append(fresh, proxies[i:]...), i - len(fresh), err
+		}
+		if ok {
+			fresh = append(fresh, proxy)
+		}
+	}
+	return fresh, len(proxies) - len(fresh), nil
+}
+
+func (d *Deduper) pooled(ctx context.Context, addr string) (bool, error) {
+	for _, pool := range core.ANONYMITY_POOLS {
+		_, err := d.Store.Zscore(ctx, pool, addr)
+		if err == nil {
+			return true, nil
+		}
+		if err != ErrNil {
+			return false, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"fproxy/core"
+	"testing"
+	"time"
+)
+
+func TestStoreSetNX(t *testing.T) {
+	testStores(t, func(t *testing.T, s ProxyStore) {
+		if ok, err := s.SetNX(ctx, "seen", "1", 20*time.Millisecond); err != nil || !ok {
+			t.Fatalf("setnx = %v, %v", ok, err)
+		}
+		if ok, _ := s.SetNX(ctx, "seen", "2", time.Minute); ok {
+			t.Errorf("setnx overwrote existing key")
+		}
+		if n, err := s.IncrBy(ctx, "seen", 5); err != nil || n != 6 {
+			t.Errorf("incrby = %d, %v", n, err)
+		}
+		time.Sleep(40 * time.Millisecond)
+		if _, err := s.Get(ctx, "seen"); err != ErrNil {
+			t.Errorf("expired key still readable: %v", err)
+		}
+		if ok, _ := s.SetNX(ctx, "seen", "3", 0); !ok {
+			t.Errorf("setnx after expiry not written")
+		}
+		if v, _ := s.Get(ctx, "seen"); v != "3" {
+			t.Errorf("get = %q", v)
+		}
+	})
+}
+
+func TestDeduperFilter(t *testing.T) {
+	testStores(t, func(t *testing.T, s ProxyStore) {
+		valid := core.NewProxy("1.1.1.1", 80, core.PROXY_SOURCE_CRAW, "")
+		s.Zadd(ctx, core.PROXY_POOL_VALID, 50, valid.Addr())
+		transparent := core.NewProxy("3.3.3.3", 3128, core.PROXY_SOURCE_SCAN, "")
+		s.Zadd(ctx, core.PROXY_POOL_TRANSPARENT, 10, transparent.Addr())
+		fresh := core.NewProxy("2.2.2.2", 8080, core.PROXY_SOURCE_SCAN, "")
+		dedup := NewDeduper(s, time.Minute)
+		proxies, suppressed, err := dedup.Filter(ctx, []core.Proxy{valid, transparent, fresh, fresh})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(proxies) != 1 || proxies[0].Addr() != fresh.Addr() || suppressed != 3 {
+			t.Errorf("filter = %v, suppressed %d", proxies, suppressed)
+		}
+		proxies, suppressed, _ = dedup.Filter(ctx, []core.Proxy{fresh})
+		if len(proxies) != 0 || suppressed != 1 {
+			t.Errorf("seen proxy not suppressed: %v, %d", proxies, suppressed)
+		}
+	})
+}
@@ -0,0 +1,721 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ENTRY_TYPE_STRING = "string"
+	ENTRY_TYPE_LIST   = "list"
+	ENTRY_TYPE_SET    = "set"
+	ENTRY_TYPE_HASH   = "hash"
+	ENTRY_TYPE_ZSET   = "zset"
+)
+
+//清理过期键的间隔，过期后不再读取的键如去重标记、统计桶只能靠清理删除
+const EXPIRE_SWEEP_INTERVAL = time.Minute
+
+/*
+*内存与本地文件存储共用的键值数据结构，语义与redis保持一致
+ */
+type entry struct {
+	Type string
+	Str  string             `json:",omitempty"`
+	List []string           `json:",omitempty"`
+	Set  map[string]bool    `json:",omitempty"`
+	Hash map[string]string  `json:",omitempty"`
+	Zset map[string]float64 `json:",omitempty"`
+	//过期时间，unix毫秒，0表示不过期
+	ExpireAt int64 `json:",omitempty"`
+}
+
+//过期的键在读取时视为不存在
+func (e *entry) expired(now time.Time) bool {
+	return e.ExpireAt > 0 && e.ExpireAt <= now.UnixNano()/int64(time.Millisecond)
+}
+
+type keyspace interface {
+	get(key string) *entry
+	put(key string, e *entry)
+	remove(key string)
+	//全部未过期的key
+	keys() []string
+	//删除全部过期的键，返回删除的数量
+	sweep(now time.Time) int
+}
+
+func lookup(ks keyspace, key, entryType string) (*entry, error) {
+	e := ks.get(key)
+	if e == nil {
+		return nil, nil
+	}
+	if e.Type != entryType {
+		return nil, ErrWrongType
+	}
+	return e, nil
+}
+
+func lookupOrCreate(ks keyspace, key, entryType string) (*entry, error) {
+	e, err := lookup(ks, key, entryType)
+	if err != nil || e != nil {
+		return e, err
+	}
+	e = &entry{Type: entryType}
+	switch entryType {
+	case ENTRY_TYPE_SET:
+		e.Set = make(map[string]bool)
+	case ENTRY_TYPE_HASH:
+		e.Hash = make(map[string]string)
+	case ENTRY_TYPE_ZSET:
+		e.Zset = make(map[string]float64)
+	}
+	return e, nil
+}
+
+func ksSet(ks keyspace, key, value string) {
+	ks.put(key, &entry{Type: ENTRY_TYPE_STRING, Str: value})
+}
+
+//键不存在时写入并设置过期时间，返回是否写入
+func ksSetNX(ks keyspace, key, value string, ttl time.Duration) bool {
+	if ks.get(key) != nil {
+		return false
+	}
+	e := &entry{Type: ENTRY_TYPE_STRING, Str: value}
+	if ttl > 0 {
+		e.ExpireAt = time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+	}
+	ks.put(key, e)
+	return true
+}
+
+func ksGet(ks keyspace, key string) (string, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_STRING)
+	if err != nil {
+		return "", err
+	}
+	if e == nil {
+		return "", ErrNil
+	}
+	return e.Str, nil
+}
+
+func ksKeys(ks keyspace, pattern string) []string {
+	keys := make([]string, 0)
+	for _, key := range ks.keys() {
+		if globMatch(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func ksExpire(ks keyspace, key string, ttl time.Duration) bool {
+	e := ks.get(key)
+	if e == nil {
+		return false
+	}
+	if ttl <= 0 {
+		ks.remove(key)
+		return true
+	}
+	e.ExpireAt = time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+	ks.put(key, e)
+	return true
+}
+
+func ksRename(ks keyspace, key, newkey string) error {
+	e := ks.get(key)
+	if e == nil {
+		return errors.New("store: no such key")
+	}
+	ks.remove(key)
+	ks.put(newkey, e)
+	return nil
+}
+
+func ksIncr(ks keyspace, key string) (int64, error) {
+	return ksIncrBy(ks, key, 1)
+}
+
+//与redis一致，自增不改变键的过期时间
+func ksIncrBy(ks keyspace, key string, increment int64) (int64, error) {
+	e, err := lookupOrCreate(ks, key, ENTRY_TYPE_STRING)
+	if err != nil {
+		return 0, err
+	}
+	var value int64
+	if e.Str != "" {
+		value, err = strconv.ParseInt(e.Str, 10, 64)
+		if err != nil {
+			return 0, errors.New("store: value is not an integer")
+		}
+	}
+	value += increment
+	e.Str = strconv.FormatInt(value, 10)
+	ks.put(key, e)
+	return value, nil
+}
+
+func ksSadd(ks keyspace, key string, members ...string) (int, error) {
+	if len(members) == 0 {
+		return 0, nil
+	}
+	e, err := lookupOrCreate(ks, key, ENTRY_TYPE_SET)
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	for _, member := range members {
+		if !e.Set[member] {
+			e.Set[member] = true
+			added++
+		}
+	}
+	ks.put(key, e)
+	return added, nil
+}
+
+func ksSrem(ks keyspace, key string, members ...string) (int, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_SET)
+	if err != nil || e == nil {
+		return 0, err
+	}
+	removed := 0
+	for _, member := range members {
+		if e.Set[member] {
+			delete(e.Set, member)
+			removed++
+		}
+	}
+	if len(e.Set) == 0 {
+		ks.remove(key)
+	} else {
+		ks.put(key, e)
+	}
+	return removed, nil
+}
+
+func ksSismember(ks keyspace, key, member string) (bool, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_SET)
+	if err != nil || e == nil {
+		return false, err
+	}
+	return e.Set[member], nil
+}
+
+func ksScard(ks keyspace, key string) (int, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_SET)
+	if err != nil || e == nil {
+		return 0, err
+	}
+	return len(e.Set), nil
+}
+
+func ksSmembers(ks keyspace, key string) ([]string, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_SET)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(e.Set))
+	for member := range e.Set {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func ksLpop(ks keyspace, key string) (string, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_LIST)
+	if err != nil {
+		return "", err
+	}
+	if e == nil || len(e.List) == 0 {
+		return "", ErrNil
+	}
+	value := e.List[0]
+	e.List = e.List[1:]
+	storeList(ks, key, e)
+	return value, nil
+}
+
+func ksRpop(ks keyspace, key string) (string, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_LIST)
+	if err != nil {
+		return "", err
+	}
+	if e == nil || len(e.List) == 0 {
+		return "", ErrNil
+	}
+	last := len(e.List) - 1
+	value := e.List[last]
+	e.List = e.List[:last]
+	storeList(ks, key, e)
+	return value, nil
+}
+
+func ksRpush(ks keyspace, key string, values ...string) error {
+	if len(values) == 0 {
+		return nil
+	}
+	e, err := lookupOrCreate(ks, key, ENTRY_TYPE_LIST)
+	if err != nil {
+		return err
+	}
+	e.List = append(e.List, values...)
+	ks.put(key, e)
+	return nil
+}
+
+func ksLpush(ks keyspace, key string, value string) error {
+	e, err := lookupOrCreate(ks, key, ENTRY_TYPE_LIST)
+	if err != nil {
+		return err
+	}
+	e.List = append([]string{value}, e.List...)
+	ks.put(key, e)
+	return nil
+}
+
+func ksLrange(ks keyspace, key string, start, stop int) ([]string, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_LIST)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	start, stop = normalizeRange(len(e.List), start, stop)
+	values := make([]string, 0)
+	for i := start; i <= stop; i++ {
+		values = append(values, e.List[i])
+	}
+	return values, nil
+}
+
+func ksLen(ks keyspace, key string) (int, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_LIST)
+	if err != nil || e == nil {
+		return 0, err
+	}
+	return len(e.List), nil
+}
+
+func ksRpopLpush(ks keyspace, source, destination string) (string, error) {
+	value, err := ksRpop(ks, source)
+	if err != nil {
+		return "", err
+	}
+	return value, ksLpush(ks, destination, value)
+}
+
+//取出source头部元素并追加到destination尾部，即LMOVE source destination LEFT RIGHT
+func ksLmove(ks keyspace, source, destination string) (string, error) {
+	_, err := lookup(ks, destination, ENTRY_TYPE_LIST)
+	if err != nil {
+		return "", err
+	}
+	value, err := ksLpop(ks, source)
+	if err != nil {
+		return "", err
+	}
+	return value, ksRpush(ks, destination, value)
+}
+
+//count大于0时从头部删除，小于0时从尾部删除，等于0时全部删除
+func ksLrem(ks keyspace, key string, count int, value string) (int, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_LIST)
+	if err != nil || e == nil {
+		return 0, err
+	}
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	removed := 0
+	kept := make([]string, 0, len(e.List))
+	if count >= 0 {
+		for _, v := range e.List {
+			if v == value && (limit == 0 || removed < limit) {
+				removed++
+				continue
+			}
+			kept = append(kept, v)
+		}
+	} else {
+		for i := len(e.List) - 1; i >= 0; i-- {
+			v := e.List[i]
+			if v == value && removed < limit {
+				removed++
+				continue
+			}
+			kept = append([]string{v}, kept...)
+		}
+	}
+	e.List = kept
+	storeList(ks, key, e)
+	return removed, nil
+}
+
+func ksHmset(ks keyspace, key string, hash map[string]string) error {
+	e, err := lookupOrCreate(ks, key, ENTRY_TYPE_HASH)
+	if err != nil {
+		return err
+	}
+	for field, value := range hash {
+		e.Hash[field] = value
+	}
+	ks.put(key, e)
+	return nil
+}
+
+func ksHincrBy(ks keyspace, key, field string, increment int64) (int64, error) {
+	e, err := lookupOrCreate(ks, key, ENTRY_TYPE_HASH)
+	if err != nil {
+		return 0, err
+	}
+	var value int64
+	if text, ok := e.Hash[field]; ok {
+		value, err = strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return 0, errors.New("store: hash value is not an integer")
+		}
+	}
+	value += increment
+	e.Hash[field] = strconv.FormatInt(value, 10)
+	ks.put(key, e)
+	return value, nil
+}
+
+func ksHgetall(ks keyspace, key string) (map[string]string, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_HASH)
+	if err != nil {
+		return nil, err
+	}
+	hash := make(map[string]string)
+	if e == nil {
+		return hash, nil
+	}
+	for field, value := range e.Hash {
+		hash[field] = value
+	}
+	return hash, nil
+}
+
+func ksZadd(ks keyspace, key string, score float64, member string) (int, error) {
+	e, err := lookupOrCreate(ks, key, ENTRY_TYPE_ZSET)
+	if err != nil {
+		return 0, err
+	}
+	_, exists := e.Zset[member]
+	e.Zset[member] = score
+	ks.put(key, e)
+	if exists {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+func ksZrem(ks keyspace, key string, members ...string) (int, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_ZSET)
+	if err != nil || e == nil {
+		return 0, err
+	}
+	removed := 0
+	for _, member := range members {
+		if _, ok := e.Zset[member]; ok {
+			delete(e.Zset, member)
+			removed++
+		}
+	}
+	if len(e.Zset) == 0 {
+		ks.remove(key)
+	} else {
+		ks.put(key, e)
+	}
+	return removed, nil
+}
+
+func ksZscore(ks keyspace, key, member string) (float64, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_ZSET)
+	if err != nil {
+		return 0, err
+	}
+	if e == nil {
+		return 0, ErrNil
+	}
+	score, ok := e.Zset[member]
+	if !ok {
+		return 0, ErrNil
+	}
+	return score, nil
+}
+
+func ksZcard(ks keyspace, key string) (int, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_ZSET)
+	if err != nil || e == nil {
+		return 0, err
+	}
+	return len(e.Zset), nil
+}
+
+func ksZrevrange(ks keyspace, key string, start, stop int) ([]ScoredMember, error) {
+	members, err := sortedMembers(ks, key)
+	if err != nil || members == nil {
+		return nil, err
+	}
+	start, stop = normalizeRange(len(members), start, stop)
+	if stop < start {
+		return []ScoredMember{}, nil
+	}
+	return members[start : stop+1], nil
+}
+
+func ksZrevrangeByScore(ks keyspace, key string, max, min float64) ([]ScoredMember, error) {
+	members, err := sortedMembers(ks, key)
+	if err != nil || members == nil {
+		return nil, err
+	}
+	result := make([]ScoredMember, 0)
+	for _, member := range members {
+		if member.Score <= max && member.Score >= min {
+			result = append(result, member)
+		}
+	}
+	return result, nil
+}
+
+//按评分从高到低排序，评分相同时按成员逆序，与redis一致
+func sortedMembers(ks keyspace, key string) ([]ScoredMember, error) {
+	e, err := lookup(ks, key, ENTRY_TYPE_ZSET)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	members := make([]ScoredMember, 0, len(e.Zset))
+	for member, score := range e.Zset {
+		members = append(members, ScoredMember{Member: member, Score: score})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Score != members[j].Score {
+			return members[i].Score > members[j].Score
+		}
+		return members[i].Member > members[j].Member
+	})
+	return members, nil
+}
+
+/*
+*内存与本地文件存储的批量写入，命令按顺序在同一把锁或同一个事务中执行
+ */
+type keyspaceBatch struct {
+	ops []func(ks keyspace) error
+}
+
+func (b *keyspaceBatch) add(op func(ks keyspace) error) {
+	b.ops = append(b.ops, op)
+}
+
+func (b *keyspaceBatch) exec(ks keyspace) error {
+	for _, op := range b.ops {
+		err := op(ks)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *keyspaceBatch) Set(key string, value string) {
+	b.add(func(ks keyspace) error {
+		ksSet(ks, key, value)
+		return nil
+	})
+}
+
+func (b *keyspaceBatch) Del(key string) {
+	b.add(func(ks keyspace) error {
+		ks.remove(key)
+		return nil
+	})
+}
+
+func (b *keyspaceBatch) Incr(key string) {
+	b.add(func(ks keyspace) error {
+		_, err := ksIncr(ks, key)
+		return err
+	})
+}
+
+func (b *keyspaceBatch) Sadd(key string, members ...string) {
+	b.add(func(ks keyspace) error {
+		_, err := ksSadd(ks, key, members...)
+		return err
+	})
+}
+
+func (b *keyspaceBatch) Srem(key string, members ...string) {
+	b.add(func(ks keyspace) error {
+		_, err := ksSrem(ks, key, members...)
+		return err
+	})
+}
+
+func (b *keyspaceBatch) Zadd(key string, score float64, member string) {
+	b.add(func(ks keyspace) error {
+		_, err := ksZadd(ks, key, score, member)
+		return err
+	})
+}
+
+func (b *keyspaceBatch) Zrem(key string, members ...string) {
+	b.add(func(ks keyspace) error {
+		_, err := ksZrem(ks, key, members...)
+		return err
+	})
+}
+
+func (b *keyspaceBatch) Rpush(key string, values ...string) {
+	b.add(func(ks keyspace) error {
+		return ksRpush(ks, key, values...)
+	})
+}
+
+func (b *keyspaceBatch) Lrem(key string, count int, value string) {
+	b.add(func(ks keyspace) error {
+		_, err := ksLrem(ks, key, count, value)
+		return err
+	})
+}
+
+func (b *keyspaceBatch) IncrBy(key string, increment int64) {
+	b.add(func(ks keyspace) error {
+		_, err := ksIncrBy(ks, key, increment)
+		return err
+	})
+}
+
+func (b *keyspaceBatch) HincrBy(key, field string, increment int64) {
+	b.add(func(ks keyspace) error {
+		_, err := ksHincrBy(ks, key, field, increment)
+		return err
+	})
+}
+
+func (b *keyspaceBatch) Expire(key string, ttl time.Duration) {
+	b.add(func(ks keyspace) error {
+		ksExpire(ks, key, ttl)
+		return nil
+	})
+}
+
+func (b *keyspaceBatch) Hmset(key string, hash map[string]string) {
+	b.add(func(ks keyspace) error {
+		return ksHmset(ks, key, hash)
+	})
+}
+
+//空列表按redis语义删除
+func storeList(ks keyspace, key string, e *entry) {
+	if len(e.List) == 0 {
+		ks.remove(key)
+		return
+	}
+	ks.put(key, e)
+}
+
+//按redis语义处理负数下标，返回闭区间[start, stop]，空区间时stop小于start
+func normalizeRange(length, start, stop int) (int, int) {
+	if start < 0 {
+		start = length + start
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	return start, stop
+}
+
+//redis的glob匹配，支持*、?、[...]、[^...]及\转义
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				//没有闭合时按普通字符处理
+				if s[0] != '[' {
+					return false
+				}
+				s = s[1:]
+				pattern = pattern[1:]
+				continue
+			}
+			class := pattern[1 : end+1]
+			negate := len(class) > 0 && class[0] == '^'
+			if negate {
+				class = class[1:]
+			}
+			if matchClass(class, s[0]) == negate {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[end+2:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+func matchClass(class string, c byte) bool {
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= c && c <= class[i+2] {
+				return true
+			}
+			i += 2
+			continue
+		}
+		if class[i] == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,316 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type memoryKeyspace map[string]*entry
+
+func (m memoryKeyspace) get(key string) *entry {
+	e := m[key]
+	if e != nil && e.expired(time.Now()) {
+		delete(m, key)
+		return nil
+	}
+	return e
+}
+
+func (m memoryKeyspace) put(key string, e *entry) {
+	m[key] = e
+}
+
+func (m memoryKeyspace) remove(key string) {
+	delete(m, key)
+}
+
+func (m memoryKeyspace) sweep(now time.Time) int {
+	n := 0
+	for key, e := range m {
+		if e.expired(now) {
+			delete(m, key)
+			n++
+		}
+	}
+	return n
+}
+
+func (m memoryKeyspace) keys() []string {
+	now := time.Now()
+	keys := make([]string, 0, len(m))
+	for key, e := range m {
+		if !e.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+/*
+*内存存储，用于单机运行及单元测试
+ */
+type MemoryStore struct {
+	lock          sync.Mutex
+	data          memoryKeyspace
+	sweepInterval time.Duration
+	sweptAt       time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(memoryKeyspace), sweepInterval: EXPIRE_SWEEP_INTERVAL, sweptAt: time.Now()}
+}
+
+func (m *MemoryStore) with(ctx context.Context, fn func(ks keyspace) error) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	//每隔sweepInterval在一次操作中顺带清理过期键
+	if now := time.Now(); now.Sub(m.sweptAt) >= m.sweepInterval {
+		m.data.sweep(now)
+		m.sweptAt = now
+	}
+	return fn(m.data)
+}
+
+func (m *MemoryStore) Set(ctx context.Context, key string, value string) error {
+	return m.with(ctx, func(ks keyspace) error {
+		ksSet(ks, key, value)
+		return nil
+	})
+}
+
+func (m *MemoryStore) SetNX(ctx context.Context, key string, value string, ttl time.Duration) (ok bool, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		ok = ksSetNX(ks, key, value, ttl)
+		return nil
+	})
+	return
+}
+
+func (m *MemoryStore) Get(ctx context.Context, key string) (value string, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		value, err = ksGet(ks, key)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Keys(ctx context.Context, pattern string) (keys []string, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		keys = ksKeys(ks, pattern)
+		return nil
+	})
+	return
+}
+
+func (m *MemoryStore) Rename(ctx context.Context, key, newkey string) error {
+	return m.with(ctx, func(ks keyspace) error {
+		return ksRename(ks, key, newkey)
+	})
+}
+
+func (m *MemoryStore) Del(ctx context.Context, key string) error {
+	return m.with(ctx, func(ks keyspace) error {
+		ks.remove(key)
+		return nil
+	})
+}
+
+func (m *MemoryStore) Expire(ctx context.Context, key string, ttl time.Duration) (ok bool, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		ok = ksExpire(ks, key, ttl)
+		return nil
+	})
+	return
+}
+
+func (m *MemoryStore) Incr(ctx context.Context, key string) (value int64, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		value, err = ksIncr(ks, key)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) IncrBy(ctx context.Context, key string, increment int64) (value int64, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		value, err = ksIncrBy(ks, key, increment)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Sadd(ctx context.Context, key string, members ...string) (n int, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		n, err = ksSadd(ks, key, members...)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Srem(ctx context.Context, key string, members ...string) (n int, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		n, err = ksSrem(ks, key, members...)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Sismember(ctx context.Context, key string, member string) (ok bool, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		ok, err = ksSismember(ks, key, member)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Smembers(ctx context.Context, key string) (members []string, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		members, err = ksSmembers(ks, key)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Scard(ctx context.Context, key string) (n int, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		n, err = ksScard(ks, key)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Zadd(ctx context.Context, key string, score float64, member string) (n int, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		n, err = ksZadd(ks, key, score, member)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Zrem(ctx context.Context, key string, members ...string) (n int, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		n, err = ksZrem(ks, key, members...)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Zscore(ctx context.Context, key string, member string) (score float64, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		score, err = ksZscore(ks, key, member)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Zcard(ctx context.Context, key string) (n int, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		n, err = ksZcard(ks, key)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Zrevrange(ctx context.Context, key string, start, stop int) (members []ScoredMember, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		members, err = ksZrevrange(ks, key, start, stop)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) ZrevrangeByScore(ctx context.Context, key string, max, min float64) (members []ScoredMember, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		members, err = ksZrevrangeByScore(ks, key, max, min)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Lpop(ctx context.Context, key string) (value string, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		value, err = ksLpop(ks, key)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Rpush(ctx context.Context, key string, values ...string) error {
+	return m.with(ctx, func(ks keyspace) error {
+		return ksRpush(ks, key, values...)
+	})
+}
+
+func (m *MemoryStore) Lrange(ctx context.Context, key string, start, stop int) (values []string, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		values, err = ksLrange(ks, key, start, stop)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Len(ctx context.Context, key string) (n int, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		n, err = ksLen(ks, key)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) RpopLpush(ctx context.Context, source, destination string) (value string, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		value, err = ksRpopLpush(ks, source, destination)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Lmove(ctx context.Context, source, destination string) (value string, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		value, err = ksLmove(ks, source, destination)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Lrem(ctx context.Context, key string, count int, value string) (n int, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		n, err = ksLrem(ks, key, count, value)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) Hmset(ctx context.Context, key string, hash map[string]string) error {
+	return m.with(ctx, func(ks keyspace) error {
+		return ksHmset(ks, key, hash)
+	})
+}
+
+func (m *MemoryStore) Hgetall(ctx context.Context, key string) (hash map[string]string, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		hash, err = ksHgetall(ks, key)
+		return err
+	})
+	return
+}
+
+func (m *MemoryStore) HincrBy(ctx context.Context, key, field string, increment int64) (value int64, err error) {
+	err = m.with(ctx, func(ks keyspace) error {
+		value, err = ksHincrBy(ks, key, field, increment)
+		return err
+	})
+	return
+}
+
+//批量写入在同一把锁内执行，出错时已执行的命令不回滚，与redis管道一致
+func (m *MemoryStore) Pipelined(ctx context.Context, fn func(pipe Pipeliner)) error {
+	batch := &keyspaceBatch{}
+	fn(batch)
+	return m.with(ctx, batch.exec)
+}
@@ -0,0 +1,301 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+const NAMESPACE_SEPARATOR = ":"
+
+/*
+*命名空间，所有key加上前缀，多套部署可共用同一个redis
+*带hash tag的key将前缀加在tag内，集群模式下与同tag的其他key仍位于同一槽位
+ */
+type NamespaceStore struct {
+	Store     ProxyStore
+	Namespace string
+}
+
+//namespace为空时直接返回原存储
+func WithNamespace(proxyStore ProxyStore, namespace string) (ProxyStore, error) {
+	if namespace == "" {
+		return proxyStore, nil
+	}
+	err := checkNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return &NamespaceStore{Store: proxyStore, Namespace: namespace}, nil
+}
+
+//命名空间不能包含分隔符、hash tag及glob字符，避免一个命名空间成为另一个的前缀
+func checkNamespace(namespace string) error {
+	if namespace == "" {
+		return errors.New("namespace can not be empty")
+	}
+	if strings.ContainsAny(namespace, NAMESPACE_SEPARATOR+"{}*?[]\\ ") {
+		return errors.New("invalid namespace: " + namespace)
+	}
+	return nil
+}
+
+func namespaceKey(namespace, key string) string {
+	prefix := namespace + NAMESPACE_SEPARATOR
+	if strings.HasPrefix(key, "{") {
+		return "{" + prefix + key[1:]
+	}
+	return prefix + key
+}
+
+func stripNamespace(namespace, key string) string {
+	prefix := namespace + NAMESPACE_SEPARATOR
+	if strings.HasPrefix(key, "{"+prefix) {
+		return "{" + key[len(prefix)+1:]
+	}
+	return strings.TrimPrefix(key, prefix)
+}
+
+//命名空间下全部key的匹配模式
+func namespacePatterns(namespace string) []string {
+	prefix := namespace + NAMESPACE_SEPARATOR
+	return []string{prefix + "*", "{" + prefix + "*"}
+}
+
+func (n *NamespaceStore) key(key string) string {
+	return namespaceKey(n.Namespace, key)
+}
+
+func (n *NamespaceStore) Set(ctx context.Context, key string, value string) error {
+	return n.Store.Set(ctx, n.key(key), value)
+}
+
+func (n *NamespaceStore) SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	return n.Store.SetNX(ctx, n.key(key), value, ttl)
+}
+
+func (n *NamespaceStore) Get(ctx context.Context, key string) (string, error) {
+	return n.Store.Get(ctx, n.key(key))
+}
+
+//只匹配命名空间内的key，返回的key不带前缀
+func (n *NamespaceStore) Keys(ctx context.Context, pattern string) ([]string, error) {
+	keys, err := ListNamespace(ctx, n.Store, n.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]string, 0, len(keys))
+	for _, key := range keys {
+		key = stripNamespace(n.Namespace, key)
+		if globMatch(pattern, key) {
+			matched = append(matched, key)
+		}
+	}
+	sort.Strings(matched)
+	return matched, nil
+}
+
+func (n *NamespaceStore) Rename(ctx context.Context, key, newkey string) error {
+	return n.Store.Rename(ctx, n.key(key), n.key(newkey))
+}
+
+func (n *NamespaceStore) Del(ctx context.Context, key string) error {
+	return n.Store.Del(ctx, n.key(key))
+}
+
+func (n *NamespaceStore) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return n.Store.Expire(ctx, n.key(key), ttl)
+}
+
+func (n *NamespaceStore) Incr(ctx context.Context, key string) (int64, error) {
+	return n.Store.Incr(ctx, n.key(key))
+}
+
+func (n *NamespaceStore) IncrBy(ctx context.Context, key string, increment int64) (int64, error) {
+	return n.Store.IncrBy(ctx, n.key(key), increment)
+}
+
+func (n *NamespaceStore) Sadd(ctx context.Context, key string, members ...string) (int, error) {
+	return n.Store.Sadd(ctx, n.key(key), members...)
+}
+
+func (n *NamespaceStore) Srem(ctx context.Context, key string, members ...string) (int, error) {
+	return n.Store.Srem(ctx, n.key(key), members...)
+}
+
+func (n *NamespaceStore) Sismember(ctx context.Context, key string, member string) (bool, error) {
+	return n.Store.Sismember(ctx, n.key(key), member)
+}
+
+func (n *NamespaceStore) Smembers(ctx context.Context, key string) ([]string, error) {
+	return n.Store.Smembers(ctx, n.key(key))
+}
+
+func (n *NamespaceStore) Scard(ctx context.Context, key string) (int, error) {
+	return n.Store.Scard(ctx, n.key(key))
+}
+
+func (n *NamespaceStore) Zadd(ctx context.Context, key string, score float64, member string) (int, error) {
+	return n.Store.Zadd(ctx, n.key(key), score, member)
+}
+
+func (n *NamespaceStore) Zrem(ctx context.Context, key string, members ...string) (int, error) {
+	return n.Store.Zrem(ctx, n.key(key), members...)
+}
+
+func (n *NamespaceStore) Zscore(ctx context.Context, key string, member string) (float64, error) {
+	return n.Store.Zscore(ctx, n.key(key), member)
+}
+
+func (n *NamespaceStore) Zcard(ctx context.Context, key string) (int, error) {
+	return n.Store.Zcard(ctx, n.key(key))
+}
+
+func (n *NamespaceStore) Zrevrange(ctx context.Context, key string, start, stop int) ([]ScoredMember, error) {
+	return n.Store.Zrevrange(ctx, n.key(key), start, stop)
+}
+
+func (n *NamespaceStore) ZrevrangeByScore(ctx context.Context, key string, max, min float64) ([]ScoredMember, error) {
+	return n.Store.ZrevrangeByScore(ctx, n.key(key), max, min)
+}
+
+func (n *NamespaceStore) Lpop(ctx context.Context, key string) (string, error) {
+	return n.Store.Lpop(ctx, n.key(key))
+}
+
+func (n *NamespaceStore) Rpush(ctx context.Context, key string, values ...string) error {
+	return n.Store.Rpush(ctx, n.key(key), values...)
+}
+
+func (n *NamespaceStore) Lrange(ctx context.Context, key string, start, stop int) ([]string, error) {
+	return n.Store.Lrange(ctx, n.key(key), start, stop)
+}
+
+func (n *NamespaceStore) Len(ctx context.Context, key string) (int, error) {
+	return n.Store.Len(ctx, n.key(key))
+}
+
+func (n *NamespaceStore) RpopLpush(ctx context.Context, source, destination string) (string, error) {
+	return n.Store.RpopLpush(ctx, n.key(source), n.key(destination))
+}
+
+func (n *NamespaceStore) Lmove(ctx context.Context, source, destination string) (string, error) {
+	return n.Store.Lmove(ctx, n.key(source), n.key(destination))
+}
+
+func (n *NamespaceStore) Lrem(ctx context.Context, key string, count int, value string) (int, error) {
+	return n.Store.Lrem(ctx, n.key(key), count, value)
+}
+
+func (n *NamespaceStore) Hmset(ctx context.Context, key string, hash map[string]string) error {
+	return n.Store.Hmset(ctx, n.key(key), hash)
+}
+
+func (n *NamespaceStore) Hgetall(ctx context.Context, key string) (map[string]string, error) {
+	return n.Store.Hgetall(ctx, n.key(key))
+}
+
+func (n *NamespaceStore) HincrBy(ctx context.Context, key, field string, increment int64) (int64, error) {
+	return n.Store.HincrBy(ctx, n.key(key), field, increment)
+}
+
+func (n *NamespaceStore) Pipelined(ctx context.Context, fn func(pipe Pipeliner)) error {
+	return n.Store.Pipelined(ctx, func(pipe Pipeliner) {
+		fn(&namespacePipeliner{pipe: pipe, namespace: n.Namespace})
+	})
+}
+
+type namespacePipeliner struct {
+	pipe      Pipeliner
+	namespace string
+}
+
+func (p *namespacePipeliner) key(key string) string {
+	return namespaceKey(p.namespace, key)
+}
+
+func (p *namespacePipeliner) Set(key string, value string) {
+	p.pipe.Set(p.key(key), value)
+}
+
+func (p *namespacePipeliner) Del(key string) {
+	p.pipe.Del(p.key(key))
+}
+
+func (p *namespacePipeliner) Incr(key string) {
+	p.pipe.Incr(p.key(key))
+}
+
+func (p *namespacePipeliner) IncrBy(key string, increment int64) {
+	p.pipe.IncrBy(p.key(key), increment)
+}
+
+func (p *namespacePipeliner) Sadd(key string, members ...string) {
+	p.pipe.Sadd(p.key(key), members...)
+}
+
+func (p *namespacePipeliner) Srem(key string, members ...string) {
+	p.pipe.Srem(p.key(key), members...)
+}
+
+func (p *namespacePipeliner) Zadd(key string, score float64, member string) {
+	p.pipe.Zadd(p.key(key), score, member)
+}
+
+func (p *namespacePipeliner) Zrem(key string, members ...string) {
+	p.pipe.Zrem(p.key(key), members...)
+}
+
+func (p *namespacePipeliner) Rpush(key string, values ...string) {
+	p.pipe.Rpush(p.key(key), values...)
+}
+
+func (p *namespacePipeliner) Lrem(key string, count int, value string) {
+	p.pipe.Lrem(p.key(key), count, value)
+}
+
+func (p *namespacePipeliner) Hmset(key string, hash map[string]string) {
+	p.pipe.Hmset(p.key(key), hash)
+}
+
+func (p *namespacePipeliner) HincrBy(key, field string, increment int64) {
+	p.pipe.HincrBy(p.key(key), field, increment)
+}
+
+func (p *namespacePipeliner) Expire(key string, ttl time.Duration) {
+	p.pipe.Expire(p.key(key), ttl)
+}
+
+//列出命名空间下的全部key，返回的key带前缀
+func ListNamespace(ctx context.Context, proxyStore ProxyStore, namespace string) ([]string, error) {
+	err := checkNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	for _, pattern := range namespacePatterns(namespace) {
+		matched, err := proxyStore.Keys(ctx, pattern)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, matched...)
+	}
+	return keys, nil
+}
+
+//删除命名空间下的全部key，返回删除的数量
+func DropNamespace(ctx context.Context, proxyStore ProxyStore, namespace string) (int, error) {
+	keys, err := ListNamespace(ctx, proxyStore, namespace)
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		err = proxyStore.Del(ctx, key)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
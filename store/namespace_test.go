@@ -0,0 +1,94 @@
+package store
+
+import (
+	"fproxy/core"
+	"testing"
+	"time"
+)
+
+func TestNamespaceIsolation(t *testing.T) {
+	testStores(t, func(t *testing.T, s ProxyStore) {
+		staging, err := WithNamespace(s, "staging")
+		if err != nil {
+			t.Fatal(err)
+		}
+		prod, _ := WithNamespace(s, "prod")
+		staging.Zadd(ctx, core.PROXY_POOL_VALID, 10, "1.1.1.1:80")
+		prod.Zadd(ctx, core.PROXY_POOL_VALID, 20, "2.2.2.2:80")
+		members, _ := staging.Zrevrange(ctx, core.PROXY_POOL_VALID, 0, -1)
+		if len(members) != 1 || members[0].Member != "1.1.1.1:80" {
+			t.Errorf("staging pool %v", members)
+		}
+		if _, err := s.Zscore(ctx, "staging:"+core.PROXY_POOL_VALID, "1.1.1.1:80"); err != nil {
+			t.Errorf("prefixed key not written: %v", err)
+		}
+		err = prod.Pipelined(ctx, func(pipe Pipeliner) {
+			pipe.Rpush(core.PROXY_CHECK_QUEUE, "a", "b")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := NewReliableQueue(prod, core.PROXY_CHECK_QUEUE, "w", time.Minute)
+		if v, err := q.Pull(ctx); err != nil || v != "a" {
+			t.Fatalf("pull = %q, %v", v, err)
+		}
+		if n, _ := s.Len(ctx, "{prod:"+core.PROXY_CHECK_QUEUE+"}:processing:w"); n != 1 {
+			t.Errorf("processing list not namespaced inside hash tag")
+		}
+		keys, _ := prod.Keys(ctx, "*")
+		want := []string{"proxy:pool:valid", "proxy:q:check", "{proxy:q:check}:leases", "{proxy:q:check}:processing:w"}
+		if len(keys) != len(want) {
+			t.Fatalf("prod keys %q", keys)
+		}
+		for i := range want {
+			if keys[i] != want[i] {
+				t.Errorf("prod keys %q, want %q", keys, want)
+				break
+			}
+		}
+		n, err := DropNamespace(ctx, s, "prod")
+		if err != nil || n != 4 {
+			t.Errorf("drop = %d, %v", n, err)
+		}
+		if keys, _ := ListNamespace(ctx, s, "prod"); len(keys) != 0 {
+			t.Errorf("keys left after drop %q", keys)
+		}
+		if keys, _ := ListNamespace(ctx, s, "staging"); len(keys) != 1 {
+			t.Errorf("drop touched another namespace: %q", keys)
+		}
+	})
+}
+
+func TestNamespaceInvalid(t *testing.T) {
+	for _, namespace := range []string{"a:b", "{a}", "a*"} {
+		if _, err := WithNamespace(NewMemoryStore(), namespace); err == nil {
+			t.Errorf("namespace %q accepted", namespace)
+		}
+	}
+	if _, err := DropNamespace(ctx, NewMemoryStore(), ""); err == nil {
+		t.Errorf("dropping empty namespace accepted")
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "anything", true},
+		{"prod:*", "prod:proxy:pool:valid", true},
+		{"prod:*", "{prod:proxy}", false},
+		{"{prod:*", "{prod:proxy:q:check}:leases", true},
+		{"h?llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+	}
+	for _, c := range cases {
+		if globMatch(c.pattern, c.s) != c.match {
+			t.Errorf("globMatch(%q, %q) != %v", c.pattern, c.s, c.match)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+type redisCommand struct {
+	name string
+	args []interface{}
+}
+
+/*
+*redis管道，命令先缓存，Pipelined返回前由执行器一次发送
+ */
+type redisPipeline struct {
+	cmds []redisCommand
+}
+
+func (p *redisPipeline) add(name string, args ...interface{}) {
+	p.cmds = append(p.cmds, redisCommand{name: name, args: args})
+}
+
+func (p *redisPipeline) Set(key string, value string) {
+	p.add("SET", key, value)
+}
+
+func (p *redisPipeline) Del(key string) {
+	p.add("DEL", key)
+}
+
+func (p *redisPipeline) Incr(key string) {
+	p.add("INCR", key)
+}
+
+func (p *redisPipeline) IncrBy(key string, increment int64) {
+	p.add("INCRBY", key, increment)
+}
+
+func (p *redisPipeline) Sadd(key string, members ...string) {
+	if len(members) == 0 {
+		return
+	}
+	p.add("SADD", redis.Args{}.Add(key).AddFlat(members)...)
+}
+
+func (p *redisPipeline) Srem(key string, members ...string) {
+	if len(members) == 0 {
+		return
+	}
+	p.add("SREM", redis.Args{}.Add(key).AddFlat(members)...)
+}
+
+func (p *redisPipeline) Zadd(key string, score float64, member string) {
+	p.add("ZADD", key, score, member)
+}
+
+func (p *redisPipeline) Zrem(key string, members ...string) {
+	if len(members) == 0 {
+		return
+	}
+	p.add("ZREM", redis.Args{}.Add(key).AddFlat(members)...)
+}
+
+func (p *redisPipeline) Rpush(key string, values ...string) {
+	if len(values) == 0 {
+		return
+	}
+	p.add("RPUSH", redis.Args{}.Add(key).AddFlat(values)...)
+}
+
+func (p *redisPipeline) Lrem(key string, count int, value string) {
+	p.add("LREM", key, count, value)
+}
+
+func (p *redisPipeline) Hmset(key string, hash map[string]string) {
+	p.add("HMSET", redis.Args{}.Add(key).AddFlat(hash)...)
+}
+
+func (p *redisPipeline) HincrBy(key, field string, increment int64) {
+	p.add("HINCRBY", key, field, increment)
+}
+
+func (p *redisPipeline) Expire(key string, ttl time.Duration) {
+	p.add("PEXPIRE", key, int64(ttl/time.Millisecond))
+}
+
+//一次发送全部命令并读取回复，单条命令的错误包含在回复中
+func sendPipeline(ctx context.Context, conn redis.Conn, cmds []redisCommand) ([]interface{}, error) {
+	for _, cmd := range cmds {
+		err := conn.Send(cmd.name, cmd.args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return redis.Values(doWithContext(ctx, conn, ""))
+}
+
+func firstReplyError(replies []interface{}) error {
+	for _, reply := range replies {
+		if replyErr, ok := reply.(redis.Error); ok {
+			return replyErr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"context"
+	"fproxy/core"
+	"math"
+)
+
+func SaveProxy(ctx context.Context, s ProxyStore, proxy core.Proxy) error {
+	return s.Hmset(ctx, core.GetProxyDataKey(proxy.Addr()), proxy.ToHash())
+}
+
+func LoadProxy(ctx context.Context, s ProxyStore, addr string) (core.Proxy, error) {
+	hash, err := s.Hgetall(ctx, core.GetProxyDataKey(addr))
+	if err != nil {
+		return core.Proxy{}, err
+	}
+	return core.NewProxyFromHash(hash)
+}
+
+//批量读取代理记录，缺失的记录以地址补全
+func LoadProxies(ctx context.Context, s ProxyStore, addrs []string) []core.Proxy {
+	proxies := make([]core.Proxy, 0, len(addrs))
+	for _, addr := range addrs {
+		proxy, err := LoadProxy(ctx, s, addr)
+		if err != nil {
+			ip, port, perr := core.ParseProxyAddr(addr)
+			if perr != nil {
+				continue
+			}
+			proxy = core.Proxy{Ip: ip, Port: port, Anonymity: core.Unknown}
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies
+}
+
+//按评分从高到低取前n个代理
+func TopProxies(ctx context.Context, s ProxyStore, pool string, n int) ([]core.Proxy, error) {
+	if n <= 0 {
+		return []core.Proxy{}, nil
+	}
+	members, err := s.Zrevrange(ctx, pool, 0, n-1)
+	if err != nil {
+		return nil, err
+	}
+	return loadScoredProxies(ctx, s, members), nil
+}
+
+//取评分不低于minScore的代理，按评分从高到低排列
+func ProxiesAboveScore(ctx context.Context, s ProxyStore, pool string, minScore float64) ([]core.Proxy, error) {
+	members, err := s.ZrevrangeByScore(ctx, pool, math.Inf(1), minScore)
+	if err != nil {
+		return nil, err
+	}
+	return loadScoredProxies(ctx, s, members), nil
+}
+
+//代理已在评分池中时更新其评分，pool为空时忽略
+func UpdatePoolScore(ctx context.Context, s ProxyStore, pool string, proxy core.Proxy) error {
+	if pool == "" {
+		return nil
+	}
+	_, err := s.Zscore(ctx, pool, proxy.Addr())
+	if err == ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.Zadd(ctx, pool, proxy.Score, proxy.Addr())
+	return err
+}
+
+func loadScoredProxies(ctx context.Context, s ProxyStore, members []ScoredMember) []core.Proxy {
+	addrs := make([]string, len(members))
+	scores := make(map[string]float64)
+	for i, member := range members {
+		addrs[i] = member.Member
+		scores[member.Member] = member.Score
+	}
+	proxies := LoadProxies(ctx, s, addrs)
+	for i := range proxies {
+		proxies[i].Score = scores[proxies[i].Addr()]
+	}
+	return proxies
+}
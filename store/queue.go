@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	QUEUE_PROCESSING_SUFFIX = ":processing:"
+	QUEUE_LEASES_SUFFIX     = ":leases"
+	DEFAULT_VISIBILITY      = 5 * time.Minute
+)
+
+/*
+*可靠队列，取出的元素移入消费者自己的处理中列表，处理完成后确认删除
+*每个消费者在租约有序集合中记录截止时间，超时未续约的处理中列表由回收器放回队列头部
+*处理中列表与租约的key以队列名作为hash tag，集群模式下与队列位于同一槽位
+ */
+type ReliableQueue struct {
+	Store      ProxyStore
+	Queue      string
+	Consumer   string
+	Visibility time.Duration
+}
+
+func NewReliableQueue(proxyStore ProxyStore, queue, consumer string, visibility time.Duration) *ReliableQueue {
+	if visibility <= 0 {
+		visibility = DEFAULT_VISIBILITY
+	}
+	return &ReliableQueue{Store: proxyStore, Queue: queue, Consumer: consumer, Visibility: visibility}
+}
+
+//主机名与进程号组成的消费者名称，name区分同一进程内的不同工作器
+func DefaultConsumer(name string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return hostname + ":" + strconv.Itoa(os.Getpid()) + ":" + name
+}
+
+func (q *ReliableQueue) ProcessingKey() string {
+	return "{" + q.Queue + "}" + QUEUE_PROCESSING_SUFFIX + q.Consumer
+}
+
+func (q *ReliableQueue) LeasesKey() string {
+	return "{" + q.Queue + "}" + QUEUE_LEASES_SUFFIX
+}
+
+//取出队列头部元素，队列为空时返回ErrNil
+func (q *ReliableQueue) Pull(ctx context.Context) (string, error) {
+	err := q.Extend(ctx)
+	if err != nil {
+		return "", err
+	}
+	return q.Store.Lmove(ctx, q.Queue, q.ProcessingKey())
+}
+
+//续约，处理耗时较长时需在超时前调用
+func (q *ReliableQueue) Extend(ctx context.Context) error {
+	deadline := time.Now().Add(q.Visibility).Unix()
+	_, err := q.Store.Zadd(ctx, q.LeasesKey(), float64(deadline), q.ProcessingKey())
+	return err
+}
+
+func (q *ReliableQueue) Ack(ctx context.Context, value string) error {
+	_, err := q.Store.Lrem(ctx, q.ProcessingKey(), 1, value)
+	return err
+}
+
+//在批量写入中确认，结果与确认同时提交
+func (q *ReliableQueue) AckPipelined(pipe Pipeliner, value string) {
+	pipe.Lrem(q.ProcessingKey(), 1, value)
+}
+
+//放弃处理，从处理中列表移回队列尾部，稍后由消费者重新取出
+func (q *ReliableQueue) Release(ctx context.Context, value string) error {
+	return q.Store.Pipelined(ctx, func(pipe Pipeliner) {
+		pipe.Lrem(q.ProcessingKey(), 1, value)
+		pipe.Rpush(q.Queue, value)
+	})
+}
+
+//将租约已过期的处理中列表放回队列头部，返回放回的元素数
+func (q *ReliableQueue) Reap(ctx context.Context) (int, error) {
+	now := float64(time.Now().Unix())
+	expired, err := q.Store.ZrevrangeByScore(ctx, q.LeasesKey(), now, math.Inf(-1))
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, lease := range expired {
+		n, err := q.requeue(ctx, lease.Member)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		_, err = q.Store.Zrem(ctx, q.LeasesKey(), lease.Member)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+//从尾部逐个移回队列头部，保持原有顺序
+func (q *ReliableQueue) requeue(ctx context.Context, processingKey string) (int, error) {
+	n := 0
+	for {
+		_, err := q.Store.RpopLpush(ctx, processingKey, q.Queue)
+		if err == ErrNil {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
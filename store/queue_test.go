@@ -0,0 +1,83 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReliableQueueAck(t *testing.T) {
+	testStores(t, func(t *testing.T, s ProxyStore) {
+		s.Rpush(ctx, "q", "a", "b")
+		q := NewReliableQueue(s, "q", "worker-1", time.Minute)
+		v, err := q.Pull(ctx)
+		if err != nil || v != "a" {
+			t.Fatalf("pull = %q, %v", v, err)
+		}
+		if values, _ := s.Lrange(ctx, q.ProcessingKey(), 0, -1); len(values) != 1 || values[0] != "a" {
+			t.Errorf("processing list %q", values)
+		}
+		if err := q.Ack(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := s.Len(ctx, q.ProcessingKey()); n != 0 {
+			t.Errorf("processing list len %d after ack", n)
+		}
+		//租约未过期，不回收
+		if n, err := q.Reap(ctx); err != nil || n != 0 {
+			t.Errorf("reap = %d, %v", n, err)
+		}
+		v, _ = q.Pull(ctx)
+		err = s.Pipelined(ctx, func(pipe Pipeliner) {
+			pipe.Rpush("done", v)
+			q.AckPipelined(pipe, v)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := s.Len(ctx, q.ProcessingKey()); n != 0 {
+			t.Errorf("processing list len %d after pipelined ack", n)
+		}
+		if _, err := q.Pull(ctx); err != ErrNil {
+			t.Errorf("pull empty queue error %v", err)
+		}
+		s.Rpush(ctx, "q", "c")
+		v, _ = q.Pull(ctx)
+		if err := q.Release(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := s.Len(ctx, q.ProcessingKey()); n != 0 {
+			t.Errorf("processing list len %d after release", n)
+		}
+		if values, _ := s.Lrange(ctx, "q", 0, -1); len(values) != 1 || values[0] != "c" {
+			t.Errorf("released %q, want [c]", values)
+		}
+	})
+}
+
+func TestReliableQueueReap(t *testing.T) {
+	testStores(t, func(t *testing.T, s ProxyStore) {
+		s.Rpush(ctx, "q", "a", "b", "c")
+		//visibility为负数，模拟取出后进程退出、租约过期
+		crashed := &ReliableQueue{Store: s, Queue: "q", Consumer: "crashed", Visibility: -time.Minute}
+		crashed.Pull(ctx)
+		crashed.Pull(ctx)
+		alive := NewReliableQueue(s, "q", "alive", time.Minute)
+		if v, _ := alive.Pull(ctx); v != "c" {
+			t.Fatalf("alive pull = %q", v)
+		}
+		n, err := alive.Reap(ctx)
+		if err != nil || n != 2 {
+			t.Fatalf("reap = %d, %v", n, err)
+		}
+		values, _ := s.Lrange(ctx, "q", 0, -1)
+		if len(values) != 2 || values[0] != "a" || values[1] != "b" {
+			t.Errorf("requeued %q, want [a b]", values)
+		}
+		if v, _ := s.Lrange(ctx, alive.ProcessingKey(), 0, -1); len(v) != 1 {
+			t.Errorf("alive processing list reaped: %q", v)
+		}
+		if _, err := s.Zscore(ctx, alive.LeasesKey(), crashed.ProcessingKey()); err != ErrNil {
+			t.Errorf("expired lease not removed: %v", err)
+		}
+	})
+}
@@ -1,14 +1,66 @@
 package store
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"github.com/garyburd/redigo/redis"
+	"io/ioutil"
+	"math"
+	"sort"
 	"strconv"
 	"time"
 )
 
+const (
+	REDIS_MODE_STANDALONE = "standalone"
+	REDIS_MODE_SENTINEL   = "sentinel"
+	REDIS_MODE_CLUSTER    = "cluster"
+)
+
+/*
+*redis连接参数，Addrs在单机模式下为redis地址，哨兵模式下为哨兵地址，集群模式下为种子节点地址
+ */
+type RedisOptions struct {
+	Mode             string
+	Addrs            []string
+	MasterName       string
+	Password         string
+	SentinelPassword string
+	Db               int
+	MaxIdle          int
+	MaxActive        int
+	IdleTimeout      time.Duration
+	DialTimeout      time.Duration
+	//为nil时不使用TLS
+	TLSConfig *tls.Config
+}
+
+func (o RedisOptions) dialOptions(password string) []redis.DialOption {
+	options := make([]redis.DialOption, 0)
+	if password != "" {
+		options = append(options, redis.DialPassword(password))
+	}
+	if o.DialTimeout > 0 {
+		options = append(options, redis.DialConnectTimeout(o.DialTimeout))
+	}
+	if o.TLSConfig != nil {
+		options = append(options, redis.DialUseTLS(true), redis.DialTLSConfig(o.TLSConfig))
+	}
+	return options
+}
+
+//单条命令与管道的执行方式，单机、哨兵与集群各自实现
+type redisExecutor interface {
+	do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error)
+	pipeline(ctx context.Context, cmds []redisCommand) error
+	scan(ctx context.Context, pattern string) ([]string, error)
+	close() error
+}
+
 type RedisManager struct {
-	redisPool *redis.Pool
+	executor redisExecutor
 }
 
 func NewRedisManager(host string, port int, password string, db, maxIdle, maxActive int, timeout time.Duration) (*RedisManager, error) {
@@ -16,106 +68,356 @@ func NewRedisManager(host string, port int, password string, db, maxIdle, maxAct
 		return nil, errors.New("host and port can not be null")
 	}
 	dialAddr := host + ":" + strconv.Itoa(port)
-	redisPool := &redis.Pool{
-		MaxIdle:     maxIdle,
-		MaxActive:   maxActive,
-		IdleTimeout: timeout,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", dialAddr, redis.DialPassword(password), redis.DialDatabase(db))
-			if err != nil {
-				return nil, err
-			}
-			return c, nil
-		},
+	return NewRedisStore(RedisOptions{Addrs: []string{dialAddr}, Password: password, Db: db, MaxIdle: maxIdle, MaxActive: maxActive, IdleTimeout: timeout})
+}
+
+func NewRedisStore(options RedisOptions) (*RedisManager, error) {
+	if len(options.Addrs) == 0 {
+		return nil, errors.New("redis addrs can not be empty")
+	}
+	switch options.Mode {
+	case "", REDIS_MODE_STANDALONE:
+		dialOptions := append(options.dialOptions(options.Password), redis.DialDatabase(options.Db))
+		dialAddr := options.Addrs[0]
+		pool := newRedisPool(options, func() (redis.Conn, error) {
+			return redis.Dial("tcp", dialAddr, dialOptions...)
+		}, nil)
+		return &RedisManager{executor: &poolExecutor{pool: pool}}, nil
+	case REDIS_MODE_SENTINEL:
+		if options.MasterName == "" {
+			return nil, errors.New("sentinel master name can not be empty")
+		}
+		return &RedisManager{executor: newSentinelExecutor(options)}, nil
+	case REDIS_MODE_CLUSTER:
+		return &RedisManager{executor: newClusterExecutor(options)}, nil
+	default:
+		return nil, errors.New("unknown redis mode: " + options.Mode)
+	}
+}
+
+func newRedisPool(options RedisOptions, dial func() (redis.Conn, error), testOnBorrow func(c redis.Conn, t time.Time) error) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:      options.MaxIdle,
+		MaxActive:    options.MaxActive,
+		IdleTimeout:  options.IdleTimeout,
+		Dial:         dial,
+		TestOnBorrow: testOnBorrow,
+	}
+}
+
+func (r *RedisManager) Close() error {
+	return r.executor.close()
+}
+
+//执行单条命令，ctx带有截止时间时作为读超时
+func (r *RedisManager) do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return r.executor.do(ctx, cmd, args...)
+}
+
+/*
+*单机与哨兵模式共用的连接池执行器
+ */
+type poolExecutor struct {
+	pool *redis.Pool
+}
+
+func (p *poolExecutor) do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := p.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return doWithContext(ctx, conn, cmd, args...)
+}
+
+func (p *poolExecutor) pipeline(ctx context.Context, cmds []redisCommand) error {
+	conn, err := p.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	replies, err := sendPipeline(ctx, conn, cmds)
+	if err != nil {
+		return err
+	}
+	return firstReplyError(replies)
+}
+
+func (p *poolExecutor) scan(ctx context.Context, pattern string) ([]string, error) {
+	conn, err := p.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return scanKeys(ctx, conn, pattern)
+}
+
+func (p *poolExecutor) close() error {
+	return p.pool.Close()
+}
+
+func doWithContext(ctx context.Context, conn redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return conn.Do(cmd, args...)
 	}
-	return &RedisManager{redisPool: redisPool}, nil
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	return redis.DoWithTimeout(conn, timeout, cmd, args...)
 }
 
-func (r *RedisManager) getConn() redis.Conn {
-	return r.redisPool.Get()
+//SCAN遍历当前节点，返回全部匹配的key
+func scanKeys(ctx context.Context, conn redis.Conn, pattern string) ([]string, error) {
+	keys := make([]string, 0)
+	cursor := "0"
+	for {
+		values, err := redis.Values(doWithContext(ctx, conn, "SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != 2 {
+			return nil, errors.New("invalid SCAN reply")
+		}
+		cursor, err = redis.String(values[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		batch, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
 }
 
-func (r *RedisManager) releaseConn(conn redis.Conn) {
-	if conn == nil {
-		return
+//redis的空值错误转换为ErrNil
+func toStoreErr(err error) error {
+	if err == redis.ErrNil {
+		return ErrNil
 	}
-	conn.Close()
+	return err
+}
+
+func (r *RedisManager) Set(ctx context.Context, key string, value string) error {
+	_, err := r.do(ctx, "SET", key, value)
+	return err
 }
 
-func (r *RedisManager) Set(key string, value string) {
-	conn := r.getConn()
-	defer r.releaseConn(conn)
-	conn.Do("SET", key, value)
+func (r *RedisManager) SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	args := redis.Args{}.Add(key, value)
+	if ttl > 0 {
+		args = args.Add("PX", int64(ttl/time.Millisecond))
+	}
+	reply, err := r.do(ctx, "SET", args.Add("NX")...)
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
 }
 
-func (r *RedisManager) Get(key string) (string, error) {
-	conn := r.getConn()
-	defer r.releaseConn(conn)
-	return redis.String(conn.Do("GET", key))
+func (r *RedisManager) Get(ctx context.Context, key string) (string, error) {
+	value, err := redis.String(r.do(ctx, "GET", key))
+	return value, toStoreErr(err)
 }
 
-func (r *RedisManager) Sadd(key string, members ...string) (int, error) {
-	conn := r.getConn()
-	defer r.releaseConn(conn)
-	return redis.Int(conn.Do("SADD", key, members))
+func (r *RedisManager) Keys(ctx context.Context, pattern string) ([]string, error) {
+	keys, err := r.executor.scan(ctx, pattern)
+	if err != nil {
+		return nil, err
+	}
+	//SCAN可能重复返回同一个key
+	unique := make(map[string]bool, len(keys))
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !unique[key] {
+			unique[key] = true
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
 }
 
-func (r *RedisManager) Sismember(key string, member string) (bool, error) {
-	conn := r.getConn()
-	defer r.releaseConn(conn)
-	return redis.Bool(conn.Do("SISMEMBER", key, member))
+func (r *RedisManager) Rename(ctx context.Context, key, newkey string) error {
+	_, err := r.do(ctx, "RENAME", key, newkey)
+	return err
 }
 
-func (r *RedisManager) Smembers(key string) ([][]byte, error) {
-	conn := r.getConn()
-	defer r.releaseConn(conn)
-	return redis.ByteSlices(conn.Do("SMEMBERS", key))
+func (r *RedisManager) Del(ctx context.Context, key string) error {
+	_, err := r.do(ctx, "DEL", key)
+	return err
 }
 
-func (r *RedisManager) Lpop(key string) (string, error) {
-	conn := r.getConn()
-	defer r.releaseConn(conn)
-	return redis.String(conn.Do("LPOP", key))
+func (r *RedisManager) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return redis.Bool(r.do(ctx, "PEXPIRE", key, int64(ttl/time.Millisecond)))
 }
 
-func (r *RedisManager) Rpush(key string, value string) {
-	conn := r.getConn()
-	defer r.releaseConn(conn)
-	conn.Do("RPUSH", key, value)
+func (r *RedisManager) Incr(ctx context.Context, key string) (int64, error) {
+	return redis.Int64(r.do(ctx, "INCR", key))
 }
 
-func (r *RedisManager) Lrange(key string, start, stop int) ([][]byte, error) {
-	conn := r.getConn()
-	defer r.releaseConn(conn)
-	return redis.ByteSlices(conn.Do("LRANGE", key, strconv.Itoa(start), strconv.Itoa(stop)))
+func (r *RedisManager) IncrBy(ctx context.Context, key string, increment int64) (int64, error) {
+	return redis.Int64(r.do(ctx, "INCRBY", key, increment))
 }
 
-func (r *RedisManager) Len(key string) (int, error) {
-	conn := r.getConn()
-	defer r.releaseConn(conn)
-	return redis.Int(conn.Do("LEN", key))
+func (r *RedisManager) Sadd(ctx context.Context, key string, members ...string) (int, error) {
+	return redis.Int(r.do(ctx, "SADD", redis.Args{}.Add(key).AddFlat(members)...))
 }
 
-func (r *RedisManager) RpopLpush(source, destination string) {
-	conn := r.getConn()
-	defer r.releaseConn(conn)
-	conn.Do("RPOPLPUSH", source, destination)
+func (r *RedisManager) Srem(ctx context.Context, key string, members ...string) (int, error) {
+	return redis.Int(r.do(ctx, "SREM", redis.Args{}.Add(key).AddFlat(members)...))
 }
 
-func (r *RedisManager) Rename(key, newkey string) (int, error) {
-	conn := r.getConn()
-	defer r.releaseConn(conn)
-	return redis.Int(conn.Do("RENAME", key, newkey))
+func (r *RedisManager) Sismember(ctx context.Context, key string, member string) (bool, error) {
+	return redis.Bool(r.do(ctx, "SISMEMBER", key, member))
 }
 
-func (r *RedisManager) Del(key string) {
-	conn := r.getConn()
-	defer r.releaseConn(conn)
-	conn.Do("DEL", key)
+func (r *RedisManager) Smembers(ctx context.Context, key string) ([]string, error) {
+	return redis.Strings(r.do(ctx, "SMEMBERS", key))
 }
 
-func (r *RedisManager) Incr(key string) (int64, error) {
-	conn := r.getConn()
-	defer r.releaseConn(conn)
-	return redis.Int64(conn.Do("INCR", key))
+func (r *RedisManager) Scard(ctx context.Context, key string) (int, error) {
+	return redis.Int(r.do(ctx, "SCARD", key))
+}
+
+func (r *RedisManager) Zadd(ctx context.Context, key string, score float64, member string) (int, error) {
+	return redis.Int(r.do(ctx, "ZADD", key, score, member))
+}
+
+func (r *RedisManager) Zrem(ctx context.Context, key string, members ...string) (int, error) {
+	return redis.Int(r.do(ctx, "ZREM", redis.Args{}.Add(key).AddFlat(members)...))
+}
+
+func (r *RedisManager) Zscore(ctx context.Context, key string, member string) (float64, error) {
+	score, err := redis.Float64(r.do(ctx, "ZSCORE", key, member))
+	return score, toStoreErr(err)
+}
+
+func (r *RedisManager) Zcard(ctx context.Context, key string) (int, error) {
+	return redis.Int(r.do(ctx, "ZCARD", key))
+}
+
+func (r *RedisManager) Zrevrange(ctx context.Context, key string, start, stop int) ([]ScoredMember, error) {
+	return toScoredMembers(redis.Strings(r.do(ctx, "ZREVRANGE", key, start, stop, "WITHSCORES")))
+}
+
+func (r *RedisManager) ZrevrangeByScore(ctx context.Context, key string, max, min float64) ([]ScoredMember, error) {
+	return toScoredMembers(redis.Strings(r.do(ctx, "ZREVRANGEBYSCORE", key, formatScore(max), formatScore(min), "WITHSCORES")))
+}
+
+func (r *RedisManager) Lpop(ctx context.Context, key string) (string, error) {
+	value, err := redis.String(r.do(ctx, "LPOP", key))
+	return value, toStoreErr(err)
+}
+
+func (r *RedisManager) Rpush(ctx context.Context, key string, values ...string) error {
+	if len(values) == 0 {
+		return nil
+	}
+	_, err := r.do(ctx, "RPUSH", redis.Args{}.Add(key).AddFlat(values)...)
+	return err
+}
+
+func (r *RedisManager) Lrange(ctx context.Context, key string, start, stop int) ([]string, error) {
+	return redis.Strings(r.do(ctx, "LRANGE", key, start, stop))
+}
+
+func (r *RedisManager) Len(ctx context.Context, key string) (int, error) {
+	return redis.Int(r.do(ctx, "LLEN", key))
+}
+
+func (r *RedisManager) RpopLpush(ctx context.Context, source, destination string) (string, error) {
+	value, err := redis.String(r.do(ctx, "RPOPLPUSH", source, destination))
+	return value, toStoreErr(err)
+}
+
+//需要redis 6.2及以上版本
+func (r *RedisManager) Lmove(ctx context.Context, source, destination string) (string, error) {
+	value, err := redis.String(r.do(ctx, "LMOVE", source, destination, "LEFT", "RIGHT"))
+	return value, toStoreErr(err)
+}
+
+func (r *RedisManager) Lrem(ctx context.Context, key string, count int, value string) (int, error) {
+	return redis.Int(r.do(ctx, "LREM", key, count, value))
+}
+
+func (r *RedisManager) Hmset(ctx context.Context, key string, hash map[string]string) error {
+	_, err := r.do(ctx, "HMSET", redis.Args{}.Add(key).AddFlat(hash)...)
+	return err
+}
+
+func (r *RedisManager) Hgetall(ctx context.Context, key string) (map[string]string, error) {
+	return redis.StringMap(r.do(ctx, "HGETALL", key))
+}
+
+func (r *RedisManager) HincrBy(ctx context.Context, key, field string, increment int64) (int64, error) {
+	return redis.Int64(r.do(ctx, "HINCRBY", key, field, increment))
+}
+
+//批量写入通过管道一次发送，返回第一条出错命令的错误
+func (r *RedisManager) Pipelined(ctx context.Context, fn func(pipe Pipeliner)) error {
+	pipe := &redisPipeline{}
+	fn(pipe)
+	if len(pipe.cmds) == 0 {
+		return nil
+	}
+	return r.executor.pipeline(ctx, pipe.cmds)
+}
+
+func toScoredMembers(values []string, err error) ([]ScoredMember, error) {
+	if err != nil {
+		return nil, err
+	}
+	members := make([]ScoredMember, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		score, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, ScoredMember{Member: values[i], Score: score})
+	}
+	return members, nil
+}
+
+func formatScore(score float64) string {
+	if math.IsInf(score, 1) {
+		return "+inf"
+	}
+	if math.IsInf(score, -1) {
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+//根据证书文件创建TLS配置，certFile与keyFile为空时不使用客户端证书，caFile为空时使用系统根证书
+func LoadTLSConfig(certFile, keyFile, caFile, serverName string, skipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: serverName, InsecureSkipVerify: skipVerify}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		caData, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(caData) {
+			return nil, errors.New("no certificate found in " + caFile)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+	return tlsConfig, nil
 }
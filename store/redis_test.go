@@ -0,0 +1,237 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeStatus string
+
+/*
+*测试用的redis服务端，只解析请求并按handler返回
+ */
+type fakeRedis struct {
+	listener net.Listener
+	lock     sync.Mutex
+	handler  func(args []string) interface{}
+}
+
+func newFakeRedis(t *testing.T, handler func(args []string) interface{}) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{listener: listener, handler: handler}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) Addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) setHandler(handler func(args []string) interface{}) {
+	f.lock.Lock()
+	f.handler = handler
+	f.lock.Unlock()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		args, err := readFakeCommand(reader)
+		if err != nil {
+			return
+		}
+		f.lock.Lock()
+		handler := f.handler
+		f.lock.Unlock()
+		writeFakeReply(writer, handler(args))
+		if reader.Buffered() == 0 {
+			writer.Flush()
+		}
+	}
+}
+
+func readFakeCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := 0; i < n; i++ {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(reader, buf)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func writeFakeReply(writer *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		writer.WriteString("$-1\r\n")
+	case fakeStatus:
+		fmt.Fprintf(writer, "+%s\r\n", v)
+	case redis.Error:
+		fmt.Fprintf(writer, "-%s\r\n", v)
+	case int:
+		fmt.Fprintf(writer, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		fmt.Fprintf(writer, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeFakeReply(writer, item)
+		}
+	}
+}
+
+//返回固定角色与值的redis节点
+func fakeNode(role string, value string) func(args []string) interface{} {
+	return func(args []string) interface{} {
+		switch strings.ToUpper(args[0]) {
+		case "ROLE":
+			return []interface{}{role}
+		case "GET":
+			return value
+		default:
+			return fakeStatus("OK")
+		}
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	if slot := keySlot("123456789"); slot != 0x31C3 {
+		t.Errorf("slot of 123456789 = %d", slot)
+	}
+	if slot := keySlot("foo"); slot != 12182 {
+		t.Errorf("slot of foo = %d", slot)
+	}
+	if keySlot("{proxy:q:check}:processing:a") != keySlot("proxy:q:check") {
+		t.Errorf("hash tag not applied")
+	}
+	if keySlot("{}foo") != int(crc16("{}foo")%CLUSTER_SLOTS) {
+		t.Errorf("empty hash tag should hash whole key")
+	}
+}
+
+func TestSentinelFailover(t *testing.T) {
+	oldMaster := newFakeRedis(t, fakeNode("master", "old"))
+	newMaster := newFakeRedis(t, fakeNode("master", "new"))
+	masterAddr := oldMaster.Addr()
+	var lock sync.Mutex
+	sentinel := newFakeRedis(t, func(args []string) interface{} {
+		lock.Lock()
+		defer lock.Unlock()
+		if strings.ToUpper(args[0]) == "SENTINEL" && args[2] == "mymaster" {
+			host, port, _ := net.SplitHostPort(masterAddr)
+			return []interface{}{host, port}
+		}
+		return redis.Error("ERR unknown command")
+	})
+	r, err := NewRedisStore(RedisOptions{Mode: REDIS_MODE_SENTINEL, Addrs: []string{"127.0.0.1:1", sentinel.Addr()}, MasterName: "mymaster", MaxIdle: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if v, err := r.Get(ctx, "k"); err != nil || v != "old" {
+		t.Fatalf("get = %q, %v", v, err)
+	}
+	//主从切换，旧主节点降级，空闲连接在取出时被丢弃
+	lock.Lock()
+	masterAddr = newMaster.Addr()
+	lock.Unlock()
+	oldMaster.setHandler(fakeNode("slave", "old"))
+	if v, err := r.Get(ctx, "k"); err != nil || v != "new" {
+		t.Fatalf("get after failover = %q, %v", v, err)
+	}
+}
+
+func TestClusterMoved(t *testing.T) {
+	nodeB := newFakeRedis(t, fakeNode("master", "b"))
+	var lock sync.Mutex
+	owner := ""
+	slotsReply := func() interface{} {
+		lock.Lock()
+		defer lock.Unlock()
+		host, port, _ := net.SplitHostPort(owner)
+		portNum, _ := strconv.Atoi(port)
+		return []interface{}{[]interface{}{0, CLUSTER_SLOTS - 1, []interface{}{host, portNum}}}
+	}
+	nodeB.setHandler(func(args []string) interface{} {
+		if strings.ToUpper(args[0]) == "CLUSTER" {
+			return slotsReply()
+		}
+		return fakeNode("master", "b")(args)
+	})
+	nodeA := newFakeRedis(t, func(args []string) interface{} {
+		switch strings.ToUpper(args[0]) {
+		case "CLUSTER":
+			return slotsReply()
+		case "GET":
+			//槽位已迁移到B
+			lock.Lock()
+			owner = nodeB.Addr()
+			lock.Unlock()
+			return redis.Error(fmt.Sprintf("MOVED %d %s", keySlot(args[1]), nodeB.Addr()))
+		default:
+			return fakeStatus("OK")
+		}
+	})
+	lock.Lock()
+	owner = nodeA.Addr()
+	lock.Unlock()
+	r, err := NewRedisStore(RedisOptions{Mode: REDIS_MODE_CLUSTER, Addrs: []string{nodeA.Addr()}, MaxIdle: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if v, err := r.Get(ctx, "k"); err != nil || v != "b" {
+		t.Fatalf("get = %q, %v", v, err)
+	}
+	executor := r.executor.(*clusterExecutor)
+	if addr, _ := executor.nodeForKey(ctx, "k"); addr != nodeB.Addr() {
+		t.Errorf("slots not refreshed after MOVED, k served by %s", addr)
+	}
+	err = r.Pipelined(ctx, func(pipe Pipeliner) {
+		pipe.Set("k", "v")
+		pipe.Incr("n")
+	})
+	if err != nil {
+		t.Errorf("pipelined on cluster error: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+*通过哨兵查询主节点地址，每次建立连接时重新查询，主从切换后新连接自动指向新的主节点
+ */
+type sentinelResolver struct {
+	lock       sync.Mutex
+	addrs      []string
+	masterName string
+	options    []redis.DialOption
+}
+
+func (s *sentinelResolver) masterAddr() (string, error) {
+	s.lock.Lock()
+	addrs := make([]string, len(s.addrs))
+	copy(addrs, s.addrs)
+	s.lock.Unlock()
+	var lastErr error
+	for i, addr := range addrs {
+		masterAddr, err := s.queryMaster(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		//可用的哨兵移到最前，下次优先查询
+		if i > 0 {
+			s.promote(addr)
+		}
+		return masterAddr, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no sentinel available")
+	}
+	return "", lastErr
+}
+
+func (s *sentinelResolver) queryMaster(sentinelAddr string) (string, error) {
+	conn, err := redis.Dial("tcp", sentinelAddr, s.options...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	values, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.masterName))
+	if err != nil {
+		return "", err
+	}
+	if len(values) != 2 {
+		return "", errors.New("sentinel returned invalid master address for " + s.masterName)
+	}
+	return net.JoinHostPort(values[0], values[1]), nil
+}
+
+func (s *sentinelResolver) promote(addr string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, a := range s.addrs {
+		if a == addr {
+			copy(s.addrs[1:i+1], s.addrs[:i])
+			s.addrs[0] = addr
+			return
+		}
+	}
+}
+
+func newSentinelExecutor(options RedisOptions) *poolExecutor {
+	resolver := &sentinelResolver{addrs: options.Addrs, masterName: options.MasterName, options: options.dialOptions(options.SentinelPassword)}
+	dialOptions := append(options.dialOptions(options.Password), redis.DialDatabase(options.Db))
+	pool := newRedisPool(options, func() (redis.Conn, error) {
+		masterAddr, err := resolver.masterAddr()
+		if err != nil {
+			return nil, err
+		}
+		return redis.Dial("tcp", masterAddr, dialOptions...)
+	}, testMasterRole)
+	return &poolExecutor{pool: pool}
+}
+
+//取出空闲连接时确认对端仍是主节点，主从切换后旧连接被丢弃
+func testMasterRole(conn redis.Conn, t time.Time) error {
+	values, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return errors.New("empty ROLE reply")
+	}
+	role, err := redis.String(values[0], nil)
+	if err != nil {
+		return err
+	}
+	if role != "master" {
+		return errors.New("redis role is " + role + ", not master")
+	}
+	return nil
+}
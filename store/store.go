@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+//键不存在或列表为空
+var ErrNil = errors.New("store: nil")
+
+//键的类型与操作不符
+var ErrWrongType = errors.New("store: operation against a key holding the wrong kind of value")
+
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+type KVStore interface {
+	Set(ctx context.Context, key string, value string) error
+	Get(ctx context.Context, key string) (string, error)
+	//键不存在时写入，ttl大于0时设置过期时间，返回是否写入
+	SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error)
+	//按redis的glob模式列出key，redis通过SCAN遍历
+	Keys(ctx context.Context, pattern string) ([]string, error)
+	Rename(ctx context.Context, key, newkey string) error
+	Del(ctx context.Context, key string) error
+	//设置过期时间，key不存在时返回false
+	Expire(ctx context.Context, key string, ttl time.Duration) (bool, error)
+}
+
+//计数器
+type CounterStore interface {
+	Incr(ctx context.Context, key string) (int64, error)
+	IncrBy(ctx context.Context, key string, increment int64) (int64, error)
+}
+
+//代理池
+type PoolStore interface {
+	Sadd(ctx context.Context, key string, members ...string) (int, error)
+	Srem(ctx context.Context, key string, members ...string) (int, error)
+	Sismember(ctx context.Context, key string, member string) (bool, error)
+	Smembers(ctx context.Context, key string) ([]string, error)
+	Scard(ctx context.Context, key string) (int, error)
+}
+
+//带评分的代理池
+type ScoreStore interface {
+	Zadd(ctx context.Context, key string, score float64, member string) (int, error)
+	Zrem(ctx context.Context, key string, members ...string) (int, error)
+	Zscore(ctx context.Context, key string, member string) (float64, error)
+	Zcard(ctx context.Context, key string) (int, error)
+	Zrevrange(ctx context.Context, key string, start, stop int) ([]ScoredMember, error)
+	ZrevrangeByScore(ctx context.Context, key string, max, min float64) ([]ScoredMember, error)
+}
+
+//检测队列与扫描ip段队列
+type QueueStore interface {
+	Lpop(ctx context.Context, key string) (string, error)
+	Rpush(ctx context.Context, key string, values ...string) error
+	Lrange(ctx context.Context, key string, start, stop int) ([]string, error)
+	Len(ctx context.Context, key string) (int, error)
+	RpopLpush(ctx context.Context, source, destination string) (string, error)
+	Lmove(ctx context.Context, source, destination string) (string, error)
+	Lrem(ctx context.Context, key string, count int, value string) (int, error)
+}
+
+//代理记录
+type HashStore interface {
+	Hmset(ctx context.Context, key string, hash map[string]string) error
+	Hgetall(ctx context.Context, key string) (map[string]string, error)
+	HincrBy(ctx context.Context, key, field string, increment int64) (int64, error)
+}
+
+/*
+*批量写入，命令在Pipelined返回前一次提交，不返回单条命令的结果
+ */
+type Pipeliner interface {
+	Set(key string, value string)
+	Del(key string)
+	Incr(key string)
+	IncrBy(key string, increment int64)
+	Sadd(key string, members ...string)
+	Srem(key string, members ...string)
+	Zadd(key string, score float64, member string)
+	Zrem(key string, members ...string)
+	Rpush(key string, values ...string)
+	Lrem(key string, count int, value string)
+	Hmset(key string, hash map[string]string)
+	HincrBy(key, field string, increment int64)
+	Expire(key string, ttl time.Duration)
+}
+
+type BatchStore interface {
+	Pipelined(ctx context.Context, fn func(pipe Pipeliner)) error
+}
+
+/*
+*代理存储，redis、内存及本地文件实现
+ */
+type ProxyStore interface {
+	KVStore
+	CounterStore
+	PoolStore
+	ScoreStore
+	QueueStore
+	HashStore
+	BatchStore
+}
@@ -0,0 +1,275 @@
+package store
+
+import (
+	"context"
+	"fproxy/core"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestBoltStore(t *testing.T) *BoltStore {
+	dir, err := ioutil.TempDir("", "fproxy-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	boltStore, err := NewBoltStore(filepath.Join(dir, "fproxy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { boltStore.Close() })
+	return boltStore
+}
+
+var ctx = context.Background()
+
+func testStores(t *testing.T, fn func(t *testing.T, s ProxyStore)) {
+	t.Run("memory", func(t *testing.T) { fn(t, NewMemoryStore()) })
+	t.Run("bolt", func(t *testing.T) { fn(t, newTestBoltStore(t)) })
+}
+
+func TestStoreKV(t *testing.T) {
+	testStores(t, func(t *testing.T, s ProxyStore) {
+		if _, err := s.Get(ctx, "k"); err != ErrNil {
+			t.Errorf("get missing key error %v, want ErrNil", err)
+		}
+		s.Set(ctx, "k", "v")
+		if v, err := s.Get(ctx, "k"); err != nil || v != "v" {
+			t.Errorf("get k = %q, %v", v, err)
+		}
+		if err := s.Rename(ctx, "k", "k2"); err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := s.Get(ctx, "k2"); v != "v" {
+			t.Errorf("renamed value %q", v)
+		}
+		s.Del(ctx, "k2")
+		if _, err := s.Get(ctx, "k2"); err != ErrNil {
+			t.Errorf("deleted key error %v", err)
+		}
+		for i := int64(1); i <= 3; i++ {
+			if n, err := s.Incr(ctx, "c"); err != nil || n != i {
+				t.Errorf("incr = %d, %v, want %d", n, err, i)
+			}
+		}
+		if _, err := s.Sadd(ctx, "c", "x"); err != ErrWrongType {
+			t.Errorf("sadd on counter error %v, want ErrWrongType", err)
+		}
+	})
+}
+
+func TestStorePool(t *testing.T) {
+	testStores(t, func(t *testing.T, s ProxyStore) {
+		n, err := s.Sadd(ctx, core.PROXY_POOL_VALID, "1.1.1.1:80", "2.2.2.2:80", "1.1.1.1:80")
+		if err != nil || n != 2 {
+			t.Fatalf("sadd = %d, %v", n, err)
+		}
+		if ok, _ := s.Sismember(ctx, core.PROXY_POOL_VALID, "2.2.2.2:80"); !ok {
+			t.Error("2.2.2.2:80 should be a member")
+		}
+		members, err := s.Smembers(ctx, core.PROXY_POOL_VALID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs := members
+		sort.Strings(addrs)
+		if len(addrs) != 2 || addrs[0] != "1.1.1.1:80" || addrs[1] != "2.2.2.2:80" {
+			t.Errorf("members %v", addrs)
+		}
+		if n, err := s.Srem(ctx, core.PROXY_POOL_VALID, "1.1.1.1:80", "3.3.3.3:80"); err != nil || n != 1 {
+			t.Errorf("srem = %d, %v", n, err)
+		}
+		err = s.Pipelined(ctx, func(pipe Pipeliner) {
+			pipe.Srem(core.PROXY_POOL_VALID, "2.2.2.2:80")
+		})
+		if n, _ := s.Scard(ctx, core.PROXY_POOL_VALID); err != nil || n != 0 {
+			t.Errorf("scard after pipelined srem = %d, %v", n, err)
+		}
+	})
+}
+
+func TestStoreQueue(t *testing.T) {
+	testStores(t, func(t *testing.T, s ProxyStore) {
+		for _, v := range []string{"a", "b", "c"} {
+			s.Rpush(ctx, "q", v)
+		}
+		if n, _ := s.Len(ctx, "q"); n != 3 {
+			t.Errorf("len = %d", n)
+		}
+		values, _ := s.Lrange(ctx, "q", 0, -1)
+		if len(values) != 3 || values[2] != "c" {
+			t.Errorf("lrange %q", values)
+		}
+		if v, _ := s.Lpop(ctx, "q"); v != "a" {
+			t.Errorf("lpop = %q", v)
+		}
+		if v, err := s.RpopLpush(ctx, "q", "q2"); err != nil || v != "c" {
+			t.Errorf("rpoplpush = %q, %v", v, err)
+		}
+		if v, _ := s.Lpop(ctx, "q2"); v != "c" {
+			t.Errorf("rpoplpush moved %q", v)
+		}
+		s.Lpop(ctx, "q")
+		if _, err := s.Lpop(ctx, "q"); err != ErrNil {
+			t.Errorf("lpop empty queue error %v", err)
+		}
+		s.Rpush(ctx, "q", "x", "y", "x", "z", "x")
+		if v, err := s.Lmove(ctx, "q", "q3"); err != nil || v != "x" {
+			t.Errorf("lmove = %q, %v", v, err)
+		}
+		if n, _ := s.Lrem(ctx, "q", -1, "x"); n != 1 {
+			t.Errorf("lrem from tail removed %d", n)
+		}
+		if values, _ := s.Lrange(ctx, "q", 0, -1); len(values) != 3 || values[1] != "x" {
+			t.Errorf("after lrem %q", values)
+		}
+		if n, _ := s.Lrem(ctx, "q", 0, "x"); n != 1 {
+			t.Errorf("lrem all removed %d", n)
+		}
+		if n, _ := s.Lrem(ctx, "q3", 1, "x"); n != 1 {
+			t.Errorf("lrem moved value removed %d", n)
+		}
+		if n, _ := s.Len(ctx, "q3"); n != 0 {
+			t.Errorf("empty list len = %d", n)
+		}
+		if _, err := s.Lmove(ctx, "missing", "q3"); err != ErrNil {
+			t.Errorf("lmove empty queue error %v", err)
+		}
+	})
+}
+
+func TestStoreProxyRecord(t *testing.T) {
+	testStores(t, func(t *testing.T, s ProxyStore) {
+		proxy := core.NewProxy("3.3.3.3", 3128, core.PROXY_SOURCE_SCAN, "3.3.0.0_3.3.3.0")
+		proxy.Anonymity = core.HighAnonymous
+		if err := SaveProxy(ctx, s, proxy); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadProxy(ctx, s, proxy.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(loaded, proxy) {
+			t.Errorf("loaded %+v, want %+v", loaded, proxy)
+		}
+		if _, err := LoadProxy(ctx, s, "9.9.9.9:80"); err == nil {
+			t.Error("missing proxy should be an error")
+		}
+		proxies := LoadProxies(ctx, s, []string{proxy.Addr(), "9.9.9.9:80"})
+		if len(proxies) != 2 || proxies[1].Anonymity != core.Unknown {
+			t.Errorf("load proxies %+v", proxies)
+		}
+	})
+}
+
+func TestStoreScoredPool(t *testing.T) {
+	testStores(t, func(t *testing.T, s ProxyStore) {
+		scores := map[string]float64{"1.1.1.1:80": 30, "2.2.2.2:80": 90, "3.3.3.3:80": 60}
+		for addr, score := range scores {
+			ip, port, _ := core.ParseProxyAddr(addr)
+			proxy := core.NewProxy(ip, port, core.PROXY_SOURCE_CRAW, "")
+			SaveProxy(ctx, s, proxy)
+			s.Zadd(ctx, core.PROXY_POOL_VALID, score, addr)
+		}
+		top, err := TopProxies(ctx, s, core.PROXY_POOL_VALID, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(top) != 2 || top[0].Addr() != "2.2.2.2:80" || top[1].Addr() != "3.3.3.3:80" || top[0].Score != 90 {
+			t.Errorf("top proxies %+v", top)
+		}
+		above, err := ProxiesAboveScore(ctx, s, core.PROXY_POOL_VALID, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(above) != 2 || above[1].Score != 60 {
+			t.Errorf("proxies above 50 %+v", above)
+		}
+		proxy := top[1]
+		proxy.Score = 10
+		if err := UpdatePoolScore(ctx, s, core.PROXY_POOL_VALID, proxy); err != nil {
+			t.Fatal(err)
+		}
+		if score, _ := s.Zscore(ctx, core.PROXY_POOL_VALID, proxy.Addr()); score != 10 {
+			t.Errorf("updated score %v", score)
+		}
+		outsider := core.NewProxy("4.4.4.4", 80, core.PROXY_SOURCE_SCAN, "")
+		UpdatePoolScore(ctx, s, core.PROXY_POOL_VALID, outsider)
+		if n, _ := s.Zcard(ctx, core.PROXY_POOL_VALID); n != 3 {
+			t.Errorf("update score should not add members, card %d", n)
+		}
+		if n, _ := s.Zrem(ctx, core.PROXY_POOL_VALID, "1.1.1.1:80", "9.9.9.9:80"); n != 1 {
+			t.Errorf("zrem removed %d", n)
+		}
+	})
+}
+
+func TestStorePipelined(t *testing.T) {
+	testStores(t, func(t *testing.T, s ProxyStore) {
+		proxy := core.NewProxy("5.5.5.5", 8080, core.PROXY_SOURCE_CRAW, "")
+		err := s.Pipelined(ctx, func(pipe Pipeliner) {
+			pipe.Hmset(core.GetProxyDataKey(proxy.Addr()), proxy.ToHash())
+			pipe.Zadd(core.PROXY_POOL_VALID, 50, proxy.Addr())
+			pipe.Sadd(core.PROXY_POOL_HISTORY, proxy.Addr())
+			pipe.Rpush(core.PROXY_CHECK_QUEUE, "a", "b")
+			pipe.Rpush(core.PROXY_CHECK_QUEUE)
+			pipe.Incr("counter")
+			pipe.Set("k", "v")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded, err := LoadProxy(ctx, s, proxy.Addr()); err != nil || !reflect.DeepEqual(loaded, proxy) {
+			t.Errorf("pipelined proxy %+v, %v", loaded, err)
+		}
+		if n, _ := s.Len(ctx, core.PROXY_CHECK_QUEUE); n != 2 {
+			t.Errorf("pipelined queue len %d", n)
+		}
+		if v, _ := s.Get(ctx, "counter"); v != "1" {
+			t.Errorf("pipelined counter %q", v)
+		}
+		err = s.Pipelined(ctx, func(pipe Pipeliner) {
+			pipe.Sadd("k", "x")
+		})
+		if err != ErrWrongType {
+			t.Errorf("pipelined wrong type error %v", err)
+		}
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		if err := s.Set(cancelled, "k", "v"); err == nil {
+			t.Error("cancelled context should fail")
+		}
+	})
+}
+
+//过期后不再读取的键由定期清理从存储中删除
+func TestStoreSweepExpired(t *testing.T) {
+	memory := NewMemoryStore()
+	memory.sweepInterval = 0
+	boltStore := newTestBoltStore(t)
+	boltStore.sweepInterval = 0
+	for _, s := range []ProxyStore{memory, boltStore} {
+		s.SetNX(ctx, "seen", "1", 10*time.Millisecond)
+		s.SetNX(ctx, "kept", "1", time.Minute)
+	}
+	time.Sleep(20 * time.Millisecond)
+	for _, s := range []ProxyStore{memory, boltStore} {
+		s.Set(ctx, "other", "1")
+	}
+	if _, ok := memory.data["seen"]; ok || memory.data["kept"] == nil {
+		t.Errorf("memory keys after sweep: %v", memory.data)
+	}
+	boltStore.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if bucket.Get([]byte("seen")) != nil || bucket.Get([]byte("kept")) == nil {
+			t.Errorf("bolt keys after sweep: seen %q, kept %q", bucket.Get([]byte("seen")), bucket.Get([]byte("kept")))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,366 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fproxy/builder"
+	"fproxy/core"
+	"fproxy/stats"
+	"fproxy/store"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FORMAT_JSONL = "jsonl"
+	FORMAT_CSV   = "csv"
+	FORMAT_TEXT  = "text"
+)
+
+const (
+	POOL_VALID       = "valid"
+	POOL_ANONYMOUS   = "anonymous"
+	POOL_TRANSPARENT = "transparent"
+	POOL_HISTORY     = "history"
+	POOL_VPS         = "vps"
+)
+
+//按匿名级别划分的评分池
+var scoredPools = map[string]string{
+	POOL_VALID:       core.PROXY_POOL_VALID,
+	POOL_ANONYMOUS:   core.PROXY_POOL_ANONYMOUS,
+	POOL_TRANSPARENT: core.PROXY_POOL_TRANSPARENT,
+}
+
+//导入目标，pool按记录的池写回，queue放入检测队列重新检测
+const (
+	IMPORT_POOL  = "pool"
+	IMPORT_QUEUE = "queue"
+)
+
+//每批写入的记录数
+const IMPORT_BATCH_SIZE = 500
+
+/*
+*导出导入的代理记录，Pool为所在的池，VPS池的记录带有vps名称及启动时间
+ */
+type Record struct {
+	Pool string
+	core.Proxy
+	VPSName      string `json:",omitempty"`
+	VPSStartTime int64  `json:",omitempty"`
+}
+
+//根据文件扩展名判断格式，无法判断时按纯文本处理
+func FormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".json":
+		return FORMAT_JSONL
+	case ".csv":
+		return FORMAT_CSV
+	default:
+		return FORMAT_TEXT
+	}
+}
+
+func Export(ctx context.Context, proxyStore store.ProxyStore, w io.Writer, format string, pools []string) (int, error) {
+	records, err := ReadRecords(ctx, proxyStore, pools)
+	if err != nil {
+		return 0, err
+	}
+	return len(records), WriteRecords(w, format, records)
+}
+
+//导入检测队列时与爬取、扫描一样经dedup去重，并由recorder记录发现及被过滤的数量
+func Import(ctx context.Context, proxyStore store.ProxyStore, r io.Reader, format, into, defaultPool string, dedup *store.Deduper, recorder *stats.Recorder) (int, error) {
+	records, err := ParseRecords(r, format, defaultPool)
+	if err != nil {
+		return 0, err
+	}
+	return ImportRecords(ctx, proxyStore, records, into, dedup, recorder)
+}
+
+func ReadRecords(ctx context.Context, proxyStore store.ProxyStore, pools []string) ([]Record, error) {
+	records := make([]Record, 0)
+	for _, pool := range pools {
+		switch pool {
+		case POOL_VALID, POOL_ANONYMOUS, POOL_TRANSPARENT:
+			members, err := proxyStore.Zrevrange(ctx, scoredPools[pool], 0, -1)
+			if err != nil {
+				return nil, err
+			}
+			addrs := make([]string, len(members))
+			scores := make(map[string]float64, len(members))
+			for i, member := range members {
+				addrs[i] = member.Member
+				scores[member.Member] = member.Score
+			}
+			for _, proxy := range store.LoadProxies(ctx, proxyStore, addrs) {
+				//以池中的评分为准
+				proxy.Score = scores[proxy.Addr()]
+				records = append(records, Record{Pool: pool, Proxy: proxy})
+			}
+		case POOL_HISTORY:
+			addrs, err := proxyStore.Smembers(ctx, core.PROXY_POOL_HISTORY)
+			if err != nil {
+				return nil, err
+			}
+			sort.Strings(addrs)
+			for _, proxy := range store.LoadProxies(ctx, proxyStore, addrs) {
+				records = append(records, Record{Pool: pool, Proxy: proxy})
+			}
+		case POOL_VPS:
+			vps := &builder.VPS{Store: proxyStore}
+			vpsProxies, err := vps.ListVPS(ctx)
+			if err != nil {
+				return nil, err
+			}
+			names := make([]string, 0, len(vpsProxies))
+			for name := range vpsProxies {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				vpsProxy := vpsProxies[name]
+				proxy := core.Proxy{Ip: vpsProxy.IP, Port: vpsProxy.Port, Anonymity: core.Unknown}
+				records = append(records, Record{Pool: pool, Proxy: proxy, VPSName: name, VPSStartTime: vpsProxy.StartTime})
+			}
+		default:
+			return nil, errors.New("unknown pool: " + pool)
+		}
+	}
+	return records, nil
+}
+
+func WriteRecords(w io.Writer, format string, records []Record) error {
+	switch format {
+	case FORMAT_JSONL:
+		encoder := json.NewEncoder(w)
+		for _, record := range records {
+			err := encoder.Encode(record)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case FORMAT_CSV:
+		writer := csv.NewWriter(w)
+		columns := csvColumns()
+		err := writer.Write(columns)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			hash := recordHash(record)
+			row := make([]string, len(columns))
+			for i, column := range columns {
+				row[i] = hash[column]
+			}
+			err = writer.Write(row)
+			if err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case FORMAT_TEXT:
+		bw := bufio.NewWriter(w)
+		for _, record := range records {
+			bw.WriteString(textLine(record.Proxy) + "\n")
+		}
+		return bw.Flush()
+	default:
+		return errors.New("unknown format: " + format)
+	}
+}
+
+//defaultPool用于未带池信息的记录，纯文本格式全部使用defaultPool
+func ParseRecords(r io.Reader, format, defaultPool string) ([]Record, error) {
+	records := make([]Record, 0)
+	switch format {
+	case FORMAT_JSONL:
+		decoder := json.NewDecoder(r)
+		for {
+			//缺少的字段与core.NewProxy的默认值一致，未检测的代理不会被当作透明代理
+			record := Record{Proxy: core.Proxy{Protocol: core.PROXY_PROTOCOL_HTTP, Anonymity: core.Unknown}}
+			err := decoder.Decode(&record)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	case FORMAT_CSV:
+		reader := csv.NewReader(r)
+		rows, err := reader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			return records, nil
+		}
+		header := rows[0]
+		for line, row := range rows[1:] {
+			hash := make(map[string]string, len(header))
+			for i, column := range header {
+				hash[column] = row[i]
+			}
+			record, err := recordFromHash(hash)
+			if err != nil {
+				return nil, errors.New("csv line " + strconv.Itoa(line+2) + ": " + err.Error())
+			}
+			records = append(records, record)
+		}
+	case FORMAT_TEXT:
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			parsed, err := core.ParseProxyURL(line)
+			if err != nil {
+				return nil, err
+			}
+			proxy := core.NewProxy(parsed.Ip, parsed.Port, core.PROXY_SOURCE_IMPORT, "")
+			proxy.Protocol, proxy.Username, proxy.Password = parsed.Protocol, parsed.Username, parsed.Password
+			records = append(records, Record{Proxy: proxy})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unknown format: " + format)
+	}
+	for i := range records {
+		if records[i].Pool == "" {
+			records[i].Pool = defaultPool
+		}
+	}
+	return records, nil
+}
+
+//按批写入，返回处理的记录数，导入检测队列时包括被去重过滤的记录
+func ImportRecords(ctx context.Context, proxyStore store.ProxyStore, records []Record, into string, dedup *store.Deduper, recorder *stats.Recorder) (int, error) {
+	if into != IMPORT_POOL && into != IMPORT_QUEUE {
+		return 0, errors.New("unknown import target: " + into)
+	}
+	for _, record := range records {
+		if into == IMPORT_POOL && scoredPools[record.Pool] == "" && record.Pool != POOL_HISTORY && record.Pool != POOL_VPS {
+			return 0, errors.New("unknown pool of " + record.Addr() + ": " + record.Pool)
+		}
+		if into == IMPORT_POOL && record.Pool == POOL_VPS && record.VPSName == "" {
+			return 0, errors.New("vps record " + record.Addr() + " without vps name")
+		}
+		if into == IMPORT_POOL && scoredPools[record.Pool] != "" && scoredPools[record.Pool] != record.Proxy.Pool() {
+			return 0, errors.New("anonymity " + strconv.Itoa(record.Anonymity) + " of " + record.Addr() + " does not match pool " + record.Pool)
+		}
+	}
+	for start := 0; start < len(records); start += IMPORT_BATCH_SIZE {
+		end := start + IMPORT_BATCH_SIZE
+		if end > len(records) {
+			end = len(records)
+		}
+		if into == IMPORT_QUEUE {
+			proxies := make([]core.Proxy, 0, end-start)
+			for _, record := range records[start:end] {
+				proxies = append(proxies, record.Proxy)
+			}
+			candidates, suppressed := builder.PrepareCandidates(ctx, dedup, proxies)
+			err := proxyStore.Pipelined(ctx, func(pipe store.Pipeliner) {
+				builder.PushCandidates(pipe, recorder, core.PROXY_SOURCE_IMPORT, candidates, suppressed)
+			})
+			if err != nil {
+				return start, err
+			}
+			continue
+		}
+		var batchErr error
+		err := proxyStore.Pipelined(ctx, func(pipe store.Pipeliner) {
+			for _, record := range records[start:end] {
+				err := importToPool(pipe, record)
+				if err != nil {
+					batchErr = err
+					return
+				}
+			}
+		})
+		if err == nil {
+			err = batchErr
+		}
+		if err != nil {
+			return start, err
+		}
+	}
+	return len(records), nil
+}
+
+func importToPool(pipe store.Pipeliner, record Record) error {
+	addr := record.Addr()
+	switch record.Pool {
+	case POOL_VALID, POOL_ANONYMOUS, POOL_TRANSPARENT:
+		pipe.Hmset(core.GetProxyDataKey(addr), record.Proxy.ToHash())
+		pipe.Zadd(scoredPools[record.Pool], record.Score, addr)
+		//与检测通过的代理一样加入历史池，移出评分池后仍会复检
+		pipe.Sadd(core.PROXY_POOL_HISTORY, addr)
+	case POOL_HISTORY:
+		pipe.Hmset(core.GetProxyDataKey(addr), record.Proxy.ToHash())
+		pipe.Sadd(core.PROXY_POOL_HISTORY, addr)
+	case POOL_VPS:
+		vpsProxy := builder.VPSProxy{IP: record.Ip, Port: record.Port, StartTime: record.VPSStartTime, LeftSecond: builder.VPS_ALIVE_TIME}
+		bs, err := json.Marshal(vpsProxy)
+		if err != nil {
+			return err
+		}
+		pipe.Sadd(builder.VPS_PROXY_SET, record.VPSName)
+		pipe.Set(builder.VPS_PROXY_DATA+record.VPSName, string(bs))
+	}
+	return nil
+}
+
+//csv列：池、vps信息，之后为代理记录的哈希字段，ip与port在前其余按字母序
+func csvColumns() []string {
+	fields := make([]string, 0)
+	for field := range (core.Proxy{}).ToHash() {
+		if field != "ip" && field != "port" {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return append([]string{"pool", "ip", "port", "vpsName", "vpsStartTime"}, fields...)
+}
+
+func recordHash(record Record) map[string]string {
+	hash := record.Proxy.ToHash()
+	hash["pool"] = record.Pool
+	hash["vpsName"] = record.VPSName
+	if record.VPSStartTime != 0 {
+		hash["vpsStartTime"] = strconv.FormatInt(record.VPSStartTime, 10)
+	}
+	return hash
+}
+
+func recordFromHash(hash map[string]string) (Record, error) {
+	proxy, err := core.NewProxyFromHash(hash)
+	if err != nil {
+		return Record{}, err
+	}
+	startTime, _ := strconv.ParseInt(hash["vpsStartTime"], 10, 64)
+	return Record{Pool: hash["pool"], Proxy: proxy, VPSName: hash["vpsName"], VPSStartTime: startTime}, nil
+}
+
+//http代理且无认证时只写ip:port，否则写带协议的地址
+func textLine(proxy core.Proxy) string {
+	if (proxy.Protocol == "" || proxy.Protocol == core.PROXY_PROTOCOL_HTTP) && proxy.Username == "" && proxy.Password == "" {
+		return proxy.Addr()
+	}
+	return proxy.URL()
+}